@@ -0,0 +1,123 @@
+// Package auth authenticates requests with API keys. Keys are only ever
+// stored as SHA-256 hashes, and each key is granted a set of scopes.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/elehner/takehomeserver/middleware"
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	ErrorMissingKey      = "An API key is required"
+	ErrorInvalidKey      = "The API key is not valid"
+	ErrorMissingScope    = "The API key is not allowed to make this request"
+	ErrorLookupFailed    = "Error verifying the API key"
+	APIKeyHeader         = "X-API-Key"
+	authenticateResponse = `Bearer realm="takehomeserver"`
+)
+
+// Scopes granted to API keys.
+const (
+	ScopeUserWrite    = "user:write"
+	ScopeImageConvert = "image:convert"
+)
+
+// ErrKeyNotFound is returned by a Store when no key matches the hash.
+var ErrKeyNotFound = errors.New("api key not found")
+
+// Key is an API key, identified by the hash of its secret.
+type Key struct {
+	ID     string   `json:"id"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+}
+
+// HasScope reports whether the key was granted the scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Store finds API keys by the hash of their secret.
+type Store interface {
+	Lookup(ctx context.Context, hash string) (*Key, error)
+}
+
+type contextKey struct{}
+
+// HashKey returns the hex encoded SHA-256 hash under which a key is stored.
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyFromContext returns the key which authenticated the request, if any.
+func KeyFromContext(ctx context.Context) (*Key, bool) {
+	key, ok := ctx.Value(contextKey{}).(*Key)
+	return key, ok
+}
+
+// Require rejects requests which don't carry a key with the given scope.
+// The key is read from the Authorization bearer token or the X-API-Key
+// header, and made available to later handlers through KeyFromContext.
+func Require(store Store, scope string) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret := secretFromRequest(r)
+			if secret == "" {
+				w.Header().Set("WWW-Authenticate", authenticateResponse)
+				problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, ErrorMissingKey))
+				return
+			}
+
+			key, err := store.Lookup(r.Context(), HashKey(secret))
+			if errors.Is(err, ErrKeyNotFound) {
+				w.Header().Set("WWW-Authenticate", authenticateResponse+`, error="invalid_token"`)
+				problem.Write(w, r, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, ErrorInvalidKey))
+				return
+			} else if err != nil {
+				problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorLookupFailed))
+				return
+			}
+
+			if !key.HasScope(scope) {
+				problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeForbidden, ErrorMissingScope).
+					WithDetail("the "+scope+" scope is required"))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, key)))
+		})
+	}
+}
+
+// ByKey keys rate limits by the ID of the API key which authenticated the
+// request, for use with ratelimit.Middleware after Require.
+func ByKey(r *http.Request) string {
+	key, ok := KeyFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return "key:" + key.ID
+}
+
+func secretFromRequest(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		scheme, token, found := strings.Cut(authorization, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get(APIKeyHeader))
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type failingStore struct{}
+
+func (failingStore) Lookup(ctx context.Context, hash string) (*Key, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func TestHashKey(t *testing.T) {
+	// echo -n secret | sha256sum
+	expected := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	if HashKey("secret") != expected {
+		t.Errorf("Hash was %s, expected %s", HashKey("secret"), expected)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	store, err := NewFileStore([]*Key{
+		{ID: "users-only", Hash: HashKey("user-secret"), Scopes: []string{ScopeUserWrite}},
+		{ID: "everything", Hash: HashKey("all-secret"), Scopes: []string{ScopeUserWrite, ScopeImageConvert}},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tests := []struct {
+		store                Store
+		headerName           string
+		headerValue          string
+		expectedResponseCode int
+		expectedKeyID        string
+	}{
+		{store, "", "", http.StatusUnauthorized, ""},
+		{store, "Authorization", "Bearer wrong-secret", http.StatusUnauthorized, ""},
+		{store, "Authorization", "Basic all-secret", http.StatusUnauthorized, ""},
+		{store, "Authorization", "Bearer user-secret", http.StatusForbidden, ""},
+		{store, "Authorization", "Bearer all-secret", http.StatusOK, "everything"},
+		{store, "Authorization", "bearer all-secret", http.StatusOK, "everything"},
+		{store, APIKeyHeader, "all-secret", http.StatusOK, "everything"},
+		{failingStore{}, APIKeyHeader, "all-secret", http.StatusInternalServerError, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Require=%d", i), func(t *testing.T) {
+			keyID := ""
+			handler := Require(test.store, ScopeImageConvert)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key, _ := KeyFromContext(r.Context())
+				keyID = key.ID
+				if ByKey(r) != "key:"+key.ID {
+					t.Errorf("Rate limit key was %s, expected key:%s", ByKey(r), key.ID)
+				}
+			}))
+			req := httptest.NewRequest("POST", "http://localhost:8080/image", nil)
+			if test.headerName != "" {
+				req.Header.Set(test.headerName, test.headerValue)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if keyID != test.expectedKeyID {
+				t.Errorf("Key was %q, expected %q", keyID, test.expectedKeyID)
+			}
+			if (w.Code == http.StatusUnauthorized) != (w.Header().Get("WWW-Authenticate") != "") {
+				t.Error("Expected WWW-Authenticate to be set on 401 responses only")
+			}
+		})
+	}
+}
+
+func TestLoadFileStore(t *testing.T) {
+	tests := []struct {
+		contents     string
+		expectsError bool
+	}{
+		{`[{"id": "svc", "hash": "2BB80D537B1DA3E38BD30361AA855686BDE0EACD7162FEF6A25FE97BF527A25B", "scopes": ["user:write"]}]`, false},
+		{`[]`, false},
+		{`not json`, true},
+		// Raw keys are rejected, only hashes may be stored
+		{`[{"id": "svc", "hash": "secret", "scopes": ["user:write"]}]`, true},
+		{`[{"hash": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}]`, true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("LoadFileStore=%d", i), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			store, err := LoadFileStore(path)
+			if (err != nil) != test.expectsError {
+				t.Fatalf("Error was %v, expected an error: %t", err, test.expectsError)
+			}
+			if err == nil && len(store.keys) > 0 {
+				// Upper case hashes are normalized
+				if _, err := store.Lookup(context.Background(), HashKey("secret")); err != nil {
+					t.Errorf("Error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+/* API keys used by the server, for use with PostgreSQL */
+create table if not exists api_keys (
+  id text primary key,
+  /* hex encoded SHA-256 hash of the key, the key itself is never stored */
+  key_hash text not null unique,
+  /* space separated scopes, e.g. 'user:write image:convert' */
+  scopes text not null default '',
+  created_on timestamp default current_timestamp,
+  revoked_on timestamp
+);
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FileStore holds keys loaded from a JSON config file.
+type FileStore struct {
+	keys []*Key
+}
+
+// LoadFileStore reads keys from a JSON file containing an array of
+// {"id": ..., "hash": ..., "scopes": [...]} objects.
+func LoadFileStore(path string) (*FileStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []*Key
+	if err := json.NewDecoder(file).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return NewFileStore(keys)
+}
+
+// NewFileStore validates the keys and holds them in memory.
+func NewFileStore(keys []*Key) (*FileStore, error) {
+	for index, key := range keys {
+		if key.ID == "" || len(key.Hash) != 64 {
+			return nil, fmt.Errorf("the key at index %d needs an id and a hex encoded SHA-256 hash", index)
+		}
+		key.Hash = strings.ToLower(key.Hash)
+	}
+	return &FileStore{keys: keys}, nil
+}
+
+// Lookup compares the hash against every key in constant time.
+func (s *FileStore) Lookup(ctx context.Context, hash string) (*Key, error) {
+	var found *Key
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) == 1 {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, ErrKeyNotFound
+	}
+	return found, nil
+}
+
+// SQLStore reads keys from the api_keys table (see schema.sql).
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Lookup finds the active key with the given hash.
+func (s *SQLStore) Lookup(ctx context.Context, hash string) (*Key, error) {
+	key := &Key{Hash: hash}
+	var scopes string
+	err := s.db.QueryRowContext(ctx,
+		`select id, scopes from api_keys where key_hash = $1 and revoked_on is null`,
+		hash,
+	).Scan(&key.ID, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Fields(scopes)
+	return key, nil
+}
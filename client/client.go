@@ -0,0 +1,165 @@
+// Package client is a typed Go client for the takehome server, following the
+// operations described in openapi/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/elehner/takehomeserver/health"
+	"github.com/elehner/takehomeserver/images"
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/users"
+)
+
+// Client calls the takehome server's API.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient overrides the http.Client used for requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// New creates a client for the server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// TransformUsers sends the inputs to POST /v1/user and returns the transformed users.
+// Errors reported by the server are returned as a *problem.Problem.
+func (c *Client) TransformUsers(ctx context.Context, userInputs []users.UserInput) ([]users.UserOutput, error) {
+	body, err := json.Marshal(userInputs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, "POST", "/v1/user", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var userOutputs []users.UserOutput
+		if err := json.NewDecoder(resp.Body).Decode(&userOutputs); err != nil {
+			return nil, fmt.Errorf("decoding users: %w", err)
+		}
+		return userOutputs, nil
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, readProblem(resp)
+	}
+}
+
+// ConvertImage sends a JPEG to POST /v1/image and returns the converted PNG.
+// Errors reported by the server are returned as a *problem.Problem.
+func (c *Client) ConvertImage(ctx context.Context, jpeg io.Reader) ([]byte, error) {
+	resp, err := c.do(ctx, "POST", "/v1/image", "image/jpeg", jpeg)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readProblem(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// TransformImage sends a JPEG and the operations to apply to it to
+// POST /v1/image as JSON, returning the converted PNG.
+func (c *Client) TransformImage(ctx context.Context, jpeg []byte, operations []images.Operation) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{"image": jpeg, "operations": operations})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "/v1/image", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readProblem(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Version returns the build information reported by GET /version.
+func (c *Client) Version(ctx context.Context) (health.VersionInfo, error) {
+	var info health.VersionInfo
+	resp, err := c.do(ctx, "GET", "/version", "", nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, readProblem(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json, "+problem.ContentType)
+
+	return c.httpClient.Do(req)
+}
+
+// readProblem converts an error response into a *problem.Problem, building
+// one from the status and body when the server didn't send problem details.
+func readProblem(resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == problem.ContentType {
+		var p problem.Problem
+		if err := json.Unmarshal(body, &p); err == nil {
+			return &p
+		}
+	}
+
+	p := &problem.Problem{
+		Title:     strings.TrimSpace(string(body)),
+		Status:    resp.StatusCode,
+		RequestID: resp.Header.Get(problem.RequestIDHeader),
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(resp.StatusCode)
+	}
+	return p
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elehner/takehomeserver/health"
+	"github.com/elehner/takehomeserver/images"
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/users"
+)
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/user", users.HandleUserRequest)
+	mux.HandleFunc("/v1/image", images.HandleImageRequest)
+	mux.HandleFunc("/version", health.HandleVersion)
+	return httptest.NewServer(mux)
+}
+
+func TestTransformUsers(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := New(server.URL)
+
+	id, name, dateOfBirth, createdOn := 1, "Joe Smith", "1983-05-12", int64(1642612034)
+	userOutputs, err := c.TransformUsers(context.Background(), []users.UserInput{
+		{UserId: &id, Name: &name, DateOfBirth: &dateOfBirth, CreatedOn: &createdOn},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []users.UserOutput{{UserId: 1, Name: "Joe Smith", WeekdayOfBirth: "Thursday", CreatedOn: "2022-01-19T12:07:14-05:00"}}
+	if !reflect.DeepEqual(userOutputs, expected) {
+		t.Errorf("Received: %v, Expected: %v", userOutputs, expected)
+	}
+}
+
+func TestTransformUsersReturnsProblem(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := New(server.URL)
+
+	_, err := c.TransformUsers(context.Background(), []users.UserInput{{}})
+
+	var p *problem.Problem
+	if !errors.As(err, &p) {
+		t.Fatalf("Expected a problem, received %v", err)
+	}
+	if p.Status != http.StatusBadRequest || p.Code != problem.CodeInvalidInput || len(p.Errors) != 4 {
+		t.Errorf("Received unexpected problem: %v", p)
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := New(server.URL)
+
+	testImg, err := os.Open("../images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	defer testImg.Close()
+
+	converted, err := c.ConvertImage(context.Background(), testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(converted))
+	if err != nil {
+		t.Fatalf("Expected a PNG: %v", err)
+	}
+	if config.Width != 256 || config.Height != 172 {
+		t.Errorf("Bounds differed. Received %d, %d. Expected 256, 172.", config.Width, config.Height)
+	}
+
+	_, err = c.ConvertImage(context.Background(), strings.NewReader("this is not an image"))
+	var p *problem.Problem
+	if !errors.As(err, &p) || p.Code != problem.CodeInvalidImage {
+		t.Errorf("Expected an invalid image problem, received %v", err)
+	}
+}
+
+func TestTransformImage(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := New(server.URL)
+
+	testImg, err := os.ReadFile("../images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	converted, err := c.TransformImage(context.Background(), testImg, []images.Operation{{Op: images.OpRotate, Angle: 90}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(converted))
+	if err != nil {
+		t.Fatalf("Expected a PNG: %v", err)
+	}
+	if config.Width != 172 || config.Height != 256 {
+		t.Errorf("Bounds differed. Received %d, %d. Expected 172, 256.", config.Width, config.Height)
+	}
+
+	_, err = c.TransformImage(context.Background(), testImg, []images.Operation{{Op: "swirl"}})
+	var p *problem.Problem
+	if !errors.As(err, &p) || p.Code != problem.CodeInvalidInput {
+		t.Errorf("Expected an invalid input problem, received %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	c := New(server.URL)
+
+	info, err := c.Version(context.Background())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if info.GoVersion == "" {
+		t.Error("Expected the Go version to be reported")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elehner/takehomeserver/images"
+)
+
+// signingKeysEnv holds the comma separated hex keys signing transform URLs,
+// newest first.
+const signingKeysEnv = "IMAGE_SIGNING_KEYS"
+
+// command is a subcommand run instead of the server, such as
+// takehomeserver images sign.
+type command struct {
+	usage string
+	run   func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+}
+
+var commands = map[string]command{
+	"images convert":  {imagesConvertUsage, runImagesConvert},
+	"images sign":     {imagesSignUsage, runImagesSign},
+	"users transform": {usersTransformUsage, runUsersTransform},
+}
+
+// runCommand runs the subcommand named by the first two arguments,
+// returning its exit status.
+func runCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) >= 2 {
+		if command, ok := commands[args[0]+" "+args[1]]; ok {
+			return command.run(args[2:], stdin, stdout, stderr)
+		}
+	}
+	names := make([]string, 0, len(commands))
+	for name, command := range commands {
+		names = append(names, fmt.Sprintf("  takehomeserver %s %s", name, command.usage))
+	}
+	sort.Strings(names)
+	fmt.Fprintf(stderr, "Unknown command %q, expected one of:\n%s\n", strings.Join(args, " "), strings.Join(names, "\n"))
+	return 2
+}
+
+// loadSigner reads the signing keys from the environment, returning nil
+// when none are set.
+func loadSigner() (*images.Signer, error) {
+	keys, err := images.ParseSigningKeys(os.Getenv(signingKeysEnv))
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return images.NewSigner(keys...)
+}
+
+const imagesSignUsage = "[-expires duration] url..."
+
+// runImagesSign prints each URL signed with the newest key, so it can be
+// served by /v2/image/signed.
+func runImagesSign(args []string, _ io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("images sign", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	expires := flags.Duration("expires", 0, "how long the URLs are accepted for, or 0 for as long as their key is")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: takehomeserver images sign %s\n\nSigns transform URLs such as /v2/image/signed?key=<key>&op=grayscale with the first key in %s.\n", imagesSignUsage, signingKeysEnv)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	signer, err := loadSigner()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error occurred while loading the signing keys: %s\n", err.Error())
+		return 1
+	}
+	if signer == nil {
+		fmt.Fprintf(stderr, "%s must be set to sign URLs\n", signingKeysEnv)
+		return 1
+	}
+	var expiry time.Time
+	if *expires > 0 {
+		expiry = time.Now().Add(*expires)
+	}
+	for _, rawURL := range flags.Args() {
+		signed, err := signer.Sign(rawURL, expiry)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error occurred while signing %s: %s\n", rawURL, err.Error())
+			return 1
+		}
+		fmt.Fprintln(stdout, signed)
+	}
+	return 0
+}
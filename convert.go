@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elehner/takehomeserver/images"
+)
+
+const (
+	imagesConvertUsage = "[-out dir] [-name template] [-workers n] [-format png|jpeg] [-quality n] [-op op]... [-force] path..."
+
+	// defaultConvertName keeps each converted image's directory and name,
+	// marking it as a thumbnail so it never replaces its input.
+	defaultConvertName = "{dir}/{name}_thumb{ext}"
+)
+
+// convertExtensions are the extensions of the images found in the
+// directories given to images convert.
+var convertExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".gif": true}
+
+// stringsFlag collects every value of a repeated flag.
+type stringsFlag []string
+
+func (values *stringsFlag) String() string {
+	return strings.Join(*values, ",")
+}
+
+func (values *stringsFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
+}
+
+// convertFile is an image found by images convert, with the directory its
+// output's {dir} is relative to.
+type convertFile struct {
+	input string
+	// dir is the input's directory relative to the path it was found
+	// under, and outDir the directory its output's path is relative to.
+	dir    string
+	outDir string
+	// output is the path the converted image is written to, set by
+	// planOutputs.
+	output string
+}
+
+// convertResult is the outcome of converting one file.
+type convertResult struct {
+	file    convertFile
+	skipped bool
+	err     error
+}
+
+// batchConverter converts the images found by images convert.
+type batchConverter struct {
+	name    string
+	format  string
+	options images.Options
+	force   bool
+}
+
+// runImagesConvert thumbnails every JPEG and GIF in the paths, like
+// /image, printing a summary once they're done.
+func runImagesConvert(args []string, _ io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("images convert", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	out := flags.String("out", "", "directory the converted images are written under, instead of the directory each path was found in")
+	name := flags.String("name", defaultConvertName, "path of each converted image under -out, from its relative {dir}, {name} without its extension and the {ext} of its new format")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of images converted at once")
+	format := flags.String("format", "", "format of the converted images, png or jpeg, keeping animated GIFs as GIFs when empty")
+	quality := flags.Int("quality", 0, "JPEG quality from 1 to 100")
+	var operations stringsFlag
+	flags.Var(&operations, "op", "operation applied before resizing, such as rotate:90, which may be repeated")
+	force := flags.Bool("force", false, "convert images even when their output is newer than them")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: takehomeserver images convert %s\n\nConverts the JPEGs and GIFs in each path into 256x256 bounded thumbnails.\n", imagesConvertUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *workers < 1 {
+		fmt.Fprintln(stderr, "-workers must be at least 1")
+		return 2
+	}
+	if !strings.Contains(*name, "{name}") {
+		fmt.Fprintln(stderr, "-name must include {name}, so each image has its own output")
+		return 2
+	}
+
+	ops, err := images.ParseOperations(url.Values{"op": operations})
+	if err == nil {
+		err = images.ValidateOperations(ops)
+	}
+	if err == nil {
+		err = images.ValidateFormat(*format, *quality, false, images.PNGOptions{})
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid conversion options: %s\n", err.Error())
+		return 2
+	}
+
+	files, err := findImages(flags.Args(), *out)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error occurred while finding images: %s\n", err.Error())
+		return 1
+	}
+	converter := &batchConverter{
+		name:    *name,
+		format:  *format,
+		options: images.Options{Operations: ops, Format: *format, Quality: *quality},
+		force:   *force,
+	}
+	files, err = converter.planOutputs(files)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\nChange -name or -out so each image has its own output\n", err.Error())
+		return 2
+	}
+
+	start := time.Now()
+	var converted, skipped, failed int
+	for result := range converter.convertAll(files, *workers) {
+		switch {
+		case result.err != nil:
+			failed++
+			fmt.Fprintf(stderr, "Error occurred while converting %s: %s\n", result.file.input, result.err.Error())
+		case result.skipped:
+			skipped++
+		default:
+			converted++
+		}
+	}
+	fmt.Fprintf(stdout, "Converted %d of %d images in %s: %d up to date, %d failed\n",
+		converted, len(files), time.Since(start).Round(time.Millisecond), skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// findImages lists the images to convert. Directories are walked for
+// JPEGs and GIFs, while files are converted whatever their extension.
+// Directories under out are skipped, so converted images aren't converted
+// again.
+func findImages(paths []string, out string) ([]convertFile, error) {
+	var files []convertFile
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		outDir := out
+		if !info.IsDir() {
+			if outDir == "" {
+				outDir = filepath.Dir(root)
+			}
+			files = append(files, convertFile{input: root, dir: ".", outDir: outDir})
+			continue
+		}
+
+		if outDir == "" {
+			outDir = root
+		}
+		err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if out != "" && path != root && sameFile(path, out) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || !convertExtensions[strings.ToLower(filepath.Ext(path))] {
+				return nil
+			}
+			dir, err := filepath.Rel(root, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			files = append(files, convertFile{input: path, dir: dir, outDir: outDir})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// sameFile reports whether both paths name the same existing file or
+// directory.
+func sameFile(a string, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	return err == nil && os.SameFile(infoA, infoB)
+}
+
+// planOutputs sets the output of every file, failing when a file would be
+// converted over itself or several files to the same output, such as a.jpg
+// and a.jpeg. Files which are another file's output, left by an earlier
+// run, are dropped rather than converted again.
+func (c *batchConverter) planOutputs(files []convertFile) ([]convertFile, error) {
+	outputs := map[string]bool{}
+	for i := range files {
+		files[i].output = filepath.Clean(c.outputPath(files[i], c.animated(files[i])))
+		outputs[files[i].output] = true
+	}
+
+	var planned []convertFile
+	inputs := map[string]string{}
+	var problems []string
+	for _, file := range files {
+		if file.output == filepath.Clean(file.input) || sameFile(file.output, file.input) {
+			problems = append(problems, fmt.Sprintf("%s would be converted over itself", file.input))
+			continue
+		}
+		if outputs[filepath.Clean(file.input)] {
+			continue
+		}
+		if input, ok := inputs[file.output]; ok {
+			problems = append(problems, fmt.Sprintf("%s and %s would both be converted to %s", input, file.input, file.output))
+			continue
+		}
+		inputs[file.output] = file.input
+		planned = append(planned, file)
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+	return planned, nil
+}
+
+// animated reports whether the file is an animated GIF which is kept as a
+// GIF. Unless forced, a GIF with only one of its possible outputs up to
+// date is taken to be unchanged since then, so it isn't read; otherwise
+// it's read as far as its second frame.
+func (c *batchConverter) animated(file convertFile) bool {
+	if c.format != "" {
+		return false
+	}
+	input, err := os.Open(file.input)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(input, header); err != nil || !strings.HasPrefix(string(header), "GIF8") {
+		return false
+	}
+
+	if !c.force {
+		if info, err := input.Stat(); err == nil {
+			gifFresh := upToDate(c.outputPath(file, true), info)
+			if pngFresh := upToDate(c.outputPath(file, false), info); gifFresh != pngFresh {
+				return gifFresh
+			}
+		}
+	}
+	return images.AnimatedReader(io.MultiReader(bytes.NewReader(header), input))
+}
+
+// upToDate reports whether the output exists and is at least as new as
+// the input.
+func upToDate(output string, input fs.FileInfo) bool {
+	info, err := os.Stat(output)
+	return err == nil && !info.ModTime().Before(input.ModTime())
+}
+
+// convertAll converts the files on the given number of workers, sending
+// each result as it's finished. The channel is closed once every file has
+// been converted.
+func (c *batchConverter) convertAll(files []convertFile, workers int) <-chan convertResult {
+	pending := make(chan convertFile)
+	results := make(chan convertResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range pending {
+				results <- c.convert(file)
+			}
+		}()
+	}
+	go func() {
+		for _, file := range files {
+			pending <- file
+		}
+		close(pending)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// convert converts one file, skipping it without reading it when its
+// output is at least as new as it is.
+func (c *batchConverter) convert(file convertFile) convertResult {
+	result := convertResult{file: file}
+	input, err := os.Stat(file.input)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	if output, err := os.Stat(file.output); err == nil && !c.force && !output.ModTime().Before(input.ModTime()) {
+		result.skipped = true
+		return result
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		result.err = err
+		return result
+	}
+
+	upload, err := os.ReadFile(file.input)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	conversion, err := images.ConvertWithOptions(upload, c.options)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.err = writeFileAtomically(file.output, conversion.Data)
+	return result
+}
+
+// outputPath expands the name template for the file. The extension is
+// that of the format, or .gif for animated GIFs when no format is set.
+func (c *batchConverter) outputPath(file convertFile, animated bool) string {
+	extension := ".png"
+	switch {
+	case c.format == images.FormatJPEG:
+		extension = ".jpeg"
+	case animated:
+		extension = ".gif"
+	}
+	name := strings.TrimSuffix(filepath.Base(file.input), filepath.Ext(file.input))
+	expanded := strings.NewReplacer("{dir}", filepath.ToSlash(file.dir), "{name}", name, "{ext}", extension).Replace(c.name)
+	return filepath.Join(file.outDir, filepath.FromSlash(expanded))
+}
+
+// writeFileAtomically writes the file through a temporary file in its
+// directory, creating the directory if needed, so an interrupted batch
+// never leaves a partial image which would then look up to date.
+func writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -2,4 +2,10 @@ module github.com/elehner/takehomeserver
 
 go 1.19
 
-require golang.org/x/image v0.0.0-20220902085622-e7cb96979f69 // indirect
+require golang.org/x/image v0.0.0-20220902085622-e7cb96979f69
+
+require github.com/lib/pq v1.10.9
+
+require github.com/andybalholm/brotli v1.1.0
+
+require golang.org/x/text v0.3.7 // indirect
@@ -0,0 +1,193 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorMethodNotSupported = "Only GET and HEAD are supported"
+	StatusOK                = "ok"
+	StatusUnavailable       = "unavailable"
+)
+
+// buildTime can be set at link time with
+// -ldflags "-X github.com/elehner/takehomeserver/health.buildTime=<time>".
+// When unset, the VCS commit time from the build info is used instead.
+var buildTime string
+
+// checkTimeout bounds how long a single readiness check is allowed to run.
+const checkTimeout = 2 * time.Second
+
+// CheckFunc reports whether a dependency is usable, returning nil if it is.
+type CheckFunc func(ctx context.Context) error
+
+// Pinger is implemented by dependencies that can verify their own
+// connectivity, such as *sql.DB.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// Checker holds the named readiness checks that /readyz runs.
+type Checker struct {
+	mu     sync.RWMutex
+	checks map[string]CheckFunc
+}
+
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// VersionInfo describes the running binary.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified"`
+}
+
+func NewChecker() *Checker {
+	return &Checker{checks: make(map[string]CheckFunc)}
+}
+
+// Register adds (or replaces) a named readiness check.
+func (c *Checker) Register(name string, check CheckFunc) {
+	c.mu.Lock()
+	c.checks[name] = check
+	c.mu.Unlock()
+}
+
+// Run executes every registered check and returns the failure message
+// (or StatusOK) for each by name, along with whether all checks passed.
+func (c *Checker) Run(ctx context.Context) (results map[string]string, ready bool) {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]CheckFunc, len(names))
+	for index, name := range names {
+		checks[index] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	results = make(map[string]string, len(names))
+	ready = true
+	for index, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		err := check(checkCtx)
+		cancel()
+		if err != nil {
+			results[names[index]] = err.Error()
+			ready = false
+			continue
+		}
+		results[names[index]] = StatusOK
+	}
+
+	return results, ready
+}
+
+// HandleReadiness responds with 200 when every registered check passes,
+// and 503 along with the failing checks otherwise.
+func (c *Checker) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	if !allowedMethod(w, r) {
+		return
+	}
+
+	results, ready := c.Run(r.Context())
+	response := readinessResponse{Status: StatusOK, Checks: results}
+	statusCode := http.StatusOK
+	if !ready {
+		response.Status = StatusUnavailable
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, statusCode, response)
+}
+
+// HandleLiveness responds with 200 as long as the process is able to
+// serve requests at all. It intentionally checks no dependencies.
+func HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	if !allowedMethod(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// HandleVersion responds with the module version, commit and build time
+// embedded in the binary.
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowedMethod(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReadVersionInfo())
+}
+
+// ReadVersionInfo extracts the version details from the binary's build info.
+// Fields which cannot be determined are left empty.
+func ReadVersionInfo() VersionInfo {
+	info := VersionInfo{BuildTime: buildTime}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.Version = buildInfo.Main.Version
+	info.GoVersion = buildInfo.GoVersion
+	for _, setting := range buildInfo.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+
+	return info
+}
+
+// TimeZoneCheck verifies the time zone database can resolve the given location.
+func TimeZoneCheck(name string) CheckFunc {
+	return func(ctx context.Context) error {
+		_, err := time.LoadLocation(name)
+		return err
+	}
+}
+
+// PingCheck verifies connectivity to a dependency such as a database or cache.
+func PingCheck(pinger Pinger) CheckFunc {
+	return func(ctx context.Context) error {
+		return pinger.PingContext(ctx)
+	}
+}
+
+func allowedMethod(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD":
+		return true
+	default:
+		http.Error(w, ErrorMethodNotSupported, http.StatusMethodNotAllowed)
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,123 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (p fakePinger) PingContext(ctx context.Context) error {
+	return p.err
+}
+
+func TestHandleLiveness(t *testing.T) {
+	tests := []struct {
+		method               string
+		expectedResponseCode int
+	}{
+		{"GET", http.StatusOK},
+		{"HEAD", http.StatusOK},
+		{"POST", http.StatusMethodNotAllowed},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("HandleLiveness=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "localhost:8080/healthz", nil)
+			w := httptest.NewRecorder()
+
+			HandleLiveness(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleReadiness(t *testing.T) {
+	tests := []struct {
+		checks               map[string]CheckFunc
+		expectedResponseCode int
+		expectedResponse     readinessResponse
+	}{
+		{
+			map[string]CheckFunc{},
+			http.StatusOK,
+			readinessResponse{Status: StatusOK, Checks: map[string]string{}},
+		},
+		{
+			map[string]CheckFunc{
+				"timezone": TimeZoneCheck("EST"),
+				"database": PingCheck(fakePinger{}),
+			},
+			http.StatusOK,
+			readinessResponse{Status: StatusOK, Checks: map[string]string{"timezone": StatusOK, "database": StatusOK}},
+		},
+		// A single failing check marks the service as unavailable
+		{
+			map[string]CheckFunc{
+				"timezone": TimeZoneCheck("EST"),
+				"cache":    PingCheck(fakePinger{errors.New("connection refused")}),
+			},
+			http.StatusServiceUnavailable,
+			readinessResponse{Status: StatusUnavailable, Checks: map[string]string{"timezone": StatusOK, "cache": "connection refused"}},
+		},
+		{
+			map[string]CheckFunc{"timezone": TimeZoneCheck("Not/AZone")},
+			http.StatusServiceUnavailable,
+			readinessResponse{Status: StatusUnavailable, Checks: map[string]string{"timezone": "unknown time zone Not/AZone"}},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("HandleReadiness=%d", i), func(t *testing.T) {
+			checker := NewChecker()
+			for name, check := range test.checks {
+				checker.Register(name, check)
+			}
+			req := httptest.NewRequest("GET", "localhost:8080/readyz", nil)
+			w := httptest.NewRecorder()
+
+			checker.HandleReadiness(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			var response readinessResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if !reflect.DeepEqual(response, test.expectedResponse) {
+				t.Errorf("Received: %v, Expected: %v", response, test.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	req := httptest.NewRequest("GET", "localhost:8080/version", nil)
+	w := httptest.NewRecorder()
+
+	HandleVersion(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusOK, w.Code)
+	}
+	var info VersionInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	// Tests are built without VCS stamping, but the Go version is always known
+	if info.GoVersion == "" {
+		t.Error("Expected the Go version to be reported")
+	}
+}
@@ -0,0 +1,303 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elehner/takehomeserver/problem"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// blurHashComponents are the horizontal and vertical components of the
+	// BlurHash, enough for a placeholder without making the hash long.
+	blurHashXComponents = 4
+	blurHashYComponents = 3
+	// sampleSize is the longest side of the copy of the image which is
+	// hashed and clustered, since neither needs full resolution.
+	sampleSize       = 64
+	paletteSize      = 5
+	kMeansIterations = 20
+)
+
+// Analysis describes an image, for showing placeholders while it loads.
+type Analysis struct {
+	Width           int            `json:"width"`
+	Height          int            `json:"height"`
+	BlurHash        string         `json:"blurhash"`
+	DominantColor   string         `json:"dominant_color"`
+	Palette         []PaletteColor `json:"palette"`
+	HasTransparency bool           `json:"has_transparency"`
+	// AverageLuminance is the mean brightness from 0 (black) to 1 (white).
+	AverageLuminance float64 `json:"average_luminance"`
+	// ColorSpace is the color space of the upload, RGB, CMYK or GRAY,
+	// before it's converted to sRGB.
+	ColorSpace string `json:"color_space,omitempty"`
+	// ColorProfile describes the upload's embedded ICC profile.
+	ColorProfile string `json:"color_profile,omitempty"`
+}
+
+// PaletteColor is one of the image's main colors, with the fraction of the
+// image it covers.
+type PaletteColor struct {
+	Color    string  `json:"color"`
+	Fraction float64 `json:"fraction"`
+}
+
+// ServeAnalyze decodes the uploaded image like ServeHTTP and responds with
+// its Analysis as JSON.
+func (h *Handler) ServeAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
+		return
+	}
+
+	request, release, ok := h.readRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if len(request.files) > 1 {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidRequest).
+			WithDetail("only one image may be uploaded"))
+		return
+	}
+
+	decoded, err := decode(request.Image)
+	if err != nil {
+		problem.Write(w, r, ConversionProblem(err))
+		return
+	}
+
+	analysis := Analyze(decoded)
+	analysis.ColorSpace, analysis.ColorProfile = describeColor(request.Image)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analysis)
+}
+
+// Analyze measures the image. The BlurHash and palette are computed from a
+// reduced copy of the image.
+func Analyze(img image.Image) *Analysis {
+	bounds := img.Bounds()
+	scale := math.Min(1, float64(sampleSize)/float64(maxInt(bounds.Dx(), bounds.Dy())))
+	sample := image.NewNRGBA(image.Rect(0, 0,
+		maxInt(1, int(math.Round(float64(bounds.Dx())*scale))),
+		maxInt(1, int(math.Round(float64(bounds.Dy())*scale)))))
+	draw.ApproxBiLinear.Scale(sample, sample.Rect, img, bounds, draw.Src, nil)
+
+	analysis := &Analysis{
+		Width:           bounds.Dx(),
+		Height:          bounds.Dy(),
+		BlurHash:        blurHash(sample, blurHashXComponents, blurHashYComponents),
+		Palette:         palette(sample, paletteSize),
+		HasTransparency: hasTransparency(img),
+	}
+	if len(analysis.Palette) > 0 {
+		analysis.DominantColor = analysis.Palette[0].Color
+	}
+
+	var luminance float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			luminance += (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+		}
+	}
+	analysis.AverageLuminance = math.Round(luminance/float64(bounds.Dx()*bounds.Dy())*1000) / 1000
+	return analysis
+}
+
+func hasTransparency(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// palette clusters the opaque pixels with k-means, returning the clusters'
+// mean colors from the largest to the smallest.
+func palette(img *image.NRGBA, k int) []PaletteColor {
+	var pixels [][3]float64
+	for i := 0; i < len(img.Pix); i += 4 {
+		// Transparent pixels have no meaningful color
+		if img.Pix[i+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, [3]float64{float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])})
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	// Seed the centers deterministically, from pixels spread across the
+	// range of brightness
+	sorted := make([][3]float64, len(pixels))
+	copy(sorted, pixels)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0]+sorted[i][1]+sorted[i][2] < sorted[j][0]+sorted[j][1]+sorted[j][2]
+	})
+	if k > len(pixels) {
+		k = len(pixels)
+	}
+	centers := make([][3]float64, k)
+	for i := range centers {
+		centers[i] = sorted[(2*i+1)*len(sorted)/(2*k)]
+	}
+
+	assignments := make([]int, len(pixels))
+	counts := make([]int, k)
+	for iteration := 0; iteration < kMeansIterations; iteration++ {
+		changed := false
+		for i, pixel := range pixels {
+			nearest, nearestDistance := 0, math.Inf(1)
+			for j, center := range centers {
+				distance := 0.0
+				for c := range pixel {
+					distance += (pixel[c] - center[c]) * (pixel[c] - center[c])
+				}
+				if distance < nearestDistance {
+					nearest, nearestDistance = j, distance
+				}
+			}
+			if assignments[i] != nearest || iteration == 0 {
+				changed = true
+			}
+			assignments[i] = nearest
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][3]float64, k)
+		counts = make([]int, k)
+		for i, pixel := range pixels {
+			for c := range pixel {
+				sums[assignments[i]][c] += pixel[c]
+			}
+			counts[assignments[i]]++
+		}
+		for j := range centers {
+			if counts[j] > 0 {
+				for c := range centers[j] {
+					centers[j][c] = sums[j][c] / float64(counts[j])
+				}
+			}
+		}
+	}
+
+	var colors []PaletteColor
+	order := make([]int, k)
+	for j := range order {
+		order[j] = j
+	}
+	sort.SliceStable(order, func(a, b int) bool { return counts[order[a]] > counts[order[b]] })
+	for _, j := range order {
+		if counts[j] == 0 {
+			continue
+		}
+		colors = append(colors, PaletteColor{
+			Color:    fmt.Sprintf("#%02x%02x%02x", clampUint8(centers[j][0]), clampUint8(centers[j][1]), clampUint8(centers[j][2])),
+			Fraction: math.Round(float64(counts[j])/float64(len(pixels))*1000) / 1000,
+		})
+	}
+	return colors
+}
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes the image following https://github.com/woltapp/blurhash.
+func blurHash(img *image.NRGBA, xComponents int, yComponents int) string {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	factors := make([][3]float64, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					c := img.NRGBAAt(x, y)
+					factor[0] += basis * sRGBToLinear(c.R)
+					factor[1] += basis * sRGBToLinear(c.G)
+					factor[2] += basis * sRGBToLinear(c.B)
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors[j*xComponents+i] = [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale}
+		}
+	}
+
+	var hash strings.Builder
+	encodeBase83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		encodeBase83(&hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(&hash, 0, 1)
+	}
+
+	encodeBase83(&hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		var quantised [3]int
+		for c, value := range factor {
+			quantised[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		encodeBase83(&hash, quantised[0]*19*19+quantised[1]*19+quantised[2], 2)
+	}
+	return hash.String()
+}
+
+func encodeBase83(hash *strings.Builder, value int, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		hash.WriteByte(base83Characters[digit])
+	}
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
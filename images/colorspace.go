@@ -0,0 +1,402 @@
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ColorSpaceRGB  = "RGB"
+	ColorSpaceCMYK = "CMYK"
+	ColorSpaceGray = "GRAY"
+
+	iccMarker = "ICC_PROFILE\x00"
+	// maxCachedColors bounds the colors remembered while converting an
+	// image to sRGB.
+	maxCachedColors = 1 << 18
+)
+
+// jpegProfile returns the ICC profile embedded in a JPEG's APP2 segments,
+// which split profiles over 64KB into numbered chunks, or nil when it has
+// none.
+func jpegProfile(upload []byte) []byte {
+	if !bytes.HasPrefix(upload, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	chunks := map[int][]byte{}
+	count := 0
+	for offset := 2; offset+4 <= len(upload); {
+		if upload[offset] != 0xff {
+			break
+		}
+		marker := upload[offset+1]
+		// Markers without a length, and the padding between markers
+		if marker == 0xff {
+			offset++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			offset += 2
+			continue
+		}
+		// The profile must come before the image data
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(upload[offset+2:]))
+		if length < 2 || offset+2+length > len(upload) {
+			break
+		}
+		segment := upload[offset+4 : offset+2+length]
+		if marker == 0xe2 && len(segment) > len(iccMarker)+2 && string(segment[:len(iccMarker)]) == iccMarker {
+			sequence := int(segment[len(iccMarker)])
+			count = int(segment[len(iccMarker)+1])
+			chunks[sequence] = segment[len(iccMarker)+2:]
+		}
+		offset += 2 + length
+	}
+
+	if len(chunks) == 0 || len(chunks) != count {
+		return nil
+	}
+	sequences := make([]int, 0, len(chunks))
+	for sequence := range chunks {
+		sequences = append(sequences, sequence)
+	}
+	sort.Ints(sequences)
+	var profile []byte
+	for _, sequence := range sequences {
+		profile = append(profile, chunks[sequence]...)
+	}
+	return profile
+}
+
+// colorSpace returns the color space of pixels in the color model.
+func colorSpace(model color.Model) string {
+	switch model {
+	case color.CMYKModel:
+		return ColorSpaceCMYK
+	case color.GrayModel, color.Gray16Model:
+		return ColorSpaceGray
+	}
+	return ColorSpaceRGB
+}
+
+// toSRGB converts an image described by the ICC profile to sRGB. Images
+// are returned unchanged when they're already sRGB, or when the profile
+// doesn't match their color space or can't be applied.
+func toSRGB(img image.Image, profile *Profile) image.Image {
+	space := colorSpace(img.ColorModel())
+	if profile == nil || profile.ColorSpace != space {
+		return img
+	}
+	if space == ColorSpaceRGB && strings.HasPrefix(profile.Description, "sRGB") {
+		return img
+	}
+	toPCS, err := profile.transform()
+	if err != nil {
+		return img
+	}
+
+	// Photos repeat many colors, and lookup tables are slow to evaluate
+	cache := map[uint32]color.RGBA{}
+	convert := func(device []float64, key uint32) color.RGBA {
+		if c, ok := cache[key]; ok {
+			return c
+		}
+		xyz := toPCS(device)
+		var rgb [3]uint8
+		for i, row := range xyzToLinearSRGB {
+			rgb[i] = encodeSRGB(row[0]*xyz[0] + row[1]*xyz[1] + row[2]*xyz[2])
+		}
+		c := color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+		if len(cache) < maxCachedColors {
+			cache[key] = c
+		}
+		return c
+	}
+
+	bounds := img.Bounds()
+	converted := image.NewRGBA(bounds)
+	device := make([]float64, 4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var key uint32
+			switch space {
+			case ColorSpaceCMYK:
+				c := color.CMYKModel.Convert(img.At(x, y)).(color.CMYK)
+				device[0], device[1], device[2], device[3] = float64(c.C)/255, float64(c.M)/255, float64(c.Y)/255, float64(c.K)/255
+				key = uint32(c.C)<<24 | uint32(c.M)<<16 | uint32(c.Y)<<8 | uint32(c.K)
+			case ColorSpaceGray:
+				g := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+				device[0] = float64(g.Y) / 255
+				key = uint32(g.Y)
+			default:
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				device[0], device[1], device[2] = float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+				key = uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+			}
+			converted.SetRGBA(x, y, convert(device, key))
+		}
+	}
+	return converted
+}
+
+// describeColor returns the color space of an uploaded JPEG or GIF along
+// with the description of its ICC profile, if it has one.
+func describeColor(upload []byte) (space string, profile string) {
+	if isGIF(upload) {
+		return ColorSpaceRGB, ""
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(upload))
+	if err != nil {
+		return "", ""
+	}
+	if parsed, err := ParseProfile(jpegProfile(upload)); err == nil {
+		profile = parsed.Description
+	}
+	return colorSpace(config.ColorModel), profile
+}
+
+// encodeSRGB clamps a linear value and applies the sRGB tone curve.
+func encodeSRGB(linear float64) uint8 {
+	v := clampFloat(linear, 0, 1)
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(v * 255))
+}
+
+var (
+	srgbProfilesOnce sync.Once
+	srgbProfile      []byte
+	srgbGrayProfile  []byte
+)
+
+// srgbProfiles returns ICC version 4 profiles for sRGB and for gray with
+// the sRGB tone curve.
+func srgbProfiles() (rgb []byte, gray []byte) {
+	srgbProfilesOnce.Do(func() {
+		// The sRGB tone curve as parametric function 3
+		trc := tagData("para", []byte{0, 3, 0, 0}, s15Fixed16Bytes(2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045))
+		description := mlucTag("sRGB IEC61966-2.1")
+		copyright := mlucTag("No copyright, use freely")
+		white := tagData("XYZ ", s15Fixed16Bytes(d50[0], d50[1], d50[2]))
+		// Bradford adaptation from the D65 white of sRGB to D50
+		adaptation := tagData("sf32", s15Fixed16Bytes(
+			1.0478112, 0.0228866, -0.0501270,
+			0.0295424, 0.9904844, -0.0170491,
+			-0.0092345, 0.0150436, 0.7521316,
+		))
+
+		srgbProfile = buildProfile("mntr", "RGB ", []profileTag{
+			{"desc", description},
+			{"cprt", copyright},
+			{"wtpt", white},
+			{"chad", adaptation},
+			{"rXYZ", tagData("XYZ ", s15Fixed16Bytes(0.4360747, 0.2225045, 0.0139322))},
+			{"gXYZ", tagData("XYZ ", s15Fixed16Bytes(0.3850649, 0.7168786, 0.0971045))},
+			{"bXYZ", tagData("XYZ ", s15Fixed16Bytes(0.1430804, 0.0606169, 0.7141733))},
+			{"rTRC", trc},
+			{"gTRC", trc},
+			{"bTRC", trc},
+		})
+		srgbGrayProfile = buildProfile("mntr", "GRAY", []profileTag{
+			{"desc", mlucTag("sRGB gray")},
+			{"cprt", copyright},
+			{"wtpt", white},
+			{"kTRC", trc},
+		})
+	})
+	return srgbProfile, srgbGrayProfile
+}
+
+type profileTag struct {
+	signature string
+	data      []byte
+}
+
+// buildProfile assembles an ICC version 4.3 profile with an XYZ connection
+// space. Tags with identical data share it.
+func buildProfile(class string, space string, tags []profileTag) []byte {
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:], 0x04300000)
+	copy(header[12:], class)
+	copy(header[16:], space)
+	copy(header[20:], "XYZ ")
+	// A fixed creation date keeps the profile, and images embedding it,
+	// reproducible
+	for i, field := range []uint16{2022, 1, 1} {
+		binary.BigEndian.PutUint16(header[24+2*i:], field)
+	}
+	copy(header[36:], "acsp")
+	copy(header[68:], s15Fixed16Bytes(d50[0], d50[1], d50[2]))
+
+	table := make([]byte, 4+12*len(tags))
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+	var data []byte
+	offsets := map[string]int{}
+	for i, tag := range tags {
+		offset, ok := offsets[string(tag.data)]
+		if !ok {
+			offset = len(header) + len(table) + len(data)
+			offsets[string(tag.data)] = offset
+			data = append(data, tag.data...)
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		entry := table[4+12*i:]
+		copy(entry, tag.signature)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag.data)))
+	}
+
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	// The profile ID is the MD5 of the profile with its flags, rendering
+	// intent and ID zeroed, which they already are
+	id := md5.Sum(profile)
+	copy(profile[84:], id[:])
+	return profile
+}
+
+// tagData joins a tag's type signature, reserved bytes and contents.
+func tagData(signature string, contents ...[]byte) []byte {
+	data := append([]byte(signature), 0, 0, 0, 0)
+	for _, content := range contents {
+		data = append(data, content...)
+	}
+	return data
+}
+
+func s15Fixed16Bytes(values ...float64) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], uint32(int32(math.Round(value*65536))))
+	}
+	return data
+}
+
+// mlucTag encodes an English multiLocalizedUnicodeType tag.
+func mlucTag(text string) []byte {
+	record := make([]byte, 20)
+	binary.BigEndian.PutUint32(record, 1)
+	binary.BigEndian.PutUint32(record[4:], 12)
+	copy(record[8:], "enUS")
+	binary.BigEndian.PutUint32(record[12:], uint32(2*len(text)))
+	binary.BigEndian.PutUint32(record[16:], 28)
+	for _, r := range text {
+		record = append(record, byte(r>>8), byte(r))
+	}
+	return tagData("mluc", record)
+}
+
+// profileWriter inserts an sRGB profile into an image as it's encoded,
+// once the header the profile follows has been written.
+type profileWriter struct {
+	w          io.Writer
+	headerSize int
+	header     []byte
+	// profile returns the bytes to insert after the header.
+	profile  func(header []byte) ([]byte, error)
+	inserted bool
+}
+
+func (pw *profileWriter) Write(data []byte) (int, error) {
+	if pw.inserted {
+		return pw.w.Write(data)
+	}
+	n := pw.headerSize - len(pw.header)
+	if n > len(data) {
+		n = len(data)
+	}
+	pw.header = append(pw.header, data[:n]...)
+	if len(pw.header) < pw.headerSize {
+		return len(data), nil
+	}
+
+	profile, err := pw.profile(pw.header)
+	if err != nil {
+		return 0, err
+	}
+	pw.inserted = true
+	if _, err := pw.w.Write(append(pw.header, profile...)); err != nil {
+		return 0, err
+	}
+	if _, err := pw.w.Write(data[n:]); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// newPNGProfileWriter adds an iCCP chunk after the header of the PNG
+// written to it, holding the sRGB profile or the sRGB gray profile for
+// grayscale images.
+func newPNGProfileWriter(w io.Writer) *profileWriter {
+	return &profileWriter{w: w, headerSize: pngHeaderSize, profile: func(header []byte) ([]byte, error) {
+		if string(header[12:16]) != "IHDR" {
+			return nil, nil
+		}
+		rgb, gray := srgbProfiles()
+		profile, name := rgb, "sRGB"
+		// Color types 0 and 4 are gray and gray with alpha
+		if colorType := header[8+4+4+9]; colorType == 0 || colorType == 4 {
+			profile, name = gray, "sRGB gray"
+		}
+
+		var chunkData bytes.Buffer
+		chunkData.WriteString(name)
+		// The name's terminator and the deflate compression method
+		chunkData.Write([]byte{0, 0})
+		compressor := zlib.NewWriter(&chunkData)
+		if _, err := compressor.Write(profile); err != nil {
+			return nil, err
+		}
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+		return pngChunk("iCCP", chunkData.Bytes()), nil
+	}}
+}
+
+// newJPEGProfileWriter adds an APP2 segment after the start of the JPEG
+// written to it, holding the sRGB profile or, for grayscale JPEGs, the
+// sRGB gray profile.
+func newJPEGProfileWriter(w io.Writer, gray bool) *profileWriter {
+	return &profileWriter{w: w, headerSize: 2, profile: func([]byte) ([]byte, error) {
+		rgbProfile, grayProfile := srgbProfiles()
+		profile := rgbProfile
+		if gray {
+			profile = grayProfile
+		}
+		// The profiles fit in a single segment, numbered 1 of 1
+		length := 2 + len(iccMarker) + 2 + len(profile)
+		segment := []byte{0xff, 0xe2, byte(length >> 8), byte(length)}
+		segment = append(segment, iccMarker...)
+		segment = append(segment, 1, 1)
+		return append(segment, profile...), nil
+	}}
+}
+
+// embedProfile adds an iCCP chunk to an encoded PNG, like
+// newPNGProfileWriter.
+func embedProfile(encoded []byte) ([]byte, error) {
+	embedded := new(bytes.Buffer)
+	if _, err := newPNGProfileWriter(embedded).Write(encoded); err != nil {
+		return nil, err
+	}
+	return embedded.Bytes(), nil
+}
@@ -0,0 +1,456 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+
+	CompressionDefault = "default"
+	CompressionNone    = "none"
+	CompressionFast    = "fast"
+	CompressionBest    = "best"
+
+	QuantizeMedianCut = "median-cut"
+	QuantizeOctree    = "octree"
+
+	// MaxPaletteColors is the most colors a paletted PNG can hold.
+	MaxPaletteColors = 256
+
+	// SavingsHeader reports how many bytes encoding options saved, compared
+	// with encoding the same image as a full color PNG.
+	SavingsHeader = "X-PNG-Savings"
+)
+
+var compressionLevels = map[string]png.CompressionLevel{
+	CompressionDefault: png.DefaultCompression,
+	CompressionNone:    png.NoCompression,
+	CompressionFast:    png.BestSpeed,
+	CompressionBest:    png.BestCompression,
+}
+
+// PNGOptions controls how converted images are encoded as PNGs. Images
+// which are gray, or have at most 256 colors, are always encoded as gray or
+// paletted PNGs since that loses nothing.
+type PNGOptions struct {
+	Compression png.CompressionLevel
+	// Quantize reduces images with more colors to a palette of Colors,
+	// chosen by QuantizeMedianCut or QuantizeOctree.
+	Quantize string
+	Colors   int
+	// Dither diffuses the error of quantized colors with Floyd-Steinberg
+	// dithering.
+	Dither bool
+	// Interlace encodes the PNG with Adam7 interlacing, so a coarse image
+	// can be shown while the rest loads.
+	Interlace bool
+}
+
+// ParsePNGOptions checks the compression level, quantization method and
+// palette size. Colors defaults to MaxPaletteColors.
+func ParsePNGOptions(compression string, quantize string, colors int, dither bool) (PNGOptions, error) {
+	options := PNGOptions{Quantize: quantize, Colors: colors, Dither: dither}
+	if compression != "" {
+		level, ok := compressionLevels[compression]
+		if !ok {
+			return PNGOptions{}, fmt.Errorf("%w: compression must be default, none, fast or best", ErrInvalidOperation)
+		}
+		options.Compression = level
+	}
+	if quantize != "" && quantize != QuantizeMedianCut && quantize != QuantizeOctree {
+		return PNGOptions{}, fmt.Errorf("%w: quantize must be median-cut or octree", ErrInvalidOperation)
+	}
+	if colors != 0 && quantize == "" {
+		return PNGOptions{}, fmt.Errorf("%w: colors requires quantize", ErrInvalidOperation)
+	}
+	if dither && quantize == "" {
+		return PNGOptions{}, fmt.Errorf("%w: dither requires quantize", ErrInvalidOperation)
+	}
+	if colors == 0 {
+		options.Colors = MaxPaletteColors
+	}
+	if options.Colors < 2 || options.Colors > MaxPaletteColors {
+		return PNGOptions{}, fmt.Errorf("%w: colors must be between 2 and %d", ErrInvalidOperation, MaxPaletteColors)
+	}
+	return options, nil
+}
+
+// ValidateFormat checks the output format, and that the other options
+// apply to it. Progressive encoding is only supported for PNGs, which are
+// interlaced, since image/jpeg only encodes baseline JPEGs.
+func ValidateFormat(format string, quality int, progressive bool, options PNGOptions) error {
+	switch format {
+	case "", FormatPNG:
+		if quality != 0 {
+			return fmt.Errorf("%w: quality only applies to JPEGs", ErrInvalidOperation)
+		}
+	case FormatJPEG:
+		if progressive {
+			return fmt.Errorf("%w: progressive JPEGs aren't supported, only interlaced PNGs", ErrInvalidOperation)
+		}
+		if options.Compression != png.DefaultCompression || options.Quantize != "" {
+			return fmt.Errorf("%w: compression and quantize only apply to PNGs", ErrInvalidOperation)
+		}
+		if quality < 0 || quality > 100 {
+			return fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidOperation)
+		}
+	default:
+		return fmt.Errorf("%w: format must be png or jpeg", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// encodePNG encodes the image with the options, also returning the size
+// of the image encoded as a full color PNG with the default compression.
+func encodePNG(img image.Image, options PNGOptions) ([]byte, int, error) {
+	encode := func(img image.Image, options PNGOptions) ([]byte, error) {
+		encoded := new(bytes.Buffer)
+		if err := writePNG(encoded, img, options); err != nil {
+			return nil, err
+		}
+		return encoded.Bytes(), nil
+	}
+	unoptimized, err := encode(img, PNGOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	encoded := unoptimized
+	if options.Compression != png.DefaultCompression || options.Interlace {
+		if encoded, err = encode(img, options); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if reduced := reduceColors(img); reduced != nil {
+		// Gray and paletted PNGs are usually smaller, but smooth gradients
+		// can compress better in full color
+		smaller, err := encode(reduced, options)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(smaller) < len(encoded) {
+			encoded = smaller
+		}
+	} else if options.Quantize != "" {
+		if encoded, err = encode(quantize(img, options), options); err != nil {
+			return nil, 0, err
+		}
+	}
+	return encoded, len(unoptimized), nil
+}
+
+// streamPNG encodes the image with the options as it's written. Unlike
+// encodePNG it can't compare encodings, so gray and paletted images are
+// always encoded as such.
+func streamPNG(w io.Writer, img image.Image, options PNGOptions) error {
+	if reduced := reduceColors(img); reduced != nil {
+		img = reduced
+	} else if options.Quantize != "" {
+		img = quantize(img, options)
+	}
+	return writePNG(w, img, options)
+}
+
+// writePNG encodes the image with the options' compression and
+// interlacing, without reducing its colors.
+func writePNG(w io.Writer, img image.Image, options PNGOptions) error {
+	if options.Interlace {
+		return encodeInterlaced(w, img, options.Compression)
+	}
+	encoder := &png.Encoder{CompressionLevel: options.Compression}
+	return encoder.Encode(w, img)
+}
+
+// writeJPEG encodes the image as a JPEG, drawing it over white first since
+// JPEGs can't be transparent. Quality defaults to jpeg.DefaultQuality.
+func writeJPEG(w io.Writer, img image.Image, quality int) error {
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	if hasTransparency(img) {
+		flattened := image.NewRGBA(img.Bounds())
+		draw.Draw(flattened, flattened.Rect, image.White, image.Point{}, draw.Src)
+		draw.Draw(flattened, flattened.Rect, img, flattened.Rect.Min, draw.Over)
+		img = flattened
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// reduceColors returns the image as an *image.Gray when it's opaque and
+// gray, or as an *image.Paletted when it has at most 256 colors. Otherwise
+// it returns nil.
+func reduceColors(img image.Image) image.Image {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	paletted := image.NewPaletted(bounds, nil)
+	isGray, isPaletted := true, true
+	indices := map[color.NRGBA]uint8{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if isGray && (c.A != 0xff || c.R != c.G || c.G != c.B) {
+				isGray = false
+			}
+			if isGray {
+				gray.Pix[gray.PixOffset(x, y)] = c.R
+			}
+			if isPaletted {
+				index, ok := indices[c]
+				if !ok && len(indices) == MaxPaletteColors {
+					isPaletted = false
+				} else {
+					if !ok {
+						index = uint8(len(indices))
+						indices[c] = index
+					}
+					paletted.Pix[paletted.PixOffset(x, y)] = index
+				}
+			}
+			if !isGray && !isPaletted {
+				return nil
+			}
+		}
+	}
+
+	if isGray {
+		return gray
+	}
+	paletted.Palette = make(color.Palette, len(indices))
+	for c, index := range indices {
+		paletted.Palette[index] = c
+	}
+	return paletted
+}
+
+// quantize reduces the image to a palette chosen by the options' method,
+// mapping each pixel to its nearest palette color or dithering.
+func quantize(img image.Image, options PNGOptions) *image.Paletted {
+	histogram := colorHistogram(img)
+	var palette color.Palette
+	if options.Quantize == QuantizeOctree {
+		palette = octreePalette(histogram, options.Colors)
+	} else {
+		palette = medianCutPalette(histogram, options.Colors)
+	}
+
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(bounds, palette)
+	if options.Dither {
+		draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+	} else {
+		draw.Draw(paletted, bounds, img, bounds.Min, draw.Src)
+	}
+	return paletted
+}
+
+// colorCount is one of an image's colors and the number of its pixels.
+type colorCount struct {
+	color [4]uint8
+	count int
+}
+
+func colorHistogram(img image.Image) []colorCount {
+	counts := map[color.NRGBA]int{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)]++
+		}
+	}
+	histogram := make([]colorCount, 0, len(counts))
+	for c, count := range counts {
+		histogram = append(histogram, colorCount{[4]uint8{c.R, c.G, c.B, c.A}, count})
+	}
+	// Map iteration is random, and the palette shouldn't be
+	sort.Slice(histogram, func(i, j int) bool {
+		a, b := histogram[i].color, histogram[j].color
+		return uint32(a[0])<<24|uint32(a[1])<<16|uint32(a[2])<<8|uint32(a[3]) <
+			uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3])
+	})
+	return histogram
+}
+
+// meanColor averages the colors weighted by their pixel counts.
+func meanColor(colors []colorCount) color.NRGBA {
+	var sums [4]int
+	total := 0
+	for _, c := range colors {
+		for i := range sums {
+			sums[i] += int(c.color[i]) * c.count
+		}
+		total += c.count
+	}
+	return color.NRGBA{
+		uint8((sums[0] + total/2) / total), uint8((sums[1] + total/2) / total),
+		uint8((sums[2] + total/2) / total), uint8((sums[3] + total/2) / total),
+	}
+}
+
+// medianCutPalette repeatedly splits the box of colors with the widest
+// channel range, weighted by its pixels, at the median pixel of that
+// channel until there are size boxes, then averages each box.
+func medianCutPalette(histogram []colorCount, size int) color.Palette {
+	type box struct {
+		colors  []colorCount
+		channel int
+		score   int
+	}
+	measure := func(colors []colorCount) box {
+		b := box{colors: colors}
+		minimum, maximum := [4]uint8{255, 255, 255, 255}, [4]uint8{}
+		pixels := 0
+		for _, c := range colors {
+			for i := range c.color {
+				if c.color[i] < minimum[i] {
+					minimum[i] = c.color[i]
+				}
+				if c.color[i] > maximum[i] {
+					maximum[i] = c.color[i]
+				}
+			}
+			pixels += c.count
+		}
+		for i := range minimum {
+			if width := int(maximum[i]) - int(minimum[i]); width*pixels > b.score {
+				b.channel, b.score = i, width*pixels
+			}
+		}
+		return b
+	}
+
+	boxes := []box{measure(histogram)}
+	for len(boxes) < size {
+		widest := 0
+		for i, b := range boxes {
+			if b.score > boxes[widest].score {
+				widest = i
+			}
+		}
+		b := boxes[widest]
+		// A box of one color can't be split
+		if b.score == 0 {
+			break
+		}
+		sort.SliceStable(b.colors, func(i, j int) bool { return b.colors[i].color[b.channel] < b.colors[j].color[b.channel] })
+		total := 0
+		for _, c := range b.colors {
+			total += c.count
+		}
+		split, seen := 1, b.colors[0].count
+		for split < len(b.colors)-1 && seen+b.colors[split].count <= total/2 {
+			seen += b.colors[split].count
+			split++
+		}
+		boxes[widest] = measure(b.colors[:split])
+		boxes = append(boxes, measure(b.colors[split:]))
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		palette[i] = meanColor(b.colors)
+	}
+	return palette
+}
+
+// octreeNode is a node of the octree, whose leaves sum the colors of the
+// pixels they hold.
+type octreeNode struct {
+	children [8]*octreeNode
+	sums     [4]int
+	count    int
+	leaf     bool
+}
+
+// octreePalette inserts every color into an octree, branching on one bit
+// of red, green and blue at each level, then merges the leaves of the
+// deepest nodes holding the fewest pixels until at most size remain.
+func octreePalette(histogram []colorCount, size int) color.Palette {
+	const depth = 8
+	root := &octreeNode{}
+	levels := make([][]*octreeNode, depth)
+	leaves := 0
+	for _, c := range histogram {
+		node := root
+		for level := 0; level < depth; level++ {
+			shift := 7 - level
+			child := int(c.color[0]>>shift&1)<<2 | int(c.color[1]>>shift&1)<<1 | int(c.color[2]>>shift&1)
+			if node.children[child] == nil {
+				node.children[child] = &octreeNode{leaf: level == depth-1}
+				if level < depth-1 {
+					levels[level+1] = append(levels[level+1], node.children[child])
+				} else {
+					leaves++
+				}
+			}
+			node = node.children[child]
+		}
+		for i := range node.sums {
+			node.sums[i] += int(c.color[i]) * c.count
+		}
+		node.count += c.count
+	}
+	levels[0] = []*octreeNode{root}
+
+	// Merge the children of the deepest, least used nodes into them
+	for level := depth - 1; level >= 0 && leaves > size; level-- {
+		nodes := levels[level]
+		pixels := func(node *octreeNode) int {
+			total := 0
+			for _, child := range node.children {
+				if child != nil {
+					total += child.count
+				}
+			}
+			return total
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return pixels(nodes[i]) < pixels(nodes[j]) })
+		for _, node := range nodes {
+			if leaves <= size {
+				break
+			}
+			for i, child := range node.children {
+				if child == nil {
+					continue
+				}
+				for j := range node.sums {
+					node.sums[j] += child.sums[j]
+				}
+				node.count += child.count
+				node.children[i] = nil
+				leaves--
+			}
+			node.leaf = true
+			leaves++
+		}
+	}
+
+	var palette color.Palette
+	var collect func(node *octreeNode)
+	collect = func(node *octreeNode) {
+		if node.leaf {
+			palette = append(palette, color.NRGBA{
+				uint8((node.sums[0] + node.count/2) / node.count), uint8((node.sums[1] + node.count/2) / node.count),
+				uint8((node.sums[2] + node.count/2) / node.count), uint8((node.sums[3] + node.count/2) / node.count),
+			})
+			return
+		}
+		for _, child := range node.children {
+			if child != nil {
+				collect(child)
+			}
+		}
+	}
+	collect(root)
+	return palette
+}
@@ -0,0 +1,220 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elehner/takehomeserver/netguard"
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	ErrorFetchBlocked  = "The image URL is not allowed"
+	ErrorFetchFailed   = "Error while fetching the image"
+	ErrorFetchDisabled = "Fetching images by URL is not enabled"
+
+	DefaultFetchTimeout      = 10 * time.Second
+	DefaultFetchMaxRedirects = 3
+)
+
+var (
+	// ErrFetchBlocked is wrapped by errors for URLs whose scheme, host or
+	// address may not be fetched.
+	ErrFetchBlocked = errors.New("fetch blocked")
+	// ErrFetchFailed is wrapped by errors for URLs which couldn't be
+	// fetched, such as when the server responds with an error.
+	ErrFetchFailed = errors.New("fetch failed")
+	// ErrFetchTooLarge is wrapped by errors for images larger than the
+	// fetcher's MaxBytes.
+	ErrFetchTooLarge = errors.New("fetched image too large")
+)
+
+// FetchConfig controls which URLs a Fetcher may fetch images from.
+type FetchConfig struct {
+	// AllowedHosts, when not empty, are the only hosts fetched from. A
+	// host such as example.com matches exactly, while *.example.com
+	// matches its subdomains.
+	AllowedHosts []string
+	// DeniedHosts are never fetched from, even when allowed.
+	DeniedHosts []string
+	// MaxRedirects bounds the redirects followed for each fetch, where 0
+	// follows none. DefaultFetchMaxRedirects is a reasonable limit.
+	MaxRedirects int
+	// Timeout bounds each fetch, including its redirects.
+	Timeout time.Duration
+	// MaxBytes bounds the size of a fetched image.
+	MaxBytes int64
+	// AllowPrivateNetworks permits fetching from loopback, private and
+	// other internal addresses, which are otherwise blocked after the
+	// host is resolved so DNS can't be used to reach them.
+	AllowPrivateNetworks bool
+}
+
+// Fetcher downloads images by URL on behalf of clients.
+type Fetcher struct {
+	config FetchConfig
+	client *http.Client
+}
+
+// NewFetcher creates a Fetcher, defaulting the timeout and size limit when
+// they're zero.
+func NewFetcher(config FetchConfig) *Fetcher {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultFetchTimeout
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = DefaultMaxBodyBytes
+	}
+
+	f := &Fetcher{config: config}
+	dialer := &net.Dialer{Timeout: config.Timeout, Control: f.checkAddress}
+	f.client = &http.Client{
+		Timeout: config.Timeout,
+		// Proxies are ignored, since the address check must see the
+		// address actually connected to
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   config.Timeout,
+			ResponseHeaderTimeout: config.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > config.MaxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", ErrFetchFailed, config.MaxRedirects)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// Fetch downloads the image at the URL.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFetchBlocked, err.Error())
+	}
+	if err := f.checkURL(target); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFetchBlocked, err.Error())
+	}
+	req.Header.Set("Accept", "image/jpeg, image/gif")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Blocked addresses and redirects keep their own errors
+		if errors.Is(err, ErrFetchBlocked) || errors.Is(err, ErrFetchFailed) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrFetchFailed, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded with %s", ErrFetchFailed, target.Host, resp.Status)
+	}
+	if resp.ContentLength > f.config.MaxBytes {
+		return nil, fmt.Errorf("%w: images may be at most %d bytes", ErrFetchTooLarge, f.config.MaxBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.config.MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFetchFailed, err.Error())
+	}
+	if int64(len(data)) > f.config.MaxBytes {
+		return nil, fmt.Errorf("%w: images may be at most %d bytes", ErrFetchTooLarge, f.config.MaxBytes)
+	}
+	return data, nil
+}
+
+// checkURL checks the scheme and host of a URL, before it's fetched and
+// before each redirect is followed.
+func (f *Fetcher) checkURL(target *url.URL) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs may be fetched", ErrFetchBlocked)
+	}
+	if target.User != nil {
+		return fmt.Errorf("%w: URLs may not contain credentials", ErrFetchBlocked)
+	}
+	host := strings.ToLower(strings.TrimSuffix(target.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: the URL has no host", ErrFetchBlocked)
+	}
+	if matchesHost(f.config.DeniedHosts, host) {
+		return fmt.Errorf("%w: %s is denied", ErrFetchBlocked, host)
+	}
+	if len(f.config.AllowedHosts) > 0 && !matchesHost(f.config.AllowedHosts, host) {
+		return fmt.Errorf("%w: %s is not allowed", ErrFetchBlocked, host)
+	}
+	return nil
+}
+
+// checkAddress runs before every connection, once the host has been
+// resolved, rejecting internal addresses.
+func (f *Fetcher) checkAddress(network string, address string, _ syscall.RawConn) error {
+	if f.config.AllowPrivateNetworks {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrFetchBlocked, err.Error())
+	}
+	if addr := addrPort.Addr().Unmap(); netguard.Internal(addr) {
+		return fmt.Errorf("%w: %s is an internal address", ErrFetchBlocked, addr)
+	}
+	return nil
+}
+
+// matchesHost reports whether the host matches any of the patterns, where
+// *.example.com matches the subdomains of example.com.
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchedName is the file name at the end of a fetched URL's path, or
+// empty when it has none.
+func fetchedName(rawURL string) string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(target.Path)
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// FetchProblem describes an error returned by Fetch.
+func FetchProblem(err error) *problem.Problem {
+	switch {
+	case errors.Is(err, ErrFetchBlocked):
+		return problem.New(http.StatusForbidden, problem.CodeFetchBlocked, ErrorFetchBlocked).WithDetail(err.Error())
+	case errors.Is(err, ErrFetchTooLarge):
+		return problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, ErrorImageTooLarge).WithDetail(err.Error())
+	}
+	return problem.New(http.StatusBadGateway, problem.CodeFetchFailed, ErrorFetchFailed).WithDetail(err.Error())
+}
@@ -0,0 +1,336 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// MaxGIFFrames bounds the number of frames in an uploaded GIF.
+	MaxGIFFrames = 300
+	// MaxGIFPixels bounds the pixels of every frame of an uploaded GIF and
+	// its canvas combined, since a small file can decompress into huge
+	// frames.
+	MaxGIFPixels = 64 << 20
+)
+
+// isGIF reports whether the upload starts with a GIF signature.
+func isGIF(upload []byte) bool {
+	return bytes.HasPrefix(upload, []byte("GIF87a")) || bytes.HasPrefix(upload, []byte("GIF89a"))
+}
+
+// extension returns the file extension of an uploaded or converted image.
+func extension(data []byte) string {
+	switch {
+	case isGIF(data):
+		return ".gif"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	}
+	return ".jpeg"
+}
+
+// contentExtension is the file extension for a converted image's content
+// type.
+func contentExtension(contentType string) string {
+	switch contentType {
+	case "image/gif":
+		return ".gif"
+	case "image/jpeg":
+		return ".jpeg"
+	}
+	return ".png"
+}
+
+// decodeGIF checks the GIF against MaxGIFFrames and MaxGIFPixels before
+// decoding all of its frames.
+func decodeGIF(upload []byte) (*gif.GIF, error) {
+	frames, pixels, err := scanGIF(upload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: gif: %s", ErrInvalidImage, err.Error())
+	}
+	if frames > MaxGIFFrames {
+		return nil, fmt.Errorf("%w: gif: %d frames exceeds the limit of %d", ErrInvalidImage, frames, MaxGIFFrames)
+	}
+	if pixels > MaxGIFPixels {
+		return nil, fmt.Errorf("%w: gif: %d pixels across all frames exceeds the limit of %d", ErrInvalidImage, pixels, MaxGIFPixels)
+	}
+
+	decoded, err := gif.DecodeAll(bytes.NewReader(upload))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImage, err.Error())
+	}
+	return decoded, nil
+}
+
+// Animated reports whether the upload is a GIF with more than one frame,
+// which is converted to an animated GIF unless Options.Frame picks one.
+func Animated(upload []byte) bool {
+	if !isGIF(upload) {
+		return false
+	}
+	frames, _, err := scanGIF(upload)
+	return err == nil && frames > 1
+}
+
+// AnimatedReader is Animated for an image read from r, reading no further
+// than the start of its second frame.
+func AnimatedReader(r io.Reader) bool {
+	buffered := bufio.NewReader(r)
+	if header, err := buffered.Peek(6); err != nil || !isGIF(header) {
+		return false
+	}
+	frames, _, err := scanGIFBlocks(buffered, 2)
+	return err == nil && frames > 1
+}
+
+// scanGIF walks the GIF's blocks without decompressing them, counting its
+// frames and their combined area along with the canvas they're drawn on.
+func scanGIF(data []byte) (frames int, pixels int64, err error) {
+	return scanGIFBlocks(bufio.NewReader(bytes.NewReader(data)), 0)
+}
+
+// scanGIFBlocks is scanGIF for a stream, stopping once it has found
+// maxFrames frames when maxFrames is positive.
+func scanGIFBlocks(r *bufio.Reader, maxFrames int) (frames int, pixels int64, err error) {
+	errTruncated := errors.New("unexpected end of data")
+	skip := func(n int) error {
+		if _, err := r.Discard(n); err != nil {
+			return errTruncated
+		}
+		return nil
+	}
+	skipSubBlocks := func() error {
+		for {
+			size, err := r.ReadByte()
+			if err != nil {
+				return errTruncated
+			}
+			if size == 0 {
+				return nil
+			}
+			if err := skip(int(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Skip the header, logical screen descriptor and global color table
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, errTruncated
+	}
+	pixels = (int64(header[6]) | int64(header[7])<<8) * (int64(header[8]) | int64(header[9])<<8)
+	if header[10]&0x80 != 0 {
+		if err := skip(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	descriptor := make([]byte, 9)
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, errTruncated
+		}
+		switch block {
+		case 0x21: // Extension
+			// Skip the extension's label
+			if err := skip(1); err != nil {
+				return 0, 0, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+		case 0x2c: // Image descriptor
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return 0, 0, errTruncated
+			}
+			width := int64(descriptor[4]) | int64(descriptor[5])<<8
+			height := int64(descriptor[6]) | int64(descriptor[7])<<8
+			packed := descriptor[8]
+			if packed&0x80 != 0 {
+				if err := skip(3 << (packed&0x07 + 1)); err != nil {
+					return 0, 0, err
+				}
+			}
+			// Skip the LZW minimum code size
+			if err := skip(1); err != nil {
+				return 0, 0, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return 0, 0, err
+			}
+			frames++
+			pixels += width * height
+			if maxFrames > 0 && frames >= maxFrames {
+				return frames, pixels, nil
+			}
+		case 0x3b: // Trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, fmt.Errorf("unknown block type %#x", block)
+		}
+	}
+}
+
+// composeFrame returns frame index of the animation as it's displayed,
+// drawing the frames before it according to their disposal methods.
+func composeFrame(animation *gif.GIF, index int) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+	var previous *image.RGBA
+	for i, frame := range animation.Image[:index+1] {
+		disposal := byte(gif.DisposalNone)
+		if i < len(animation.Disposal) {
+			disposal = animation.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious && i < index {
+			previous = image.NewRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		if i == index {
+			break
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return canvas
+}
+
+// resizeGIF scales every frame of the animation by the factor resizeImage
+// would scale its canvas, keeping each frame's palette, delay and disposal
+// method along with the loop count.
+func resizeGIF(animation *gif.GIF) *gif.GIF {
+	width, height := animation.Config.Width, animation.Config.Height
+	newWidth, newHeight := fitWithin(width, height)
+	if newWidth == width && newHeight == height {
+		return animation
+	}
+
+	scale := func(value int, from int, to int) int {
+		return (value*to + from/2) / from
+	}
+	resized := &gif.GIF{
+		Image:           make([]*image.Paletted, len(animation.Image)),
+		Delay:           animation.Delay,
+		Disposal:        animation.Disposal,
+		LoopCount:       animation.LoopCount,
+		BackgroundIndex: animation.BackgroundIndex,
+		Config:          image.Config{ColorModel: animation.Config.ColorModel, Width: newWidth, Height: newHeight},
+	}
+	for i, frame := range animation.Image {
+		rect := image.Rect(
+			scale(frame.Rect.Min.X, width, newWidth), scale(frame.Rect.Min.Y, height, newHeight),
+			scale(frame.Rect.Max.X, width, newWidth), scale(frame.Rect.Max.Y, height, newHeight),
+		)
+		// Keep frames which shrink to nothing a pixel in size
+		if rect.Dx() == 0 {
+			rect.Min.X = clampInt(rect.Min.X, 0, newWidth-1)
+			rect.Max.X = rect.Min.X + 1
+		}
+		if rect.Dy() == 0 {
+			rect.Min.Y = clampInt(rect.Min.Y, 0, newHeight-1)
+			rect.Max.Y = rect.Min.Y + 1
+		}
+
+		// Nearest neighbor scaling only picks existing colors, so every
+		// pixel keeps its place in the frame's palette
+		scaled := image.NewPaletted(rect, frame.Palette)
+		draw.NearestNeighbor.Scale(scaled, rect, frame, frame.Rect, draw.Src, nil)
+		resized.Image[i] = scaled
+	}
+	return resized
+}
+
+// watermarkGIF composites the watermark over every frame of the animation
+// as it's displayed. Each frame is replaced by the whole canvas, reduced to
+// a palette of its own colors since the blended watermark adds colors, and
+// cleared before the next is drawn.
+func watermarkGIF(animation *gif.GIF, watermark *Watermark) *gif.GIF {
+	watermarked := &gif.GIF{
+		Image:     make([]*image.Paletted, len(animation.Image)),
+		Delay:     animation.Delay,
+		Disposal:  make([]byte, len(animation.Image)),
+		LoopCount: animation.LoopCount,
+		Config:    image.Config{Width: animation.Config.Width, Height: animation.Config.Height},
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, animation.Config.Width, animation.Config.Height))
+	for i, frame := range animation.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(animation.Disposal) {
+			disposal = animation.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+
+		shown := image.NewRGBA(canvas.Rect)
+		copy(shown.Pix, canvas.Pix)
+		watermark.apply(shown)
+		watermarked.Image[i] = quantize(shown, PNGOptions{Colors: MaxPaletteColors})
+		watermarked.Disposal[i] = gif.DisposalBackground
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return watermarked
+}
+
+// prepareGIF prepares an animated GIF. A GIF with a single frame, or a
+// request for one frame, is converted like any other image, while
+// animations are resized frame by frame and stay animated.
+func prepareGIF(ctx context.Context, upload []byte, options Options) (*preparedImage, error) {
+	animation, err := decodeGIF(upload)
+	if err != nil {
+		return nil, err
+	}
+	if options.Frame != nil {
+		if *options.Frame < 0 || *options.Frame >= len(animation.Image) {
+			return nil, fmt.Errorf("%w: frame must be between 0 and %d", ErrInvalidOperation, len(animation.Image)-1)
+		}
+		return prepareImage(ctx, composeFrame(animation, *options.Frame), options)
+	}
+	if len(animation.Image) == 1 {
+		return prepareImage(ctx, composeFrame(animation, 0), options)
+	}
+
+	if len(options.Operations) > 0 || options.Crop != nil || len(options.Text) > 0 {
+		return nil, fmt.Errorf("%w: animated GIFs can only be resized, set frame to transform a single frame", ErrInvalidOperation)
+	}
+	if options.Format != "" || options.PNG.Interlace {
+		return nil, fmt.Errorf("%w: animated GIFs are always encoded as GIFs, set frame to convert a single frame", ErrInvalidOperation)
+	}
+	resized := resizeGIF(animation)
+	if options.Watermark != nil {
+		resized = watermarkGIF(resized, options.Watermark)
+	}
+	conversion := &Conversion{ContentType: "image/gif", Width: resized.Config.Width, Height: resized.Config.Height,
+		OriginalWidth: animation.Config.Width, OriginalHeight: animation.Config.Height}
+	if options.Hash {
+		hashes := ComputeHashes(composeFrame(animation, 0))
+		conversion.Hashes = &hashes
+	}
+	return &preparedImage{conversion: conversion, animation: resized, options: options}, nil
+}
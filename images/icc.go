@@ -0,0 +1,576 @@
+package images
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// Profile is an ICC color profile, as embedded in an image to describe
+// the color space of its pixels.
+type Profile struct {
+	// ColorSpace is the space of the image's pixels, such as RGB, CMYK or
+	// GRAY.
+	ColorSpace string
+	// PCS is the profile connection space colors are converted through,
+	// XYZ or Lab.
+	PCS         string
+	Description string
+	// Version is the profile's major version, 2 or 4.
+	Version int
+
+	tags map[string][]byte
+}
+
+var errUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// maxCLUTValues bounds the values of a lookup table, well beyond the 33
+// point CMYK tables of print profiles, so a crafted profile can't exhaust
+// memory.
+const maxCLUTValues = 1 << 24
+
+// channels returns the number of channels of the profile's color space, or
+// 0 when it isn't a space images can be in.
+func (p *Profile) channels() int {
+	switch p.ColorSpace {
+	case ColorSpaceRGB:
+		return 3
+	case ColorSpaceCMYK:
+		return 4
+	case ColorSpaceGray:
+		return 1
+	}
+	return 0
+}
+
+// ParseProfile reads the header and tags of an ICC profile.
+func ParseProfile(data []byte) (*Profile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	size := binary.BigEndian.Uint32(data[0:4])
+	if size < 132 || int64(size) > int64(len(data)) {
+		return nil, fmt.Errorf("ICC profile size %d does not match its %d bytes", size, len(data))
+	}
+	data = data[:size]
+
+	p := &Profile{
+		ColorSpace: strings.TrimSpace(string(data[16:20])),
+		PCS:        strings.TrimSpace(string(data[20:24])),
+		Version:    int(data[8]),
+		tags:       map[string][]byte{},
+	}
+	count := int(binary.BigEndian.Uint32(data[128:132]))
+	if count > (len(data)-132)/12 {
+		return nil, errors.New("ICC profile tag table is truncated")
+	}
+	for i := 0; i < count; i++ {
+		entry := data[132+12*i:]
+		offset, length := binary.BigEndian.Uint32(entry[4:8]), binary.BigEndian.Uint32(entry[8:12])
+		if uint64(offset)+uint64(length) > uint64(len(data)) || length < 8 {
+			return nil, fmt.Errorf("ICC profile tag %q is out of bounds", entry[0:4])
+		}
+		p.tags[string(entry[0:4])] = data[offset : offset+length]
+	}
+	p.Description = parseText(p.tags["desc"])
+	return p, nil
+}
+
+// parseText reads a textDescriptionType (version 2) or
+// multiLocalizedUnicodeType (version 4) tag, returning the first string.
+func parseText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[0:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(tag[8:12]))
+		if length > len(tag)-12 {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		length, offset := int(binary.BigEndian.Uint32(tag[20:24])), int(binary.BigEndian.Uint32(tag[24:28]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case "text":
+		return strings.TrimRight(string(tag[8:]), "\x00")
+	}
+	return ""
+}
+
+// curve maps a normalized value from 0 to 1 through a tone curve.
+type curve func(float64) float64
+
+func identityCurve(x float64) float64 { return x }
+
+// parseCurve reads a curveType or parametricCurveType, also returning the
+// number of bytes it took, padded to 4 byte alignment.
+func parseCurve(data []byte) (curve, int, error) {
+	if len(data) < 12 {
+		return nil, 0, errUnsupportedProfile
+	}
+	switch string(data[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:12]))
+		if count > (len(data)-12)/2 {
+			return nil, 0, errUnsupportedProfile
+		}
+		size := (12 + 2*count + 3) &^ 3
+		switch count {
+		case 0:
+			return identityCurve, size, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, size, nil
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 { return interpolate(table, x) }, size, nil
+	case "para":
+		function := binary.BigEndian.Uint16(data[8:10])
+		counts := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		count, ok := counts[function]
+		if !ok || len(data) < 12+4*count {
+			return nil, 0, errUnsupportedProfile
+		}
+		params := make([]float64, 7)
+		for i := 0; i < count; i++ {
+			params[i] = s15Fixed16(data[12+4*i:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		size := (12 + 4*count + 3) &^ 3
+		switch function {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, size, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, size, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, size, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, size, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, size, nil
+		}
+	}
+	return nil, 0, errUnsupportedProfile
+}
+
+// interpolate looks up x from 0 to 1 in a table of evenly spaced samples.
+func interpolate(table []float64, x float64) float64 {
+	position := clampFloat(x, 0, 1) * float64(len(table)-1)
+	i := int(position)
+	if i >= len(table)-1 {
+		return table[len(table)-1]
+	}
+	fraction := position - float64(i)
+	return table[i] + (table[i+1]-table[i])*fraction
+}
+
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+func clampFloat(x float64, minimum float64, maximum float64) float64 {
+	return math.Max(minimum, math.Min(maximum, x))
+}
+
+// parseXYZ reads the first value of an XYZType tag.
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+		return [3]float64{}, errUnsupportedProfile
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// clutSize returns the number of values in a lookup table with the grid
+// points along each dimension, or false when it's more than maxCLUTValues.
+func clutSize(gridPoints []int, outputs int) (int, bool) {
+	size := outputs
+	for _, points := range gridPoints {
+		if points > maxCLUTValues/size {
+			return 0, false
+		}
+		size *= points
+	}
+	return size, true
+}
+
+// clut is a color lookup table, sampled on a grid with gridPoints[i]
+// points along input dimension i, each holding outputs values.
+type clut struct {
+	gridPoints []int
+	outputs    int
+	values     []float64
+}
+
+// lookup interpolates the table multilinearly at the input, from 0 to 1 in
+// each dimension.
+func (t *clut) lookup(input []float64, output []float64) {
+	dimensions := len(t.gridPoints)
+	var base [15]int
+	var fractions [15]float64
+	var strides [15]int
+	stride := t.outputs
+	for i := dimensions - 1; i >= 0; i-- {
+		strides[i] = stride
+		position := clampFloat(input[i], 0, 1) * float64(t.gridPoints[i]-1)
+		base[i] = int(position)
+		if base[i] >= t.gridPoints[i]-1 {
+			base[i] = maxInt(0, t.gridPoints[i]-2)
+		}
+		fractions[i] = position - float64(base[i])
+		stride *= t.gridPoints[i]
+	}
+
+	for o := range output[:t.outputs] {
+		output[o] = 0
+	}
+	// Sum every corner of the cell surrounding the input, weighted by its
+	// distance along each dimension
+	for corner := 0; corner < 1<<dimensions; corner++ {
+		weight, offset := 1.0, 0
+		for i := 0; i < dimensions; i++ {
+			if corner&(1<<i) != 0 {
+				if t.gridPoints[i] == 1 {
+					weight = 0
+					break
+				}
+				weight *= fractions[i]
+				offset += (base[i] + 1) * strides[i]
+			} else {
+				weight *= 1 - fractions[i]
+				offset += base[i] * strides[i]
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		for o := 0; o < t.outputs; o++ {
+			output[o] += weight * t.values[offset+o]
+		}
+	}
+}
+
+// pcsTransform converts device values, from 0 to 1, to XYZ relative to the
+// D50 illuminant.
+type pcsTransform func(device []float64) [3]float64
+
+// transform returns the conversion from the profile's color space to XYZ,
+// preferring the perceptual lookup table and falling back to the matrix
+// and tone curves of RGB and gray profiles.
+func (p *Profile) transform() (pcsTransform, error) {
+	if tag, ok := p.tags["A2B0"]; ok {
+		return p.lutTransform(tag)
+	}
+	switch p.ColorSpace {
+	case "RGB":
+		return p.matrixTransform()
+	case "GRAY":
+		tone, _, err := parseCurve(p.tags["kTRC"])
+		if err != nil {
+			return nil, err
+		}
+		return func(device []float64) [3]float64 {
+			y := tone(device[0])
+			// Gray is neutral, so it has the chromaticity of the D50 white
+			return [3]float64{d50[0] * y, y, d50[2] * y}
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s profile without a lookup table", errUnsupportedProfile, p.ColorSpace)
+}
+
+func (p *Profile) matrixTransform() (pcsTransform, error) {
+	var columns [3][3]float64
+	var tones [3]curve
+	for i, channel := range []string{"r", "g", "b"} {
+		var err error
+		if columns[i], err = parseXYZ(p.tags[channel+"XYZ"]); err != nil {
+			return nil, err
+		}
+		if tones[i], _, err = parseCurve(p.tags[channel+"TRC"]); err != nil {
+			return nil, err
+		}
+	}
+	return func(device []float64) [3]float64 {
+		var xyz [3]float64
+		for i := range tones {
+			linear := tones[i](device[i])
+			for j := range xyz {
+				xyz[j] += columns[i][j] * linear
+			}
+		}
+		return xyz
+	}, nil
+}
+
+// lutTransform reads an lut8Type, lut16Type or lutAToBType tag, whose
+// inputs must be the channels of the profile's color space.
+func (p *Profile) lutTransform(tag []byte) (pcsTransform, error) {
+	var toPCS func(device []float64, output []float64)
+	var err error
+	channels := p.channels()
+	// Version 2 lookup tables encode Lab with 0xff00 as 100, while lut8
+	// tables and version 4 tables use the full range
+	legacyLab := false
+	switch string(tag[0:4]) {
+	case "mft1":
+		toPCS, err = parseLUT(tag, 1, channels)
+	case "mft2":
+		toPCS, err = parseLUT(tag, 2, channels)
+		legacyLab = true
+	case "mAB ":
+		toPCS, err = parseLUTAToB(tag, channels)
+	default:
+		err = fmt.Errorf("%w: lookup table type %q", errUnsupportedProfile, tag[0:4])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lab := p.PCS == "Lab"
+	return func(device []float64) [3]float64 {
+		var pcs [3]float64
+		toPCS(device, pcs[:])
+		if !lab {
+			// XYZ is encoded with 1 + 32767/32768 as the maximum
+			return [3]float64{pcs[0] * 65535 / 32768, pcs[1] * 65535 / 32768, pcs[2] * 65535 / 32768}
+		}
+		l, a, b := pcs[0]*100, pcs[1]*255-128, pcs[2]*255-128
+		if legacyLab {
+			l, a, b = pcs[0]*100*65535/65280, pcs[1]*65535/256-128, pcs[2]*65535/256-128
+		}
+		return labToXYZ(l, a, b)
+	}, nil
+}
+
+// parseLUT reads an lut8Type or lut16Type from the given number of
+// channels, whose values are precision bytes wide: input curves, a lookup
+// table and output curves.
+func parseLUT(tag []byte, precision int, channels int) (func(device []float64, output []float64), error) {
+	if len(tag) < 48 {
+		return nil, errUnsupportedProfile
+	}
+	inputs, outputs, gridPoints := int(tag[8]), int(tag[9]), int(tag[10])
+	if inputs < 1 || inputs != channels || outputs != 3 || gridPoints < 2 {
+		return nil, fmt.Errorf("%w: %d to %d channel lookup table", errUnsupportedProfile, inputs, outputs)
+	}
+	offset, inputEntries, outputEntries := 48, 256, 256
+	if precision == 2 {
+		if len(tag) < 52 {
+			return nil, errUnsupportedProfile
+		}
+		inputEntries, outputEntries = int(binary.BigEndian.Uint16(tag[48:50])), int(binary.BigEndian.Uint16(tag[50:52]))
+		offset = 52
+	}
+	grid := &clut{gridPoints: make([]int, inputs), outputs: outputs}
+	for i := range grid.gridPoints {
+		grid.gridPoints[i] = gridPoints
+	}
+	gridSize, ok := clutSize(grid.gridPoints, outputs)
+	if !ok || inputEntries < 2 || outputEntries < 2 || len(tag) < offset+precision*(inputs*inputEntries+gridSize+outputs*outputEntries) {
+		return nil, errUnsupportedProfile
+	}
+
+	read := func(count int) []float64 {
+		values := make([]float64, count)
+		for i := range values {
+			if precision == 1 {
+				values[i] = float64(tag[offset]) / 255
+			} else {
+				values[i] = float64(binary.BigEndian.Uint16(tag[offset:])) / 65535
+			}
+			offset += precision
+		}
+		return values
+	}
+	inputTables := make([][]float64, inputs)
+	for i := range inputTables {
+		inputTables[i] = read(inputEntries)
+	}
+	grid.values = read(gridSize)
+	outputTables := make([][]float64, outputs)
+	for i := range outputTables {
+		outputTables[i] = read(outputEntries)
+	}
+
+	return func(device []float64, output []float64) {
+		var input [15]float64
+		for i := range inputTables {
+			input[i] = interpolate(inputTables[i], device[i])
+		}
+		grid.lookup(input[:inputs], output)
+		for i := range outputTables {
+			output[i] = interpolate(outputTables[i], output[i])
+		}
+	}, nil
+}
+
+// parseLUTAToB reads an lutAToBType, which applies A curves, a lookup
+// table, M curves, a matrix and B curves, each of which but the B curves
+// may be missing. Its inputs must be the given number of channels.
+func parseLUTAToB(tag []byte, channels int) (func(device []float64, output []float64), error) {
+	if len(tag) < 32 {
+		return nil, errUnsupportedProfile
+	}
+	inputs, outputs := int(tag[8]), int(tag[9])
+	if inputs < 1 || inputs != channels || outputs != 3 {
+		return nil, fmt.Errorf("%w: %d to %d channel lookup table", errUnsupportedProfile, inputs, outputs)
+	}
+	offsetB, offsetMatrix, offsetM := binary.BigEndian.Uint32(tag[12:]), binary.BigEndian.Uint32(tag[16:]), binary.BigEndian.Uint32(tag[20:])
+	offsetCLUT, offsetA := binary.BigEndian.Uint32(tag[24:]), binary.BigEndian.Uint32(tag[28:])
+
+	curves := func(offset uint32, count int) ([]curve, error) {
+		if offset == 0 {
+			return nil, nil
+		}
+		parsed := make([]curve, count)
+		for i := range parsed {
+			if int64(offset) >= int64(len(tag)) {
+				return nil, errUnsupportedProfile
+			}
+			var size int
+			var err error
+			if parsed[i], size, err = parseCurve(tag[offset:]); err != nil {
+				return nil, err
+			}
+			offset += uint32(size)
+		}
+		return parsed, nil
+	}
+	bCurves, err := curves(offsetB, outputs)
+	if err != nil {
+		return nil, err
+	}
+	mCurves, err := curves(offsetM, outputs)
+	if err != nil {
+		return nil, err
+	}
+	aCurves, err := curves(offsetA, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	var matrix []float64
+	if offsetMatrix != 0 {
+		if int64(offsetMatrix)+48 > int64(len(tag)) {
+			return nil, errUnsupportedProfile
+		}
+		matrix = make([]float64, 12)
+		for i := range matrix {
+			matrix[i] = s15Fixed16(tag[int(offsetMatrix)+4*i:])
+		}
+	}
+
+	var grid *clut
+	if offsetCLUT != 0 {
+		if int64(offsetCLUT)+20 > int64(len(tag)) {
+			return nil, errUnsupportedProfile
+		}
+		header := tag[offsetCLUT:]
+		grid = &clut{gridPoints: make([]int, inputs), outputs: outputs}
+		for i := range grid.gridPoints {
+			grid.gridPoints[i] = int(header[i])
+			if grid.gridPoints[i] < 1 {
+				return nil, errUnsupportedProfile
+			}
+		}
+		size, ok := clutSize(grid.gridPoints, outputs)
+		precision := int(header[16])
+		if !ok || (precision != 1 && precision != 2) || len(header) < 20+size*precision {
+			return nil, errUnsupportedProfile
+		}
+		grid.values = make([]float64, size)
+		for i := range grid.values {
+			if precision == 1 {
+				grid.values[i] = float64(header[20+i]) / 255
+			} else {
+				grid.values[i] = float64(binary.BigEndian.Uint16(header[20+2*i:])) / 65535
+			}
+		}
+	} else if inputs != outputs {
+		return nil, errUnsupportedProfile
+	}
+
+	return func(device []float64, output []float64) {
+		var values [15]float64
+		copy(values[:inputs], device)
+		for i, c := range aCurves {
+			values[i] = c(values[i])
+		}
+		if grid != nil {
+			grid.lookup(values[:inputs], output)
+		} else {
+			copy(output, values[:outputs])
+		}
+		for i, c := range mCurves {
+			output[i] = c(output[i])
+		}
+		if matrix != nil {
+			x, y, z := output[0], output[1], output[2]
+			for i := 0; i < 3; i++ {
+				output[i] = matrix[3*i]*x + matrix[3*i+1]*y + matrix[3*i+2]*z + matrix[9+i]
+			}
+		}
+		for i, c := range bCurves {
+			output[i] = c(output[i])
+		}
+	}, nil
+}
+
+// d50 is the white point of the profile connection space.
+var d50 = [3]float64{0.9642, 1, 0.8249}
+
+func labToXYZ(l float64, a float64, b float64) [3]float64 {
+	fy := (l + 16) / 116
+	fx, fz := fy+a/500, fy-b/200
+	inverse := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+	return [3]float64{d50[0] * inverse(fx), d50[1] * inverse(fy), d50[2] * inverse(fz)}
+}
+
+// xyzToLinearSRGB converts XYZ relative to D50 to linear sRGB, using the
+// sRGB primaries adapted to D50 with the Bradford transform.
+var xyzToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
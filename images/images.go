@@ -2,65 +2,865 @@ package images
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
-	"image/png"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/storage"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/font/opentype"
 )
 
 const (
 	ErrorMethodNotSupported = "Only POST is supported"
 	ErrorDecodingImage      = "Error while extracting image"
 	ErrorEncodingImage      = "Error while converting image"
+	ErrorReadingImage       = "Error while reading image"
+	ErrorImageTooLarge      = "The image is too large"
+	ErrorServerBusy         = "The server is busy converting other images"
+	ErrorInvalidRequest     = "Error while reading the image request"
+	ErrorInvalidOperation   = "Invalid image operation"
+
+	// CropHeader reports the rectangle kept by a crop, as x,y,width,height
+	// of the image after its operations.
+	CropHeader = "X-Crop-Rect"
+
+	// WidthHeader and HeightHeader report the dimensions of the converted
+	// image, and OriginalWidthHeader and OriginalHeightHeader those of the
+	// upload.
+	WidthHeader          = "X-Image-Width"
+	HeightHeader         = "X-Image-Height"
+	OriginalWidthHeader  = "X-Original-Width"
+	OriginalHeightHeader = "X-Original-Height"
+
+	// DefaultMaxBodyBytes bounds the size of uploaded images.
+	DefaultMaxBodyBytes = 32 << 20
 )
 
+// ErrInvalidImage is wrapped by errors caused by the uploaded image rather
+// than the server.
+var ErrInvalidImage = errors.New("invalid image")
+
+// Handler converts uploaded images, holding the settings shared by every request.
+type Handler struct {
+	limiter      *Limiter
+	maxBodyBytes int64
+	// maxUploadBytes bounds a whole multipart upload, twice maxBodyBytes
+	// unless set.
+	maxUploadBytes int64
+	store          storage.Store
+	storeURL       string
+	watermark      *Watermark
+	font           *opentype.Font
+	index          *Index
+	owner          func(r *http.Request) string
+	fetcher        *Fetcher
+	signer         *Signer
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithLimiter bounds how many images the handler converts at once.
+func WithLimiter(limiter *Limiter) Option {
+	return func(h *Handler) {
+		h.limiter = limiter
+	}
+}
+
+// WithMaxBodyBytes overrides the maximum size of an uploaded image.
+func WithMaxBodyBytes(maxBodyBytes int64) Option {
+	return func(h *Handler) {
+		h.maxBodyBytes = maxBodyBytes
+	}
+}
+
+// WithMaxUploadBytes overrides the maximum size of a multipart upload,
+// whose files are each limited by WithMaxBodyBytes. Since uploads are read
+// before waiting for a worker, it bounds the memory each request holds.
+func WithMaxUploadBytes(maxUploadBytes int64) Option {
+	return func(h *Handler) {
+		h.maxUploadBytes = maxUploadBytes
+	}
+}
+
+// WithStorage stores each original and converted image, linking to them
+// under baseURL, where storage.Handler serves the store.
+func WithStorage(store storage.Store, baseURL string) Option {
+	return func(h *Handler) {
+		h.store = store
+		h.storeURL = baseURL
+	}
+}
+
+// WithWatermark composites the watermark over every converted image.
+// Requests may change its position, opacity and scale.
+func WithWatermark(watermark *Watermark) Option {
+	return func(h *Handler) {
+		h.watermark = watermark
+	}
+}
+
+// WithFont renders text overlays with the font rather than Go Regular.
+func WithFont(typeface *opentype.Font) Option {
+	return func(h *Handler) {
+		h.font = typeface
+	}
+}
+
+// WithIndex records the perceptual hashes of every uploaded image in the
+// index, which ServeSimilar searches.
+func WithIndex(index *Index) Option {
+	return func(h *Handler) {
+		h.index = index
+	}
+}
+
+// WithOwner identifies the client making each request, such as by its API
+// key, so ServeSimilar only finds the images that client uploaded.
+func WithOwner(owner func(r *http.Request) string) Option {
+	return func(h *Handler) {
+		h.owner = owner
+	}
+}
+
+// WithFetcher lets JSON requests name an image by URL, which the fetcher
+// downloads.
+func WithFetcher(fetcher *Fetcher) Option {
+	return func(h *Handler) {
+		h.fetcher = fetcher
+	}
+}
+
+func NewHandler(options ...Option) *Handler {
+	h := &Handler{maxBodyBytes: DefaultMaxBodyBytes}
+	for _, option := range options {
+		option(h)
+	}
+	if h.maxUploadBytes == 0 {
+		h.maxUploadBytes = 2 * h.maxBodyBytes
+	}
+	return h
+}
+
+// defaultHandler converts images without any concurrency limit.
+var defaultHandler = NewHandler()
+
 // HandleImageRequest directs the request to the appropriate call based
-// on the request method.
+// on the request method, using the default settings.
 func HandleImageRequest(w http.ResponseWriter, r *http.Request) {
+	defaultHandler.ServeHTTP(w, r)
+}
+
+// ServeHTTP directs the request to the appropriate call based
+// on the request method.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		handleImageProcessing(w, r)
+		h.handleImageProcessing(w, r)
 	default:
-		http.Error(w, ErrorMethodNotSupported, http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", "POST")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
 	}
 }
 
-func handleImageProcessing(w http.ResponseWriter, r *http.Request) {
-	body := r.Body
-	defer body.Close()
+func (h *Handler) handleImageProcessing(w http.ResponseWriter, r *http.Request) {
+	request, release, ok := h.readRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
 
-	jpeg, err := jpeg.Decode(body)
+	options := h.options(request)
+	if len(request.files) > 1 {
+		h.convertFiles(w, r, request.files, options)
+		return
+	}
+	if Streaming(r) {
+		h.streamConversion(w, r, request.files[0], options)
+		return
+	}
+
+	conversion, header, err := h.convert(r, request.Image, options)
 	if err != nil {
-		http.Error(w, ErrorDecodingImage, http.StatusBadRequest)
+		problem.Write(w, r, ConversionProblem(err))
 		return
 	}
+	writeConversion(w, request.files[0].name, conversion, header)
+}
 
-	resizedImage := resizeImage(jpeg)
+// writeConversion responds with the converted image, named after the
+// upload, and the headers describing it.
+func writeConversion(w http.ResponseWriter, upload string, conversion *Conversion, header http.Header) {
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", conversion.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(conversion.Data)))
+	w.Header().Set("Content-Disposition", contentDisposition(upload, conversion.ContentType))
+	w.WriteHeader(http.StatusOK)
+	w.Write(conversion.Data)
+}
+
+// contentDisposition names a single converted image after its upload, or
+// "image" when the upload has no name, with the extension of its new
+// format. It's inline so browsers still show the image.
+func contentDisposition(upload string, contentType string) string {
+	base := strings.TrimSuffix(upload, path.Ext(upload))
+	if base == "" {
+		base = "image"
+	}
+	return mime.FormatMediaType("inline", map[string]string{"filename": base + contentExtension(contentType)})
+}
+
+// convertFiles converts every file of a multipart upload, responding with
+// a multipart/mixed body when the client accepts one and a ZIP otherwise.
+// If any file can't be converted the request fails.
+func (h *Handler) convertFiles(w http.ResponseWriter, r *http.Request, files []imageFile, options Options) {
+	converted := make([]convertedFile, len(files))
+	for i, file := range files {
+		conversion, header, err := h.convert(r, file.data, options)
+		if err != nil {
+			conversionProblem := ConversionProblem(err)
+			problem.Write(w, r, conversionProblem.WithDetail(fmt.Sprintf("%s: %s", file.name, conversionProblem.Detail)))
+			return
+		}
+		converted[i] = convertedFile{name: file.name, conversion: conversion, header: header}
+	}
 
-	newPngBuffer := new(bytes.Buffer)
-	if err := png.Encode(newPngBuffer, resizedImage); err != nil {
-		http.Error(w, ErrorEncodingImage, http.StatusInternalServerError)
+	if strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+		body, contentType, err := encodeMultipart(converted)
+		if err != nil {
+			problem.Write(w, r, ConversionProblem(err))
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
 		return
 	}
 
+	archive, err := encodeZIP(converted)
+	if err != nil {
+		problem.Write(w, r, ConversionProblem(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "images.zip"}))
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "image/png")
-	w.Write(newPngBuffer.Bytes())
+	w.Write(archive)
 }
 
-func resizeImage(img image.Image) image.Image {
-	maxWidth, maxHeight := 256, 256
+// convert converts a single upload, storing and indexing it when the
+// handler is configured to. The returned headers describe the conversion.
+func (h *Handler) convert(r *http.Request, upload []byte, options Options) (*Conversion, http.Header, error) {
+	conversion, err := ConvertContext(r.Context(), upload, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := conversionHeader(conversion)
+	if h.store != nil {
+		h.storeImages(r, header, upload, conversion.Data)
+	}
+	h.indexImage(r, upload, conversion)
+	return conversion, header, nil
+}
+
+// conversionHeader describes the conversion's dimensions, its crop and, for
+// buffered PNGs, what the PNG options saved.
+func conversionHeader(conversion *Conversion) http.Header {
+	header := http.Header{}
+	header.Set(WidthHeader, strconv.Itoa(conversion.Width))
+	header.Set(HeightHeader, strconv.Itoa(conversion.Height))
+	header.Set(OriginalWidthHeader, strconv.Itoa(conversion.OriginalWidth))
+	header.Set(OriginalHeightHeader, strconv.Itoa(conversion.OriginalHeight))
+	if conversion.Crop != nil {
+		crop := conversion.Crop
+		header.Set(CropHeader, fmt.Sprintf("%d,%d,%d,%d", crop.Min.X, crop.Min.Y, crop.Dx(), crop.Dy()))
+	}
+	if conversion.UnoptimizedSize > 0 {
+		size := conversion.UnoptimizedSize
+		saved := size - len(conversion.Data)
+		header.Set(SavingsHeader, fmt.Sprintf("%d bytes (%.1f%%)", saved, float64(saved)*100/float64(size)))
+	}
+	return header
+}
+
+// indexImage adds the upload to the handler's index, owned by the client
+// making the request, when its hashes were computed.
+func (h *Handler) indexImage(r *http.Request, upload []byte, conversion *Conversion) {
+	if conversion.Hashes == nil {
+		return
+	}
+	record := Record{Key: storage.ContentKey(upload, extension(upload)), Owner: h.requestOwner(r), Hashes: *conversion.Hashes, CreatedOn: time.Now()}
+	if err := h.index.Add(record); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while indexing image %s: %s\n", record.Key, err.Error())
+	}
+}
+
+// requestOwner identifies the client making the request, or is empty when
+// the handler doesn't tell clients apart.
+func (h *Handler) requestOwner(r *http.Request) string {
+	if h.owner == nil {
+		return ""
+	}
+	return h.owner(r)
+}
+
+// readRequest reads and parses the image request, then waits for a
+// conversion slot. The release function must be called once the image has
+// been processed. When ok is false a problem has already been written.
+func (h *Handler) readRequest(w http.ResponseWriter, r *http.Request) (request *imageRequest, release func(), ok bool) {
+	body := r.Body
+	defer body.Close()
+
+	// Multipart uploads may hold several images, each limited separately
+	// and together by maxUploadBytes
+	maxBodyBytes, limited := h.maxBodyBytes, "images"
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		maxBodyBytes, limited = h.maxUploadBytes, "multipart uploads"
+	}
+
+	// Read the whole upload before waiting for a worker, so slow clients
+	// don't hold a worker while their image is transferred
+	requestBody, err := io.ReadAll(http.MaxBytesReader(w, body, maxBodyBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, ErrorImageTooLarge).
+				WithDetail(fmt.Sprintf("%s may be at most %d bytes", limited, maxBodyBytes)))
+			return nil, nil, false
+		}
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidImage, ErrorReadingImage).WithDetail(err.Error()))
+		return nil, nil, false
+	}
 
+	request, err = parseImageRequest(r, requestBody, h.maxBodyBytes)
+	if err != nil {
+		var tooLarge *fileTooLargeError
+		if errors.As(err, &tooLarge) {
+			problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, ErrorImageTooLarge).WithDetail(tooLarge.Error()))
+			return nil, nil, false
+		}
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidRequest).WithDetail(err.Error()))
+		return nil, nil, false
+	}
+	if request.URL != "" {
+		if h.fetcher == nil {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorFetchDisabled))
+			return nil, nil, false
+		}
+		// Like uploads, fetched images are downloaded before waiting for
+		// a worker
+		fetched, err := h.fetcher.Fetch(r.Context(), request.URL)
+		if err != nil {
+			problem.Write(w, r, FetchProblem(err))
+			return nil, nil, false
+		}
+		request.Image, request.files = fetched, []imageFile{{name: fetchedName(request.URL), data: fetched}}
+	}
+
+	if release, ok = h.acquire(w, r); !ok {
+		return nil, nil, false
+	}
+	return request, release, true
+}
+
+// acquire waits for a conversion slot, returning the function releasing
+// it. When ok is false a problem has already been written.
+func (h *Handler) acquire(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if h.limiter == nil {
+		return func() {}, true
+	}
+	release, err := h.limiter.Acquire(r.Context())
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(h.limiter.RetryAfter.Seconds()))))
+		problem.Write(w, r, problem.New(http.StatusServiceUnavailable, problem.CodeOverloaded, ErrorServerBusy).WithDetail(err.Error()))
+		return nil, false
+	}
+	return release, true
+}
+
+// storeImages saves the original and converted images, pointing the
+// response's Content-Location at the converted image and a Link header at
+// the original. The conversion is still returned if they can't be stored.
+func (h *Handler) storeImages(r *http.Request, header http.Header, original []byte, converted []byte) {
+	originalKey := storage.ContentKey(original, extension(original))
+	convertedKey := storage.ContentKey(converted, extension(converted))
+	for key, data := range map[string][]byte{originalKey: original, convertedKey: converted} {
+		if err := h.store.Put(r.Context(), key, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while storing image %s: %s\n", key, err.Error())
+			return
+		}
+	}
+
+	header.Set("Content-Location", h.storeURL+convertedKey)
+	header.Add("Link", fmt.Sprintf(`<%s%s>; rel="original"`, h.storeURL, originalKey))
+}
+
+// imageRequest is the JSON form of an image request, used to send
+// options along with the image.
+type imageRequest struct {
+	// Image is the base64 encoded JPEG or GIF.
+	Image []byte `json:"image"`
+	// URL is fetched for the image instead, when the handler has a
+	// Fetcher.
+	URL        string      `json:"url"`
+	Operations []Operation `json:"operations"`
+	// Crop is a crop mode, center or smart, and Aspect the ratio it
+	// crops to, such as 16:9.
+	Crop      string            `json:"crop"`
+	Aspect    string            `json:"aspect"`
+	Watermark *WatermarkOptions `json:"watermark"`
+	Text      []TextOverlay     `json:"text"`
+	// Frame picks a single frame of an animated GIF to convert.
+	Frame *int `json:"frame"`
+	// EmbedProfile embeds an sRGB ICC profile in PNG output.
+	EmbedProfile bool `json:"embed_icc"`
+	// Compression is the PNG compression level, and Quantize the method
+	// reducing the image to a palette of Colors, optionally dithered.
+	Compression string `json:"compression"`
+	Quantize    string `json:"quantize"`
+	Colors      int    `json:"colors"`
+	Dither      bool   `json:"dither"`
+	// Format is png or jpeg, Quality the JPEG quality, and Progressive
+	// interlaces PNGs.
+	Format      string `json:"format"`
+	Quality     int    `json:"quality"`
+	Progressive bool   `json:"progressive"`
+
+	crop *CropOptions
+	png  PNGOptions
+	// files are the uploaded images, of which Image is the first.
+	files []imageFile
+}
+
+// parseImageRequest reads the image and its options from either a JSON
+// body, a multipart/form-data body with options in its form fields, or a
+// raw JPEG body with options in the query string. Files in a multipart
+// body are limited to maxFileBytes each.
+func parseImageRequest(r *http.Request, body []byte, maxFileBytes int64) (*imageRequest, error) {
+	request := &imageRequest{}
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.Unmarshal(body, request); err != nil {
+			return nil, err
+		}
+		if (len(request.Image) == 0) == (request.URL == "") {
+			return nil, errors.New("exactly one of image and url is required")
+		}
+	case "multipart/form-data":
+		files, fields, err := parseMultipart(body, params["boundary"], maxFileBytes)
+		if err != nil {
+			return nil, err
+		}
+		request.files, request.Image = files, files[0].data
+		// Options may be sent in the query string as well as the form
+		query := r.URL.Query()
+		for name, values := range fields {
+			query[name] = append(query[name], values...)
+		}
+		if err := request.parseQuery(query); err != nil {
+			return nil, err
+		}
+	default:
+		request.Image = body
+		if err := request.parseQuery(r.URL.Query()); err != nil {
+			return nil, err
+		}
+	}
+	if request.files == nil && request.URL == "" {
+		request.files = []imageFile{{data: request.Image}}
+	}
+	return request, request.validate()
+}
+
+// validate checks the request's options, parsing those which are sent as
+// strings.
+func (request *imageRequest) validate() error {
+	if err := ValidateOperations(request.Operations); err != nil {
+		return err
+	}
+	var err error
+	if request.crop, err = ParseCrop(request.Crop, request.Aspect); err != nil {
+		return err
+	}
+	if request.png, err = ParsePNGOptions(request.Compression, request.Quantize, request.Colors, request.Dither); err != nil {
+		return err
+	}
+	if err := ValidateFormat(request.Format, request.Quality, request.Progressive, request.png); err != nil {
+		return err
+	}
+	request.png.Interlace = request.Progressive
+	if err := request.Watermark.Validate(); err != nil {
+		return err
+	}
+	return ValidateTextOverlays(request.Text)
+}
+
+// options are the conversion options the request asks for, with the
+// handler's font and watermark.
+func (h *Handler) options(request *imageRequest) Options {
+	options := Options{Operations: request.Operations, Crop: request.crop, Text: request.Text, Font: h.font, Hash: h.index != nil, Frame: request.Frame,
+		EmbedProfile: request.EmbedProfile, Format: request.Format, Quality: request.Quality, PNG: request.png}
+	if h.watermark != nil {
+		options.Watermark = h.watermark.With(request.Watermark)
+	}
+	return options
+}
+
+// parseQuery reads the request's options from query parameters or form
+// fields.
+func (request *imageRequest) parseQuery(query url.Values) error {
+	var err error
+	request.Crop, request.Aspect = query.Get("crop"), query.Get("aspect")
+	if request.Operations, err = ParseOperations(query); err != nil {
+		return err
+	}
+	if request.Watermark, request.Text, err = parseOverlayQuery(query); err != nil {
+		return err
+	}
+	if query.Has("frame") {
+		frame, err := strconv.Atoi(query.Get("frame"))
+		if err != nil {
+			return fmt.Errorf("%w: frame: %s", ErrInvalidOperation, err.Error())
+		}
+		request.Frame = &frame
+	}
+	if query.Has("embed_icc") {
+		if request.EmbedProfile, err = strconv.ParseBool(query.Get("embed_icc")); err != nil {
+			return fmt.Errorf("%w: embed_icc: %s", ErrInvalidOperation, err.Error())
+		}
+	}
+	request.Compression, request.Quantize = query.Get("compression"), query.Get("quantize")
+	if query.Has("colors") {
+		if request.Colors, err = strconv.Atoi(query.Get("colors")); err != nil {
+			return fmt.Errorf("%w: colors: %s", ErrInvalidOperation, err.Error())
+		}
+	}
+	if query.Has("dither") {
+		if request.Dither, err = strconv.ParseBool(query.Get("dither")); err != nil {
+			return fmt.Errorf("%w: dither: %s", ErrInvalidOperation, err.Error())
+		}
+	}
+	request.Format = query.Get("format")
+	if query.Has("quality") {
+		if request.Quality, err = strconv.Atoi(query.Get("quality")); err != nil {
+			return fmt.Errorf("%w: quality: %s", ErrInvalidOperation, err.Error())
+		}
+	}
+	if query.Has("progressive") {
+		if request.Progressive, err = strconv.ParseBool(query.Get("progressive")); err != nil {
+			return fmt.Errorf("%w: progressive: %s", ErrInvalidOperation, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseOverlayQuery reads the watermark_position, watermark_opacity and
+// watermark_scale overrides, and a text overlay from text, text_position,
+// text_size and text_color.
+func parseOverlayQuery(query url.Values) (*WatermarkOptions, []TextOverlay, error) {
+	var watermark *WatermarkOptions
+	parseFloat := func(name string) (*float64, error) {
+		if !query.Has(name) {
+			return nil, nil
+		}
+		value, err := strconv.ParseFloat(query.Get(name), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidOperation, name, err.Error())
+		}
+		return &value, nil
+	}
+	if query.Has("watermark_position") || query.Has("watermark_opacity") || query.Has("watermark_scale") {
+		watermark = &WatermarkOptions{Position: Position(query.Get("watermark_position"))}
+		var err error
+		if watermark.Opacity, err = parseFloat("watermark_opacity"); err != nil {
+			return nil, nil, err
+		}
+		if watermark.Scale, err = parseFloat("watermark_scale"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !query.Has("text") {
+		return watermark, nil, nil
+	}
+	overlay := TextOverlay{Text: query.Get("text"), Position: Position(query.Get("text_position")), Color: query.Get("text_color")}
+	size, err := parseFloat("text_size")
+	if err != nil {
+		return nil, nil, err
+	}
+	if size != nil {
+		overlay.Size = *size
+	}
+	return watermark, []TextOverlay{overlay}, nil
+}
+
+// Options controls how an image is converted.
+type Options struct {
+	// Operations transform the decoded image, in order, before it's resized.
+	Operations []Operation
+	// Crop cuts the transformed image to an aspect ratio before it's resized.
+	Crop *CropOptions
+	// Watermark is composited over the resized image when set.
+	Watermark *Watermark
+	// Text is drawn over the resized image, after the watermark.
+	Text []TextOverlay
+	// Font renders the text, defaulting to Go Regular.
+	Font *opentype.Font
+	// Hash computes the perceptual hashes of the original image.
+	Hash bool
+	// Frame converts a single frame of an animated GIF to a PNG, counting
+	// from 0, rather than resizing the whole animation.
+	Frame *int
+	// EmbedProfile embeds an sRGB ICC profile in a PNG or JPEG, which the
+	// pixels are always converted to.
+	EmbedProfile bool
+	// Format is the format of still images, FormatPNG or FormatJPEG,
+	// defaulting to PNG. Animations are always GIFs.
+	Format string
+	// Quality is the JPEG quality from 1 to 100, defaulting to
+	// jpeg.DefaultQuality.
+	Quality int
+	// PNG controls the compression, palette and interlacing of PNG output.
+	PNG PNGOptions
+}
+
+// Convert decodes a JPEG or GIF, resizes it to fit within 256x256 and
+// encodes it as a PNG, or a GIF when it's animated. Errors caused by the
+// upload itself wrap ErrInvalidImage.
+func Convert(upload []byte) ([]byte, error) {
+	conversion, err := ConvertWithOptions(upload, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return conversion.Data, nil
+}
+
+// Conversion is a converted image along with how it was produced.
+type Conversion struct {
+	Data []byte
+	// ContentType is image/gif for animations, and otherwise image/png or
+	// image/jpeg according to Options.Format.
+	ContentType string
+	// Crop is the rectangle of the transformed image kept by Options.Crop.
+	Crop *image.Rectangle
+	// Hashes are the perceptual hashes of the original image, computed
+	// when Options.Hash is set.
+	Hashes *Hashes
+	// UnoptimizedSize is the size the PNG would have been in full color
+	// with the default compression, for reporting what Options.PNG saved.
+	// It's zero for GIFs.
+	UnoptimizedSize int
+	// Width and Height are the dimensions of the converted image, and
+	// OriginalWidth and OriginalHeight those of the upload.
+	Width, Height                 int
+	OriginalWidth, OriginalHeight int
+}
+
+// ConvertWithOptions converts an image like Convert, first applying the
+// options' operations. Operations which can't be applied to the image wrap
+// ErrInvalidOperation. Animated GIFs stay animated GIFs unless
+// Options.Frame picks one of their frames.
+func ConvertWithOptions(upload []byte, options Options) (*Conversion, error) {
+	return ConvertContext(context.Background(), upload, options)
+}
+
+// ConvertContext is ConvertWithOptions, stopping with the context's error
+// when the context is done before the operations have been applied.
+func ConvertContext(ctx context.Context, upload []byte, options Options) (*Conversion, error) {
+	prepared, err := prepare(ctx, upload, options)
+	if err != nil {
+		return nil, err
+	}
+	return prepared.encode()
+}
+
+// preparedImage is an upload which has been decoded, transformed and
+// resized, ready to be encoded.
+type preparedImage struct {
+	// conversion describes the image, without its data.
+	conversion *Conversion
+	// image is the still image, or animation the GIF, to encode.
+	image     image.Image
+	animation *gif.GIF
+	options   Options
+}
+
+// prepare converts the upload up to encoding it, so errors caused by the
+// upload or options are found before anything is written.
+func prepare(ctx context.Context, upload []byte, options Options) (*preparedImage, error) {
+	if isGIF(upload) {
+		return prepareGIF(ctx, upload, options)
+	}
+	if options.Frame != nil && *options.Frame != 0 {
+		return nil, fmt.Errorf("%w: only animated GIFs have more than one frame", ErrInvalidOperation)
+	}
+	decoded, err := decode(upload)
+	if err != nil {
+		return nil, err
+	}
+	return prepareImage(ctx, decoded, options)
+}
+
+// prepareImage transforms, crops, resizes and overlays a decoded image.
+func prepareImage(ctx context.Context, decoded image.Image, options Options) (*preparedImage, error) {
+	transformed, err := ApplyOperations(ctx, decoded, options.Operations)
+	if err != nil {
+		return nil, err
+	}
+	original := decoded.Bounds()
+	conversion := &Conversion{ContentType: "image/png", OriginalWidth: original.Dx(), OriginalHeight: original.Dy()}
+	if options.Format == FormatJPEG {
+		conversion.ContentType = "image/jpeg"
+	}
+	if options.Hash {
+		hashes := ComputeHashes(decoded)
+		conversion.Hashes = &hashes
+	}
+	if options.Crop != nil {
+		window := cropWindow(transformed, *options.Crop)
+		conversion.Crop = &window
+		transformed, _ = crop(transformed, window.Min.X-transformed.Bounds().Min.X, window.Min.Y-transformed.Bounds().Min.Y, window.Dx(), window.Dy())
+	}
+	resizedImage, err := applyOverlays(resizeImage(transformed), options)
+	if err != nil {
+		return nil, err
+	}
+	conversion.Width, conversion.Height = resizedImage.Bounds().Dx(), resizedImage.Bounds().Dy()
+	return &preparedImage{conversion: conversion, image: resizedImage, options: options}, nil
+}
+
+// encode encodes the prepared image in memory. PNGs are encoded with
+// encodePNG, which can pick the smaller of several encodings and measures
+// what they saved.
+func (p *preparedImage) encode() (*Conversion, error) {
+	if p.conversion.ContentType != "image/png" {
+		encoded := new(bytes.Buffer)
+		if err := p.write(encoded); err != nil {
+			return nil, err
+		}
+		p.conversion.Data = encoded.Bytes()
+		return p.conversion, nil
+	}
+
+	var err error
+	if p.conversion.Data, p.conversion.UnoptimizedSize, err = encodePNG(p.image, p.options.PNG); err != nil {
+		return nil, err
+	}
+	if p.options.EmbedProfile {
+		size := len(p.conversion.Data)
+		if p.conversion.Data, err = embedProfile(p.conversion.Data); err != nil {
+			return nil, err
+		}
+		p.conversion.UnoptimizedSize += len(p.conversion.Data) - size
+	}
+	return p.conversion, nil
+}
+
+// write encodes the prepared image as it's written to w.
+func (p *preparedImage) write(w io.Writer) error {
+	if p.animation != nil {
+		return gif.EncodeAll(w, p.animation)
+	}
+	if p.conversion.ContentType == "image/jpeg" {
+		if p.options.EmbedProfile {
+			_, gray := p.image.(*image.Gray)
+			w = newJPEGProfileWriter(w, gray)
+		}
+		return writeJPEG(w, p.image, p.options.Quality)
+	}
+	if p.options.EmbedProfile {
+		w = newPNGProfileWriter(w)
+	}
+	return streamPNG(w, p.image, p.options.PNG)
+}
+
+// decode reads the uploaded JPEG, or the first frame of a GIF, wrapping
+// errors with ErrInvalidImage. JPEGs are checked against
+// MaxOperationPixels before they're decoded, since a small file can
+// declare huge dimensions, and those with an embedded ICC profile are
+// converted to sRGB.
+func decode(upload []byte) (image.Image, error) {
+	if isGIF(upload) {
+		animation, err := decodeGIF(upload)
+		if err != nil {
+			return nil, err
+		}
+		return composeFrame(animation, 0), nil
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(upload))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImage, err.Error())
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > MaxOperationPixels {
+		return nil, fmt.Errorf("%w: jpeg: %d pixels exceeds the limit of %d", ErrInvalidImage, pixels, MaxOperationPixels)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(upload))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImage, err.Error())
+	}
+	if profile, err := ParseProfile(jpegProfile(upload)); err == nil {
+		decoded = toSRGB(decoded, profile)
+	}
+	return decoded, nil
+}
+
+// ConversionProblem describes an error returned by Convert, distinguishing
+// bad uploads from failures on the server.
+func ConversionProblem(err error) *problem.Problem {
+	if errors.Is(err, ErrInvalidImage) {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidImage, ErrorDecodingImage).WithDetail(err.Error())
+	}
+	if errors.Is(err, ErrInvalidOperation) {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidOperation).WithDetail(err.Error())
+	}
+	return problem.New(http.StatusInternalServerError, problem.CodeEncodingFailed, ErrorEncodingImage).WithDetail(err.Error())
+}
+
+func resizeImage(img image.Image) image.Image {
 	//Determine initial bounds
 	width := img.Bounds().Dx()
 	height := img.Bounds().Dy()
 
+	newWidth, newHeight := fitWithin(width, height)
 	// image within bounds and does not need to be resized
-	if width <= maxWidth && height <= maxHeight {
+	if newWidth == width && newHeight == height {
 		return img
 	}
+
+	// Draw the newly sized the image
+	scaledImg := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	draw.NearestNeighbor.Scale(scaledImg, scaledImg.Rect, img, img.Bounds(), draw.Over, nil)
+
+	return scaledImg
+}
+
+// fitWithin returns the size of an image scaled down to fit within
+// 256x256, keeping its aspect ratio.
+func fitWithin(width int, height int) (int, int) {
+	maxWidth, maxHeight := 256, 256
+
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
 	// Setup the aspect ratio
 	newWidth, newHeight := maxWidth, maxHeight
 	if width < height {
@@ -74,10 +874,5 @@ func resizeImage(img image.Image) image.Image {
 			newHeight = 1
 		}
 	}
-
-	// Draw the newly sized the image
-	scaledImg := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
-	draw.NearestNeighbor.Scale(scaledImg, scaledImg.Rect, img, img.Bounds(), draw.Over, nil)
-
-	return scaledImg
+	return newWidth, newHeight
 }
@@ -1,16 +1,39 @@
 package images
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/storage"
 )
 
 func TestHandleImageProcessingErrorsOnBadMethod(t *testing.T) {
@@ -89,6 +112,30 @@ func TestHandleImageProcessingErrorsOnBadFile(t *testing.T) {
 	}
 }
 
+func TestHandleImageProcessingProblemOnBadFile(t *testing.T) {
+	req := httptest.NewRequest("POST", "localhost:8080", strings.NewReader("this is not an image"))
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	HandleImageRequest(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != problem.ContentType {
+		t.Errorf("Content-Type was %s, expected %s", resp.Header.Get("Content-Type"), problem.ContentType)
+	}
+
+	var received problem.Problem
+	if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if received.Code != problem.CodeInvalidImage || received.Title != ErrorDecodingImage {
+		t.Errorf("Received: %v, expected code %s and title %s", received, problem.CodeInvalidImage, ErrorDecodingImage)
+	}
+}
+
 func TestHandleImageProcessingHandlesRealImage(t *testing.T) {
 	testImg, err := os.Open("./test_images/test_image.jpeg")
 	if err != nil {
@@ -176,3 +223,2417 @@ func TestResizeImage(t *testing.T) {
 		})
 	}
 }
+
+func TestLimiterQueue(t *testing.T) {
+	limiter := NewLimiter(1, 1)
+
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The second job waits in the queue for the first to finish
+	acquired := make(chan func())
+	go func() {
+		queuedRelease, err := limiter.Acquire(context.Background())
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		acquired <- queuedRelease
+	}()
+	for queued(limiter) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so the third is rejected immediately
+	if _, err := limiter.Acquire(context.Background()); err != ErrQueueFull {
+		t.Errorf("Expected %v, received %v", ErrQueueFull, err)
+	}
+
+	release()
+	(<-acquired)()
+
+	metrics := limiter.Metrics()
+	expected := map[string]string{"running": "0", "queued": "0", "completed": "2", "rejected": "1", "queue_wait_count": "2"}
+	for name, value := range expected {
+		if metrics.Get(name).String() != value {
+			t.Errorf("%s was %s, expected %s", name, metrics.Get(name).String(), value)
+		}
+	}
+	if metrics.Get("queue_wait_seconds_max").(*expvar.Float).Value() <= 0 {
+		t.Error("Expected the queued job's wait to be recorded")
+	}
+}
+
+func TestLimiterAbandonedWait(t *testing.T) {
+	limiter := NewLimiter(1, 1)
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, received %v", context.DeadlineExceeded, err)
+	}
+	if queued(limiter) != 0 || limiter.Metrics().Get("abandoned").String() != "1" {
+		t.Error("Expected the abandoned job to leave the queue")
+	}
+}
+
+func TestHandlerSheddingAndLimits(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	busyLimiter := NewLimiter(1, 0)
+	release, err := busyLimiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer release()
+
+	tests := []struct {
+		handler              *Handler
+		expectedResponseCode int
+		expectedRetryAfter   string
+	}{
+		{NewHandler(WithLimiter(NewLimiter(1, 0))), http.StatusOK, ""},
+		{NewHandler(WithLimiter(busyLimiter)), http.StatusServiceUnavailable, "1"},
+		{NewHandler(WithMaxBodyBytes(1024)), http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Handler=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "localhost:8080", bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			test.handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if w.Header().Get("Retry-After") != test.expectedRetryAfter {
+				t.Errorf("Retry-After was %q, expected %q", w.Header().Get("Retry-After"), test.expectedRetryAfter)
+			}
+		})
+	}
+}
+
+func queued(limiter *Limiter) int {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.queued
+}
+
+func TestHandlerStoresImages(t *testing.T) {
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	handler := NewHandler(WithStorage(store, "/v2/images/"))
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", bytes.NewReader(testImg))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	convertedKey := storage.ContentKey(w.Body.Bytes(), ".png")
+	if w.Header().Get("Content-Location") != "/v2/images/"+convertedKey {
+		t.Errorf("Content-Location was %s, expected /v2/images/%s", w.Header().Get("Content-Location"), convertedKey)
+	}
+	originalKey := storage.ContentKey(testImg, ".jpeg")
+	expectedLink := fmt.Sprintf(`</v2/images/%s>; rel="original"`, originalKey)
+	if w.Header().Get("Link") != expectedLink {
+		t.Errorf("Link was %s, expected %s", w.Header().Get("Link"), expectedLink)
+	}
+
+	for _, key := range []string{originalKey, convertedKey} {
+		blob, err := store.Get(context.Background(), key)
+		if err != nil {
+			t.Errorf("Expected %s to be stored, received %v", key, err)
+			continue
+		}
+		blob.Content.Close()
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden images in test_images/golden")
+
+// goldenSource is a small gradient, so that every operation visibly
+// changes it.
+func goldenSource() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 12, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 12; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 20), uint8(y * 30), uint8((x + y) * 10), 255})
+		}
+	}
+	return img
+}
+
+// TestOperationsGolden compares each operation's output with a golden
+// image. Pixels are compared rather than PNG bytes, since the encoder's
+// output can change between Go versions. Run with -update to regenerate.
+func TestOperationsGolden(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations []Operation
+	}{
+		{"crop", []Operation{{Op: OpCrop, X: 2, Y: 1, Width: 6, Height: 4}}},
+		{"rotate90", []Operation{{Op: OpRotate, Angle: 90}}},
+		{"rotate180", []Operation{{Op: OpRotate, Angle: 180}}},
+		{"rotate270", []Operation{{Op: OpRotate, Angle: 270}}},
+		{"flip_horizontal", []Operation{{Op: OpFlip, Direction: "horizontal"}}},
+		{"flip_vertical", []Operation{{Op: OpFlip, Direction: "vertical"}}},
+		{"grayscale", []Operation{{Op: OpGrayscale}}},
+		{"brightness", []Operation{{Op: OpBrightness, Amount: 30}}},
+		{"contrast", []Operation{{Op: OpContrast, Amount: -50}}},
+		{"blur", []Operation{{Op: OpBlur, Sigma: 1.5}}},
+		{"sharpen", []Operation{{Op: OpSharpen, Amount: 2}}},
+		{"pad", []Operation{{Op: OpPad, Padding: 2, Color: "ff000080"}}},
+		{"pipeline", []Operation{
+			{Op: OpCrop, X: 0, Y: 0, Width: 8, Height: 8},
+			{Op: OpRotate, Angle: 90},
+			{Op: OpGrayscale},
+			{Op: OpPad, Padding: 1},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformed, err := ApplyOperations(context.Background(), goldenSource(), test.operations)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			goldenPath := "./test_images/golden/" + test.name + ".png"
+
+			if *update {
+				file, err := os.Create(goldenPath)
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				defer file.Close()
+				if err := png.Encode(file, transformed); err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				return
+			}
+
+			file, err := os.Open(goldenPath)
+			if err != nil {
+				t.Fatalf("Error pulling golden image: %v", err)
+			}
+			defer file.Close()
+			golden, err := png.Decode(file)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if golden.Bounds().Size() != transformed.Bounds().Size() {
+				t.Fatalf("Size was %v, expected %v", transformed.Bounds().Size(), golden.Bounds().Size())
+			}
+			expected, actual := toNRGBA(golden), toNRGBA(transformed)
+			if !bytes.Equal(expected.Pix, actual.Pix) {
+				t.Error("Pixels differ from the golden image")
+			}
+		})
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	tests := []struct {
+		query              string
+		expectedOperations []Operation
+		expectsError       bool
+	}{
+		{"", nil, false},
+		{
+			"op=crop:1,2,3,4&op=rotate:90&op=grayscale&op=pad:5,000000",
+			[]Operation{
+				{Op: OpCrop, X: 1, Y: 2, Width: 3, Height: 4},
+				{Op: OpRotate, Angle: 90},
+				{Op: OpGrayscale},
+				{Op: OpPad, Padding: 5, Color: "000000"},
+			},
+			false,
+		},
+		{"op=blur:2&op=sharpen:1&op=flip:vertical&op=brightness:-10&op=contrast:20", []Operation{
+			{Op: OpBlur, Sigma: 2},
+			{Op: OpSharpen, Amount: 1},
+			{Op: OpFlip, Direction: "vertical"},
+			{Op: OpBrightness, Amount: -10},
+			{Op: OpContrast, Amount: 20},
+		}, false},
+		{"op=rotate:45", nil, true},
+		{"op=crop:1,2", nil, true},
+		{"op=grayscale:1", nil, true},
+		{"op=pad:5,nothex", nil, true},
+		{"op=blur:0", nil, true},
+		{"op=swirl", nil, true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("ParseOperations=%d", i), func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			operations, err := ParseOperations(query)
+			if (err != nil) != test.expectsError {
+				t.Fatalf("Error was %v, expected an error: %t", err, test.expectsError)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("Expected %v to wrap %v", err, ErrInvalidOperation)
+			}
+			if !test.expectsError && !reflect.DeepEqual(operations, test.expectedOperations) {
+				t.Errorf("Operations were %+v, expected %+v", operations, test.expectedOperations)
+			}
+		})
+	}
+}
+
+func TestOperationSizeLimits(t *testing.T) {
+	tests := []struct {
+		operation    Operation
+		size         image.Point
+		expectsError bool
+	}{
+		{Operation{Op: OpPad, Padding: 1000}, image.Pt(10, 10), false},
+		// Five pads of 1000 grow a 10x10 image past the limit
+		{Operation{Op: OpPad, Padding: 1000}, image.Pt(8010, 8010), true},
+		{Operation{Op: OpPad, Padding: 1}, image.Pt(1, MaxOperationPixels-2), true},
+		{Operation{Op: OpRotate, Angle: 90}, image.Pt(8010, 8010), false},
+		{Operation{Op: OpBlur, Sigma: 50}, image.Pt(1000, 1000), false},
+		{Operation{Op: OpBlur, Sigma: 50}, image.Pt(4000, 3000), true},
+		{Operation{Op: OpBlur, Sigma: 2}, image.Pt(4000, 3000), false},
+		{Operation{Op: OpSharpen, Amount: 10}, image.Pt(8000, 8000), false},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s=%v", test.operation.Op, test.size), func(t *testing.T) {
+			err := test.operation.checkSize(image.Rectangle{Max: test.size})
+			if (err != nil) != test.expectsError {
+				t.Fatalf("Error was %v, expected an error: %t", err, test.expectsError)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("Expected %v to wrap %v", err, ErrInvalidOperation)
+			}
+		})
+	}
+
+	// The pipeline stops before applying an operation over the limit
+	_, err := ApplyOperations(context.Background(), image.NewNRGBA(image.Rect(0, 0, 2000, 2000)), []Operation{{Op: OpGrayscale}, {Op: OpBlur, Sigma: 50}})
+	if !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected %v to wrap %v", err, ErrInvalidOperation)
+	}
+}
+
+func TestOperationsStopWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+
+	if _, err := ApplyOperations(ctx, img, []Operation{{Op: OpGrayscale}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v to be %v", err, context.Canceled)
+	}
+	// Blurs check the context while they convolve
+	if _, err := blur(ctx, img, 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v to be %v", err, context.Canceled)
+	}
+	if _, err := sharpen(ctx, img, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v to be %v", err, context.Canceled)
+	}
+}
+
+func TestDecodeRejectsHugeJPEG(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	// Declare a 65535x65535 image in the start of frame segment
+	huge := append([]byte(nil), testImg...)
+	sof := bytes.Index(huge, []byte{0xff, 0xc0})
+	if sof < 0 {
+		sof = bytes.Index(huge, []byte{0xff, 0xc2})
+	}
+	if sof < 0 {
+		t.Fatal("Expected the test image to have a start of frame segment")
+	}
+	copy(huge[sof+5:], []byte{0xff, 0xff, 0xff, 0xff})
+
+	_, err = decode(huge)
+	if !errors.Is(err, ErrInvalidImage) || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("Expected %v to be rejected for its size", err)
+	}
+}
+
+func TestHandlerAppliesOperations(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	jsonBody, err := json.Marshal(imageRequest{Image: testImg, Operations: []Operation{{Op: OpRotate, Angle: 90}}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	unrotated, err := Convert(testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	unrotatedImage, err := png.Decode(bytes.NewReader(unrotated))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	unrotatedSize := unrotatedImage.Bounds().Size()
+
+	tests := []struct {
+		query                string
+		contentType          string
+		body                 []byte
+		expectedResponseCode int
+	}{
+		{"?op=rotate:90", "image/jpeg", testImg, http.StatusOK},
+		{"", "application/json", jsonBody, http.StatusOK},
+		{"?op=rotate:45", "image/jpeg", testImg, http.StatusBadRequest},
+		{"", "application/json", []byte(`{"image": "not base64"}`), http.StatusBadRequest},
+		{"", "application/json", []byte(`{"operations": []}`), http.StatusBadRequest},
+		// Crops outside the image are only detected once it's decoded
+		{"?op=crop:100000,0,10,10", "image/jpeg", testImg, http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s %s=%d", test.contentType, test.query, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+
+			HandleImageRequest(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			rotated, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if size := rotated.Bounds().Size(); size.X != unrotatedSize.Y || size.Y != unrotatedSize.X {
+				t.Errorf("Size was %v, expected the rotation of %v", size, unrotatedSize)
+			}
+		})
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	// The left half of the watermark is transparent and the right half red
+	watermarkImage := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 5; x < 10; x++ {
+			watermarkImage.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	black := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(black, black.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	watermark := &Watermark{Image: watermarkImage, Position: PositionBottomRight, Opacity: 0.5, Scale: 0.2}
+
+	watermarked, err := applyOverlays(black, Options{Watermark: watermark})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The 20x20 watermark sits 2 pixels from the bottom right corner
+	tests := []struct {
+		x, y        int
+		expectedRed uint8
+	}{
+		{10, 10, 0},
+		{80, 85, 0},
+		{95, 85, 128},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Watermark=%d", i), func(t *testing.T) {
+			red, _, _, _ := watermarked.At(test.x, test.y).RGBA()
+			if uint8(red>>8) != test.expectedRed {
+				t.Errorf("Red at %d,%d was %d, expected %d", test.x, test.y, red>>8, test.expectedRed)
+			}
+		})
+	}
+}
+
+func TestWatermarkMinOpacity(t *testing.T) {
+	watermark := &Watermark{Position: PositionBottomRight, Opacity: 0.5, MinOpacity: 0.25, Scale: 0.25}
+	tests := []struct {
+		opacity, expected float64
+	}{
+		{0, 0.25},
+		{0.1, 0.25},
+		{0.4, 0.4},
+		{1, 1},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("Opacity=%v", test.opacity), func(t *testing.T) {
+			opacity := test.opacity
+			if overridden := watermark.With(&WatermarkOptions{Opacity: &opacity}); overridden.Opacity != test.expected {
+				t.Errorf("Opacity was %v, expected %v", overridden.Opacity, test.expected)
+			}
+		})
+	}
+
+	invalid := &Watermark{Position: PositionBottomRight, Opacity: 0.5, MinOpacity: 0.75, Scale: 0.25}
+	if err := invalid.Validate(); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Validate returned %v, expected ErrInvalidOperation", err)
+	}
+}
+
+func TestTextOverlay(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 100, 40))
+	draw.Draw(black, black.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	text := []TextOverlay{{Text: "Hi", Color: "00ff00"}}
+	if err := ValidateTextOverlays(text); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	drawn, err := applyOverlays(black, Options{Text: text})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Only the top left corner, where the text is placed, should be green
+	greenPixels := map[bool]int{}
+	bounds := drawn.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			red, green, _, _ := drawn.At(x, y).RGBA()
+			if red != 0 {
+				t.Fatalf("Expected no red at %d,%d", x, y)
+			}
+			if green != 0 {
+				greenPixels[x < 30 && y < 25]++
+			}
+		}
+	}
+	if greenPixels[true] == 0 || greenPixels[false] != 0 {
+		t.Errorf("Expected the text only in the top left corner, found %v", greenPixels)
+	}
+}
+
+func TestHandlerAppliesOverlays(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	watermarkImage := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(watermarkImage, watermarkImage.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	handler := NewHandler(WithWatermark(&Watermark{Image: watermarkImage, Position: PositionBottomRight, Opacity: 1, Scale: 0.25}))
+	plain, err := Convert(testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	textBody, err := json.Marshal(imageRequest{Image: testImg, Text: []TextOverlay{{Text: "Sample"}}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tests := []struct {
+		query                string
+		contentType          string
+		body                 []byte
+		expectedResponseCode int
+	}{
+		{"", "image/jpeg", testImg, http.StatusOK},
+		{"?watermark_position=top-left&watermark_opacity=0.5&text=Sample&text_size=24", "image/jpeg", testImg, http.StatusOK},
+		{"", "application/json", textBody, http.StatusOK},
+		{"?watermark_opacity=2", "image/jpeg", testImg, http.StatusBadRequest},
+		{"?watermark_position=middle", "image/jpeg", testImg, http.StatusBadRequest},
+		{"?text=", "image/jpeg", testImg, http.StatusBadRequest},
+		{"?text=Sample&text_size=big", "image/jpeg", testImg, http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s %s=%d", test.contentType, test.query, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK && bytes.Equal(w.Body.Bytes(), plain) {
+				t.Error("Expected the overlays to change the image")
+			}
+		})
+	}
+}
+
+// featureImage is a flat gray image with a region drawn by the function.
+func featureImage(width int, height int, region image.Rectangle, feature func(x int, y int) color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			img.SetNRGBA(x, y, feature(x, y))
+		}
+	}
+	return img
+}
+
+func TestCropWindow(t *testing.T) {
+	checkerboard := func(x int, y int) color.NRGBA {
+		if (x/4+y/4)%2 == 0 {
+			return color.NRGBA{0, 0, 0, 255}
+		}
+		return color.NRGBA{255, 255, 255, 255}
+	}
+	skin := func(x int, y int) color.NRGBA {
+		return color.NRGBA{224, 172, 140, 255}
+	}
+
+	tests := []struct {
+		name         string
+		image        image.Image
+		options      CropOptions
+		expectedRect image.Rectangle
+	}{
+		{
+			"center",
+			featureImage(400, 200, image.Rect(300, 0, 400, 200), checkerboard),
+			CropOptions{Mode: CropCenter, Aspect: image.Pt(1, 1)},
+			image.Rect(100, 0, 300, 200),
+		},
+		{
+			"edges",
+			featureImage(400, 200, image.Rect(300, 0, 400, 200), checkerboard),
+			CropOptions{Mode: CropSmart, Aspect: image.Pt(1, 1)},
+			image.Rect(200, 0, 400, 200),
+		},
+		{
+			"skin",
+			featureImage(200, 400, image.Rect(0, 0, 200, 100), skin),
+			CropOptions{Mode: CropSmart, Aspect: image.Pt(2, 1)},
+			image.Rect(0, 0, 200, 100),
+		},
+		// Without any features the crop stays in the center
+		{
+			"flat",
+			featureImage(400, 200, image.Rectangle{}, nil),
+			CropOptions{Mode: CropSmart, Aspect: image.Pt(1, 1)},
+			image.Rect(100, 0, 300, 200),
+		},
+		{
+			"aspect",
+			featureImage(400, 200, image.Rectangle{}, nil),
+			CropOptions{Mode: CropCenter, Aspect: image.Pt(16, 9)},
+			image.Rect(22, 0, 377, 200),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rect := cropWindow(test.image, test.options)
+			if rect != test.expectedRect {
+				t.Errorf("Crop was %v, expected %v", rect, test.expectedRect)
+			}
+		})
+	}
+}
+
+func TestHandlerReportsCrop(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	tests := []struct {
+		query                string
+		expectedResponseCode int
+		expectedSize         image.Point
+	}{
+		{"?crop=smart", http.StatusOK, image.Pt(256, 256)},
+		{"?crop=center&aspect=2:1", http.StatusOK, image.Pt(256, 128)},
+		{"?crop=sideways", http.StatusBadRequest, image.Point{}},
+		{"?crop=smart&aspect=wide", http.StatusBadRequest, image.Point{}},
+		{"?aspect=1:1", http.StatusBadRequest, image.Point{}},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s=%d", test.query, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			HandleImageRequest(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var x, y, width, height int
+			if _, err := fmt.Sscanf(w.Header().Get(CropHeader), "%d,%d,%d,%d", &x, &y, &width, &height); err != nil {
+				t.Fatalf("Expected %s to hold the crop rectangle, was %q", CropHeader, w.Header().Get(CropHeader))
+			}
+			if width*test.expectedSize.Y != height*test.expectedSize.X {
+				t.Errorf("Crop of %dx%d didn't match the aspect ratio of %v", width, height, test.expectedSize)
+			}
+			config, err := png.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if config.Width != test.expectedSize.X || config.Height != test.expectedSize.Y {
+				t.Errorf("Size was %dx%d, expected %v", config.Width, config.Height, test.expectedSize)
+			}
+		})
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	solid := func(c color.NRGBA) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+		return img
+	}
+	split := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(split, image.Rect(0, 0, 6, 10), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(split, image.Rect(6, 0, 10, 10), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	transparent := solid(color.NRGBA{255, 255, 255, 255}).(*image.NRGBA)
+	transparent.SetNRGBA(0, 0, color.NRGBA{})
+
+	tests := []struct {
+		name             string
+		image            image.Image
+		expectedDC       string
+		expectedAnalysis Analysis
+	}{
+		{
+			"solid",
+			solid(color.NRGBA{255, 0, 0, 255}),
+			// The average color, 0xff0000, in base 83
+			"TI:j",
+			Analysis{
+				Width: 10, Height: 10,
+				DominantColor:    "#ff0000",
+				Palette:          []PaletteColor{{"#ff0000", 1}},
+				AverageLuminance: 0.213,
+			},
+		},
+		{
+			"split",
+			split,
+			"",
+			Analysis{
+				Width: 10, Height: 10,
+				// Matches the hash from github.com/buckket/go-blurhash
+				BlurHash:         "L~NMF@|TfQO0w$sRfQa~fQfQfQfQ",
+				DominantColor:    "#ff0000",
+				Palette:          []PaletteColor{{"#ff0000", 0.6}, {"#0000ff", 0.4}},
+				AverageLuminance: 0.156,
+			},
+		},
+		{
+			"transparent",
+			transparent,
+			"",
+			Analysis{
+				Width: 10, Height: 10,
+				DominantColor:    "#ffffff",
+				Palette:          []PaletteColor{{"#ffffff", 1}},
+				HasTransparency:  true,
+				AverageLuminance: 0.99,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			analysis := Analyze(test.image)
+			// 4x3 components are flagged with L, followed by the maximum AC
+			// value, the DC component and the 11 AC components
+			if len(analysis.BlurHash) != 28 || analysis.BlurHash[0] != 'L' {
+				t.Errorf("BlurHash %q was not a 4x3 hash", analysis.BlurHash)
+			}
+			if test.expectedDC != "" && analysis.BlurHash[2:6] != test.expectedDC {
+				t.Errorf("BlurHash %q had a DC component of %s, expected %s", analysis.BlurHash, analysis.BlurHash[2:6], test.expectedDC)
+			}
+			if test.expectedAnalysis.BlurHash == "" {
+				test.expectedAnalysis.BlurHash = analysis.BlurHash
+			}
+			if !reflect.DeepEqual(*analysis, test.expectedAnalysis) {
+				t.Errorf("Analysis was %+v, expected %+v", *analysis, test.expectedAnalysis)
+			}
+		})
+	}
+}
+
+func TestServeAnalyze(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	decoded, err := decode(testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tests := []struct {
+		method               string
+		body                 []byte
+		expectedResponseCode int
+	}{
+		{"POST", testImg, http.StatusOK},
+		{"POST", []byte("this is not an image"), http.StatusBadRequest},
+		{"GET", nil, http.StatusMethodNotAllowed},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s=%d", test.method, i), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost:8080/v2/image/analyze", bytes.NewReader(test.body))
+			w := httptest.NewRecorder()
+
+			defaultHandler.ServeAnalyze(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var analysis Analysis
+			if err := json.NewDecoder(w.Body).Decode(&analysis); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if analysis.Width != decoded.Bounds().Dx() || analysis.Height != decoded.Bounds().Dy() {
+				t.Errorf("Size was %dx%d, expected %v", analysis.Width, analysis.Height, decoded.Bounds().Size())
+			}
+			if analysis.HasTransparency || len(analysis.Palette) != paletteSize || analysis.DominantColor != analysis.Palette[0].Color {
+				t.Errorf("Unexpected analysis of a JPEG: %+v", analysis)
+			}
+		})
+	}
+}
+
+func TestHashes(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	decoded, err := decode(testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	original := ComputeHashes(decoded)
+
+	// The same photo resized and recompressed should hash nearby
+	resized := resizeImage(decoded)
+	recompressed := new(bytes.Buffer)
+	if err := jpeg.Encode(recompressed, resized, &jpeg.Options{Quality: 30}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	similar, err := decode(recompressed.Bytes())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// A different image should not
+	different, err := ApplyOperations(context.Background(), decoded, []Operation{{Op: OpFlip, Direction: "vertical"}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	similarHashes, differentHashes := ComputeHashes(similar), ComputeHashes(different)
+	for _, kind := range []string{HashAverage, HashDifference, HashPerceptual} {
+		hash, _ := original.Get(kind)
+		similarHash, _ := similarHashes.Get(kind)
+		differentHash, _ := differentHashes.Get(kind)
+		if distance := hash.Distance(similarHash); distance > 6 {
+			t.Errorf("%s distance of the resized image was %d, expected at most 6", kind, distance)
+		}
+		if distance := hash.Distance(differentHash); distance < 16 {
+			t.Errorf("%s distance of the flipped image was %d, expected at least 16", kind, distance)
+		}
+	}
+
+	encoded, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var roundTripped Hashes
+	if err := json.Unmarshal(encoded, &roundTripped); err != nil || roundTripped != original {
+		t.Errorf("Hashes %s did not round trip: %v", encoded, err)
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.ndjson")
+	index, err := OpenIndex(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	var records []Record
+	for i := 0; i < 500; i++ {
+		hash := Hash(random.Uint64())
+		// Cluster some records around earlier ones
+		if i > 0 && i%3 == 0 {
+			hash = records[random.Intn(len(records))].Hashes.PHash ^ Hash(1)<<uint(random.Intn(64))
+		}
+		record := Record{Key: fmt.Sprintf("%064x.jpeg", i), Hashes: Hashes{PHash: hash}, CreatedOn: time.Unix(int64(i), 0).UTC()}
+		records = append(records, record)
+		if err := index.Add(record); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	// Adding a key twice keeps the first record
+	if err := index.Add(records[0]); err != nil || index.Len() != len(records) {
+		t.Fatalf("Index held %d records after a duplicate add: %v", index.Len(), err)
+	}
+	// The same images uploaded by another owner are kept apart
+	for _, record := range records[:10] {
+		record.Owner = "key:other"
+		if err := index.Add(record); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if index.Len() != len(records)+10 {
+		t.Fatalf("Index held %d records, expected %d", index.Len(), len(records)+10)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reopened, err := OpenIndex(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != len(records)+10 {
+		t.Fatalf("Reopened index held %d records, expected %d", reopened.Len(), len(records)+10)
+	}
+	if matches := reopened.Search("key:other", HashPerceptual, Hashes{PHash: records[0].Hashes.PHash}, 64); len(matches) != 10 {
+		t.Errorf("Found %d of the other owner's records, expected 10", len(matches))
+	}
+
+	for _, maxDistance := range []int{0, 4, 24} {
+		query := Hashes{PHash: records[random.Intn(len(records))].Hashes.PHash}
+		var expected []string
+		for _, record := range records {
+			if record.Hashes.PHash.Distance(query.PHash) <= maxDistance {
+				expected = append(expected, record.Key)
+			}
+		}
+
+		matches := reopened.Search("", HashPerceptual, query, maxDistance)
+		var received []string
+		for i, match := range matches {
+			received = append(received, match.Key)
+			if i > 0 && match.Distance < matches[i-1].Distance {
+				t.Errorf("Matches were not sorted by distance: %v", matches)
+			}
+		}
+		sort.Strings(expected)
+		sort.Strings(received)
+		if !reflect.DeepEqual(received, expected) {
+			t.Errorf("Search within %d found %v, expected %v", maxDistance, received, expected)
+		}
+	}
+}
+
+func TestServeSimilar(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	index := NewIndex()
+	owner := func(r *http.Request) string { return r.Header.Get("X-Owner") }
+	handler := NewHandler(WithIndex(index), WithOwner(owner), WithStorage(store, "/v2/images/"))
+
+	upload := httptest.NewRequest("POST", "http://localhost:8080/v2/image", bytes.NewReader(testImg))
+	upload.Header.Set("X-Owner", "key:uploader")
+	uploaded := httptest.NewRecorder()
+	handler.ServeHTTP(uploaded, upload)
+	if uploaded.Code != http.StatusOK {
+		t.Fatalf("Upload status was %d: %s", uploaded.Code, uploaded.Body.String())
+	}
+	originalURL := "/v2/images/" + storage.ContentKey(testImg, ".jpeg")
+
+	tests := []struct {
+		method               string
+		query                string
+		owner                string
+		body                 []byte
+		expectedResponseCode int
+		expectedMatches      int
+	}{
+		{"POST", "", "key:uploader", testImg, http.StatusOK, 1},
+		{"POST", "?hash=dhash&distance=0", "key:uploader", testImg, http.StatusOK, 1},
+		// Other clients never find the upload
+		{"POST", "?distance=64", "key:other", testImg, http.StatusOK, 0},
+		{"POST", "?distance=64", "", testImg, http.StatusOK, 0},
+		{"POST", "?hash=nope", "key:uploader", testImg, http.StatusBadRequest, 0},
+		{"POST", "?distance=65", "key:uploader", testImg, http.StatusBadRequest, 0},
+		{"POST", "", "key:uploader", []byte("this is not an image"), http.StatusBadRequest, 0},
+		{"GET", "", "key:uploader", nil, http.StatusMethodNotAllowed, 0},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s%s=%d", test.method, test.query, i), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost:8080/v2/image/similar"+test.query, bytes.NewReader(test.body))
+			req.Header.Set("X-Owner", test.owner)
+			w := httptest.NewRecorder()
+
+			handler.ServeSimilar(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var response similarImages
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if len(response.Matches) != test.expectedMatches {
+				t.Fatalf("Received %d matches, expected %d", len(response.Matches), test.expectedMatches)
+			}
+			if test.expectedMatches == 0 {
+				return
+			}
+			if match := response.Matches[0]; match.Distance != 0 || match.URL != originalURL {
+				t.Errorf("Match was %+v, expected the upload at %s", match, originalURL)
+			}
+		})
+	}
+
+	t.Run("limited", func(t *testing.T) {
+		decoded, err := decode(testImg)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		hashes := ComputeHashes(decoded)
+		for i := 0; i < 2*MaxSimilarMatches; i++ {
+			index.Add(Record{Key: fmt.Sprintf("%064x.jpeg", i), Owner: "key:many", Hashes: hashes})
+		}
+		req := httptest.NewRequest("POST", "http://localhost:8080/v2/image/similar?distance=64", bytes.NewReader(testImg))
+		req.Header.Set("X-Owner", "key:many")
+		w := httptest.NewRecorder()
+		handler.ServeSimilar(w, req)
+		var response similarImages
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(response.Matches) != MaxSimilarMatches {
+			t.Errorf("Received %d matches, expected %d", len(response.Matches), MaxSimilarMatches)
+		}
+	})
+}
+
+// animatedGIF encodes a 400x200 animation of three frames: a red canvas, a
+// blue square disposed back to the background, then a green square.
+func animatedGIF(t *testing.T) []byte {
+	palette := color.Palette{color.Transparent, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 0, 255}}
+	background := image.NewPaletted(image.Rect(0, 0, 400, 200), palette)
+	for i := range background.Pix {
+		background.Pix[i] = 1
+	}
+	blue := image.NewPaletted(image.Rect(0, 0, 100, 100), palette)
+	for i := range blue.Pix {
+		blue.Pix[i] = 2
+	}
+	green := image.NewPaletted(image.Rect(200, 100, 300, 200), palette)
+	for i := range green.Pix {
+		green.Pix[i] = 3
+	}
+
+	encoded := new(bytes.Buffer)
+	err := gif.EncodeAll(encoded, &gif.GIF{
+		Image:     []*image.Paletted{background, blue, green},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{ColorModel: palette, Width: 400, Height: 200},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return encoded.Bytes()
+}
+
+func TestAnimatedReader(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	still := &bytes.Buffer{}
+	if err := gif.Encode(still, image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White}), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{"animated", animatedGIF(t), true},
+		{"still", still.Bytes(), false},
+		{"jpeg", testImg, false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if animated := AnimatedReader(bytes.NewReader(test.data)); animated != test.expected {
+				t.Errorf("Animated was %t, expected %t", animated, test.expected)
+			}
+			if Animated(test.data) != test.expected {
+				t.Errorf("Animated disagreed with AnimatedReader")
+			}
+		})
+	}
+}
+
+func TestConvertAnimatedGIF(t *testing.T) {
+	conversion, err := ConvertWithOptions(animatedGIF(t), Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if conversion.ContentType != "image/gif" {
+		t.Errorf("Content type was %s, expected image/gif", conversion.ContentType)
+	}
+
+	animation, err := gif.DecodeAll(bytes.NewReader(conversion.Data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if animation.Config.Width != 256 || animation.Config.Height != 128 {
+		t.Errorf("Size was %dx%d, expected 256x128", animation.Config.Width, animation.Config.Height)
+	}
+	if !reflect.DeepEqual(animation.Delay, []int{10, 20, 30}) ||
+		!reflect.DeepEqual(animation.Disposal, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone}) ||
+		animation.LoopCount != 3 {
+		t.Errorf("Timing was %v, %v, %d, expected it to be kept", animation.Delay, animation.Disposal, animation.LoopCount)
+	}
+	expectedRects := []image.Rectangle{image.Rect(0, 0, 256, 128), image.Rect(0, 0, 64, 64), image.Rect(128, 64, 192, 128)}
+	for i, frame := range animation.Image {
+		if frame.Rect != expectedRects[i] {
+			t.Errorf("Frame %d covered %v, expected %v", i, frame.Rect, expectedRects[i])
+		}
+	}
+
+	// The blue square is cleared before the green one is drawn
+	third := composeFrame(animation, 2)
+	for _, test := range []struct {
+		at       image.Point
+		expected color.RGBA
+	}{
+		{image.Pt(10, 10), color.RGBA{}},
+		{image.Pt(150, 100), color.RGBA{0, 255, 0, 255}},
+		{image.Pt(250, 10), color.RGBA{255, 0, 0, 255}},
+	} {
+		if c := color.RGBAModel.Convert(third.At(test.at.X, test.at.Y)); c != test.expected {
+			t.Errorf("Pixel at %v of the third frame was %v, expected %v", test.at, c, test.expected)
+		}
+	}
+
+	if _, err := ConvertWithOptions(animatedGIF(t), Options{Operations: []Operation{{Op: OpGrayscale}}}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected operations on an animation to be rejected, received %v", err)
+	}
+}
+
+func TestWatermarkAnimatedGIF(t *testing.T) {
+	white := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(white, white.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	watermark := &Watermark{Image: white, Position: PositionBottomRight, Opacity: 1, Scale: 0.25}
+
+	conversion, err := ConvertWithOptions(animatedGIF(t), Options{Watermark: watermark})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	animation, err := gif.DecodeAll(bytes.NewReader(conversion.Data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(animation.Image) != 3 || !reflect.DeepEqual(animation.Delay, []int{10, 20, 30}) || animation.LoopCount != 3 {
+		t.Fatalf("Expected the animation's frames and timing to be kept, but was %d frames, %v, %d", len(animation.Image), animation.Delay, animation.LoopCount)
+	}
+
+	// The 64x64 watermark sits 2 pixels from the bottom right corner of
+	// every frame, which are otherwise displayed as before
+	for i, expected := range []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {}} {
+		frame := composeFrame(animation, i)
+		if c := color.RGBAModel.Convert(frame.At(220, 100)); c != (color.RGBA{255, 255, 255, 255}) {
+			t.Errorf("Pixel under the watermark of frame %d was %v, expected white", i, c)
+		}
+		if c := color.RGBAModel.Convert(frame.At(10, 10)); c != expected {
+			t.Errorf("Pixel at (10, 10) of frame %d was %v, expected %v", i, c, expected)
+		}
+	}
+}
+
+func TestConvertGIFFrame(t *testing.T) {
+	frame := 1
+	conversion, err := ConvertWithOptions(animatedGIF(t), Options{Frame: &frame, Operations: []Operation{{Op: OpFlip, Direction: "horizontal"}}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(conversion.Data))
+	if err != nil {
+		t.Fatalf("Expected a PNG: %v", err)
+	}
+	// The blue square drawn over the red canvas, flipped to the right
+	if c := color.RGBAModel.Convert(decoded.At(250, 10)); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("Pixel was %v, expected blue", c)
+	}
+	if c := color.RGBAModel.Convert(decoded.At(10, 10)); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Pixel was %v, expected red", c)
+	}
+
+	frame = 3
+	if _, err := ConvertWithOptions(animatedGIF(t), Options{Frame: &frame}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected a missing frame to be rejected, received %v", err)
+	}
+}
+
+func TestGIFLimits(t *testing.T) {
+	encode := func(animation *gif.GIF) []byte {
+		encoded := new(bytes.Buffer)
+		if err := gif.EncodeAll(encoded, animation); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return encoded.Bytes()
+	}
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black})
+
+	tooManyFrames := &gif.GIF{}
+	for i := 0; i <= MaxGIFFrames; i++ {
+		tooManyFrames.Image = append(tooManyFrames.Image, frame)
+		tooManyFrames.Delay = append(tooManyFrames.Delay, 0)
+	}
+	tooManyPixels := &gif.GIF{
+		Image:  []*image.Paletted{frame},
+		Delay:  []int{0},
+		Config: image.Config{ColorModel: color.Palette{color.Black}, Width: 10000, Height: 10000},
+	}
+
+	for name, upload := range map[string][]byte{
+		"frames":    encode(tooManyFrames),
+		"pixels":    encode(tooManyPixels),
+		"truncated": animatedGIF(t)[:100],
+	} {
+		if _, err := Convert(upload); !errors.Is(err, ErrInvalidImage) {
+			t.Errorf("Expected the %s limit to reject the GIF, received %v", name, err)
+		}
+	}
+}
+
+func TestHandlerConvertsGIF(t *testing.T) {
+	tests := []struct {
+		query               string
+		expectedContentType string
+	}{
+		{"", "image/gif"},
+		{"?frame=2", "image/png"},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s=%d", test.query, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(animatedGIF(t)))
+			w := httptest.NewRecorder()
+
+			defaultHandler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != test.expectedContentType {
+				t.Errorf("Content type was %s, expected %s", contentType, test.expectedContentType)
+			}
+		})
+	}
+}
+
+// multipartUpload encodes the named files along with form fields
+// as a multipart/form-data body, returning it and its content type.
+func multipartUpload(t *testing.T, names []string, files [][]byte, fields url.Values) (*bytes.Buffer, string) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for name, values := range fields {
+		for _, value := range values {
+			writer.WriteField(name, value)
+		}
+	}
+	for i, name := range names {
+		part, err := writer.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		part.Write(files[i])
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func TestHandlerAcceptsMultipart(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	animation := animatedGIF(t)
+
+	t.Run("single", func(t *testing.T) {
+		body, contentType := multipartUpload(t, []string{"photo.jpeg"}, [][]byte{testImg}, url.Values{"op": {"rotate:90"}})
+		req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		defaultHandler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code to be %d, but was %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		config, err := png.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatalf("Expected a PNG: %v", err)
+		}
+		if config.Width != 172 || config.Height != 256 {
+			t.Errorf("Bounds differed. Received %d, %d. Expected 172, 256.", config.Width, config.Height)
+		}
+	})
+
+	names := []string{"photo.jpeg", "photo.jpg", "sticker.gif"}
+	files := [][]byte{testImg, testImg, animation}
+	expectedNames := []string{"photo.png", "photo-2.png", "sticker.gif"}
+
+	t.Run("zip", func(t *testing.T) {
+		body, contentType := multipartUpload(t, names, files, nil)
+		req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		defaultHandler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("Expected a ZIP, received %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var received []string
+		for _, entry := range archive.File {
+			received = append(received, entry.Name)
+		}
+		if !reflect.DeepEqual(received, expectedNames) {
+			t.Errorf("Archive held %v, expected %v", received, expectedNames)
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		body, contentType := multipartUpload(t, names, files, nil)
+		req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", body)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", "multipart/mixed")
+		w := httptest.NewRecorder()
+
+		defaultHandler.ServeHTTP(w, req)
+
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if w.Code != http.StatusOK || err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("Expected a multipart response, received %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		reader := multipart.NewReader(w.Body, params["boundary"])
+		for i, expectedType := range []string{"image/png", "image/png", "image/gif"} {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("Error reading part %d: %v", i, err)
+			}
+			if part.FileName() != expectedNames[i] || part.Header.Get("Content-Type") != expectedType {
+				t.Errorf("Part %d was %s of type %s, expected %s of type %s", i, part.FileName(), part.Header.Get("Content-Type"), expectedNames[i], expectedType)
+			}
+		}
+		if _, err := reader.NextPart(); err != io.EOF {
+			t.Errorf("Expected three parts, received %v", err)
+		}
+	})
+
+	tests := []struct {
+		name                 string
+		handler              *Handler
+		names                []string
+		files                [][]byte
+		expectedResponseCode int
+		expectedCode         string
+		expectedDetail       string
+	}{
+		{"file too large", NewHandler(WithMaxBodyBytes(int64(len(testImg)) + 1024)), []string{"small.gif", "large.jpeg"}, [][]byte{animation, append(testImg, make([]byte, 2048)...)}, http.StatusRequestEntityTooLarge, problem.CodeTooLarge, "large.jpeg"},
+		// Every file fits, but the upload as a whole doesn't
+		{"upload too large", NewHandler(WithMaxUploadBytes(int64(len(testImg)) + 1024)), []string{"first.jpeg", "second.jpeg"}, [][]byte{testImg, testImg}, http.StatusRequestEntityTooLarge, problem.CodeTooLarge, "multipart uploads"},
+		{"invalid image", defaultHandler, []string{"photo.jpeg", "notes.txt"}, [][]byte{testImg, []byte("this is not an image")}, http.StatusBadRequest, problem.CodeInvalidImage, "notes.txt"},
+		{"no files", defaultHandler, nil, nil, http.StatusBadRequest, problem.CodeInvalidInput, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, contentType := multipartUpload(t, test.names, test.files, nil)
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Accept", "application/problem+json")
+			w := httptest.NewRecorder()
+
+			test.handler.ServeHTTP(w, req)
+
+			var p problem.Problem
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if w.Code != test.expectedResponseCode || p.Code != test.expectedCode {
+				t.Errorf("Received %d %s, expected %d %s", w.Code, p.Code, test.expectedResponseCode, test.expectedCode)
+			}
+			if !strings.Contains(p.Detail, test.expectedDetail) {
+				t.Errorf("Detail %q did not include %q", p.Detail, test.expectedDetail)
+			}
+		})
+	}
+}
+
+// newImageServer serves the test image at /image.jpeg, along with routes
+// which misbehave.
+func newImageServer(t *testing.T) *httptest.Server {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	mux := http.NewServeMux()
+	serveImage := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(testImg)
+	}
+	mux.HandleFunc("/image.jpeg", serveImage)
+	mux.HandleFunc("/photos/beach.jpeg", serveImage)
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetch(t *testing.T) {
+	server := newImageServer(t)
+	serverURL, _ := url.Parse(server.URL)
+	localhostURL := "http://localhost:" + serverURL.Port()
+
+	tests := []struct {
+		name     string
+		config   FetchConfig
+		url      string
+		expected error
+	}{
+		{"fetched", FetchConfig{AllowPrivateNetworks: true}, server.URL + "/image.jpeg", nil},
+		{"redirected", FetchConfig{AllowPrivateNetworks: true, MaxRedirects: DefaultFetchMaxRedirects}, server.URL + "/redirect?to=/image.jpeg", nil},
+		{"redirects disabled", FetchConfig{AllowPrivateNetworks: true}, server.URL + "/redirect?to=/image.jpeg", ErrFetchFailed},
+		{"allowed", FetchConfig{AllowPrivateNetworks: true, AllowedHosts: []string{"127.0.0.1"}}, server.URL + "/image.jpeg", nil},
+		{"loopback", FetchConfig{}, server.URL + "/image.jpeg", ErrFetchBlocked},
+		{"resolved to loopback", FetchConfig{}, localhostURL + "/image.jpeg", ErrFetchBlocked},
+		{"not allowed", FetchConfig{AllowPrivateNetworks: true, AllowedHosts: []string{"*.example.com"}}, server.URL + "/image.jpeg", ErrFetchBlocked},
+		{"denied", FetchConfig{AllowPrivateNetworks: true, DeniedHosts: []string{"localhost"}}, localhostURL + "/image.jpeg", ErrFetchBlocked},
+		{"redirected to denied", FetchConfig{AllowPrivateNetworks: true, DeniedHosts: []string{"localhost"}, MaxRedirects: DefaultFetchMaxRedirects}, server.URL + "/redirect?to=" + url.QueryEscape(localhostURL+"/image.jpeg"), ErrFetchBlocked},
+		{"scheme", FetchConfig{AllowPrivateNetworks: true}, "file:///etc/passwd", ErrFetchBlocked},
+		{"credentials", FetchConfig{AllowPrivateNetworks: true}, "http://user:password@" + serverURL.Host + "/image.jpeg", ErrFetchBlocked},
+		{"redirect loop", FetchConfig{AllowPrivateNetworks: true, MaxRedirects: DefaultFetchMaxRedirects}, server.URL + "/loop", ErrFetchFailed},
+		{"not found", FetchConfig{AllowPrivateNetworks: true}, server.URL + "/missing.jpeg", ErrFetchFailed},
+		{"timeout", FetchConfig{AllowPrivateNetworks: true, Timeout: 50 * time.Millisecond}, server.URL + "/slow", ErrFetchFailed},
+		{"too large", FetchConfig{AllowPrivateNetworks: true, MaxBytes: 1024}, server.URL + "/image.jpeg", ErrFetchTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetched, err := NewFetcher(test.config).Fetch(context.Background(), test.url)
+			if test.expected == nil {
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				if _, err := decode(fetched); err != nil {
+					t.Errorf("Fetched an invalid image: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.expected) {
+				t.Errorf("Expected %v, received %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestHandlerFetchesURL(t *testing.T) {
+	server := newImageServer(t)
+	fetching := NewHandler(WithFetcher(NewFetcher(FetchConfig{AllowPrivateNetworks: true})))
+	blocking := NewHandler(WithFetcher(NewFetcher(FetchConfig{})))
+
+	tests := []struct {
+		name                 string
+		handler              *Handler
+		body                 string
+		expectedResponseCode int
+	}{
+		{"fetched", fetching, `{"url": "` + server.URL + `/photos/beach.jpeg?size=large", "operations": [{"op": "rotate", "angle": 90}]}`, http.StatusOK},
+		{"blocked", blocking, `{"url": "` + server.URL + `/image.jpeg"}`, http.StatusForbidden},
+		{"failed", fetching, `{"url": "` + server.URL + `/missing.jpeg"}`, http.StatusBadGateway},
+		{"both", fetching, `{"url": "` + server.URL + `/image.jpeg", "image": "aGVsbG8="}`, http.StatusBadRequest},
+		{"disabled", defaultHandler, `{"url": "` + server.URL + `/image.jpeg"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			test.handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			config, err := png.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatalf("Expected a PNG: %v", err)
+			}
+			if config.Width != 172 || config.Height != 256 {
+				t.Errorf("Bounds differed. Received %d, %d. Expected 172, 256.", config.Width, config.Height)
+			}
+			// The image is named after the end of the URL
+			if disposition := w.Result().Header.Get("Content-Disposition"); disposition != `inline; filename=beach.png` {
+				t.Errorf("Expected the image to be named beach.png, but was %q", disposition)
+			}
+		})
+	}
+}
+
+// adobeRGBProfile builds a profile for Adobe RGB (1998), whose primaries
+// are wider than sRGB's.
+func adobeRGBProfile() []byte {
+	gamma := tagData("curv", []byte{0, 0, 0, 1, 0x02, 0x33})
+	return buildProfile("mntr", "RGB ", []profileTag{
+		{"desc", mlucTag("Adobe RGB (1998)")},
+		{"rXYZ", tagData("XYZ ", s15Fixed16Bytes(0.6097559, 0.3111242, 0.0194811))},
+		{"gXYZ", tagData("XYZ ", s15Fixed16Bytes(0.2052401, 0.6256560, 0.0608902))},
+		{"bXYZ", tagData("XYZ ", s15Fixed16Bytes(0.1492240, 0.0632197, 0.7448387))},
+		{"rTRC", gamma},
+		{"gTRC", gamma},
+		{"bTRC", gamma},
+	})
+}
+
+// cmykProfile builds a CMYK profile whose lookup table maps each corner of
+// the CMYK cube to a Lab color, white without ink and black with full K.
+func cmykProfile() []byte {
+	lab := func(l float64, a float64, b float64) []byte {
+		// Version 2 lookup tables encode L=100 as 0xff00 and a=0 as 0x8000
+		var encoded []byte
+		for _, value := range []float64{l * 0xff00 / 100, (a + 128) * 256, (b + 128) * 256} {
+			encoded = append(encoded, byte(uint16(value)>>8), byte(uint16(value)))
+		}
+		return encoded
+	}
+	table := []byte{4, 3, 2, 0}
+	table = append(table, s15Fixed16Bytes(1, 0, 0, 0, 1, 0, 0, 0, 1)...)
+	table = append(table, 0, 2, 0, 2)
+	for i := 0; i < 4; i++ {
+		table = append(table, 0, 0, 0xff, 0xff)
+	}
+	for corner := 0; corner < 16; corner++ {
+		switch {
+		case corner&1 != 0:
+			table = append(table, lab(0, 0, 0)...)
+		case corner == 8:
+			table = append(table, lab(62, -40, -45)...)
+		case corner == 0:
+			table = append(table, lab(100, 0, 0)...)
+		default:
+			table = append(table, lab(30, 0, 0)...)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		table = append(table, 0, 0, 0xff, 0xff)
+	}
+	profile := buildProfile("prtr", "CMYK", []profileTag{
+		{"desc", mlucTag("Test CMYK")},
+		{"A2B0", tagData("mft2", table)},
+	})
+	copy(profile[20:], "Lab ")
+	return profile
+}
+
+// withProfile embeds the profile in a JPEG, in APP2 segments of at most
+// chunkSize bytes after the SOI marker.
+func withProfile(upload []byte, profile []byte, chunkSize int) []byte {
+	var chunks [][]byte
+	for len(profile) > 0 {
+		size := chunkSize
+		if size > len(profile) {
+			size = len(profile)
+		}
+		chunks = append(chunks, profile[:size])
+		profile = profile[size:]
+	}
+	result := append([]byte{}, upload[:2]...)
+	for i, chunk := range chunks {
+		length := 2 + len(iccMarker) + 2 + len(chunk)
+		result = append(result, 0xff, 0xe2, byte(length>>8), byte(length))
+		result = append(result, iccMarker...)
+		result = append(result, byte(i+1), byte(len(chunks)))
+		result = append(result, chunk...)
+	}
+	return append(result, upload[2:]...)
+}
+
+func TestProfileTransforms(t *testing.T) {
+	rgb, gray := srgbProfiles()
+	toSRGBColor := func(t *testing.T, data []byte, device ...float64) [3]int {
+		profile, err := ParseProfile(data)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		toPCS, err := profile.transform()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		xyz := toPCS(device)
+		var result [3]int
+		for i, row := range xyzToLinearSRGB {
+			result[i] = int(encodeSRGB(row[0]*xyz[0] + row[1]*xyz[1] + row[2]*xyz[2]))
+		}
+		return result
+	}
+	near := func(a [3]int, b [3]int) bool {
+		for i := range a {
+			if a[i]-b[i] > 1 || b[i]-a[i] > 1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	t.Run("sRGB", func(t *testing.T) {
+		for _, c := range [][3]int{{0, 0, 0}, {255, 255, 255}, {200, 30, 90}, {12, 180, 250}} {
+			result := toSRGBColor(t, rgb, float64(c[0])/255, float64(c[1])/255, float64(c[2])/255)
+			if !near(result, c) {
+				t.Errorf("Expected %v to convert to itself, but was %v", c, result)
+			}
+		}
+		if result := toSRGBColor(t, gray, 100.0/255); !near(result, [3]int{100, 100, 100}) {
+			t.Errorf("Expected gray 100 to stay gray, but was %v", result)
+		}
+	})
+
+	t.Run("Adobe RGB", func(t *testing.T) {
+		if result := toSRGBColor(t, adobeRGBProfile(), 0.5, 0.5, 0.5); result[0] != result[1] || result[1] != result[2] {
+			t.Errorf("Expected gray to stay gray, but was %v", result)
+		}
+		// Adobe RGB greens are more saturated than the same values in sRGB
+		result := toSRGBColor(t, adobeRGBProfile(), 0.25, 0.6, 0.25)
+		if result[1]-result[0] <= 90 || result[0] > 64 {
+			t.Errorf("Expected a more saturated green than (64, 153, 64), but was %v", result)
+		}
+	})
+
+	t.Run("CMYK", func(t *testing.T) {
+		for _, test := range []struct {
+			device   []float64
+			expected [3]int
+		}{
+			{[]float64{0, 0, 0, 0}, [3]int{255, 255, 255}},
+			{[]float64{0, 0, 0, 1}, [3]int{0, 0, 0}},
+			{[]float64{1, 1, 1, 1}, [3]int{0, 0, 0}},
+		} {
+			if result := toSRGBColor(t, cmykProfile(), test.device...); !near(result, test.expected) {
+				t.Errorf("Expected %v to convert to %v, but was %v", test.device, test.expected, result)
+			}
+		}
+		cyan := toSRGBColor(t, cmykProfile(), 1, 0, 0, 0)
+		if cyan[0] > 50 || cyan[2] < 150 {
+			t.Errorf("Expected cyan, but was %v", cyan)
+		}
+	})
+}
+
+func TestMalformedProfiles(t *testing.T) {
+	// lut8 tables hold a matrix, then 256 entry input and output curves
+	lut8 := func(inputs int, gridPoints int, size int) []byte {
+		return tagData("mft1", []byte{byte(inputs), 3, byte(gridPoints), 0}, make([]byte, 36+size))
+	}
+	clutAToB := func(inputs int, gridPoints int) []byte {
+		// The lookup table follows the 32 byte header, with no curves
+		table := []byte{byte(inputs), 3, 0, 0}
+		table = append(table, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0, 0, 0)
+		grid := make([]byte, 20)
+		for i := 0; i < inputs; i++ {
+			grid[i] = byte(gridPoints)
+		}
+		grid[16] = 2
+		return tagData("mAB ", table, grid, make([]byte, 1024))
+	}
+
+	for _, test := range []struct {
+		name  string
+		space string
+		table []byte
+	}{
+		{"more inputs than channels", "RGB ", lut8(5, 2, 5*256+32*3+3*256)},
+		{"fewer inputs than channels", "CMYK", lut8(3, 2, 3*256+8*3+3*256)},
+		{"grid overflowing", "RGB ", lut8(9, 128, 4096)},
+		{"grid beyond the limit", "CMYK", lut8(4, 255, 4096)},
+		{"lutAToB with more inputs than channels", "GRAY", clutAToB(3, 2)},
+		{"lutAToB grid beyond the limit", "CMYK", clutAToB(4, 255)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := buildProfile("mntr", test.space, []profileTag{{"A2B0", test.table}})
+			profile, err := ParseProfile(data)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if _, err := profile.transform(); !errors.Is(err, errUnsupportedProfile) {
+				t.Errorf("Expected the lookup table to be unsupported, but was %v", err)
+			}
+		})
+	}
+
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	if _, err := decode(withProfile(testImg, buildProfile("mntr", "RGB ", []profileTag{{"A2B0", lut8(5, 2, 5*256+32*3+3*256)}}), 60000)); err != nil {
+		t.Errorf("Expected an image with an unsupported profile to be decoded as is, but was %v", err)
+	}
+}
+
+func FuzzProfileTransform(f *testing.F) {
+	rgb, gray := srgbProfiles()
+	for _, seed := range [][]byte{rgb, gray, adobeRGBProfile(), cmykProfile()} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		profile, err := ParseProfile(data)
+		if err != nil {
+			return
+		}
+		toPCS, err := profile.transform()
+		if err != nil {
+			return
+		}
+		device := make([]float64, profile.channels())
+		for _, value := range []float64{0, 0.5, 1} {
+			for i := range device {
+				device[i] = value
+			}
+			toPCS(device)
+		}
+	})
+}
+
+func TestDecodeConvertsProfiles(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	plain, err := decode(testImg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tagged := withProfile(testImg, adobeRGBProfile(), 200)
+	if !bytes.Equal(jpegProfile(tagged), adobeRGBProfile()) {
+		t.Fatal("Expected the profile split over APP2 segments to be joined")
+	}
+	converted, err := decode(tagged)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if converted.Bounds() != plain.Bounds() {
+		t.Fatalf("Expected bounds %v, but was %v", plain.Bounds(), converted.Bounds())
+	}
+	if reflect.DeepEqual(converted, plain) {
+		t.Error("Expected an Adobe RGB image to be converted")
+	}
+
+	srgb, _ := srgbProfiles()
+	unchanged, err := decode(withProfile(testImg, srgb, 60000))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(unchanged, plain) {
+		t.Error("Expected an sRGB image to be left as is")
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/v2/image/analyze", bytes.NewReader(tagged))
+	w := httptest.NewRecorder()
+	defaultHandler.ServeAnalyze(w, req)
+	var analysis Analysis
+	if err := json.NewDecoder(w.Body).Decode(&analysis); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if analysis.ColorSpace != ColorSpaceRGB || analysis.ColorProfile != "Adobe RGB (1998)" {
+		t.Errorf("Expected an RGB image with an Adobe RGB profile, but was %q and %q", analysis.ColorSpace, analysis.ColorProfile)
+	}
+}
+
+func TestEmbedProfile(t *testing.T) {
+	embedded := func(t *testing.T, data []byte) *Profile {
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("Expected a valid PNG: %v", err)
+		}
+		start := bytes.Index(data, []byte("iCCP"))
+		if start != 8+4+4+13+4+4 {
+			t.Fatalf("Expected an iCCP chunk after IHDR, but found it at %d", start)
+		}
+		length := int(data[start-4])<<24 | int(data[start-3])<<16 | int(data[start-2])<<8 | int(data[start-1])
+		chunk := data[start+4 : start+4+length]
+		name := chunk[:bytes.IndexByte(chunk, 0)]
+		reader, err := zlib.NewReader(bytes.NewReader(chunk[len(name)+2:]))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		profile, err := ParseProfile(decompressed)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return profile
+	}
+
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	conversion, err := ConvertWithOptions(testImg, Options{EmbedProfile: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if profile := embedded(t, conversion.Data); profile.ColorSpace != ColorSpaceRGB || profile.Description != "sRGB IEC61966-2.1" {
+		t.Errorf("Expected an sRGB profile, but was %+v", profile)
+	}
+
+	grayPNG := new(bytes.Buffer)
+	if err := png.Encode(grayPNG, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := embedProfile(grayPNG.Bytes())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if profile := embedded(t, data); profile.ColorSpace != ColorSpaceGray {
+		t.Errorf("Expected a gray profile, but was %+v", profile)
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	// A noisy gradient, with more colors than fit in a palette
+	random := rand.New(rand.NewSource(1))
+	photo := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			noise := uint8(random.Intn(16))
+			photo.SetNRGBA(x, y, color.NRGBA{uint8(x*3) + noise, uint8(y*3) + noise, uint8(255-x*3) - noise, 255})
+		}
+	}
+	gray := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(gray.Pix); i += 4 {
+		value := uint8(random.Intn(256))
+		gray.Pix[i], gray.Pix[i+1], gray.Pix[i+2], gray.Pix[i+3] = value, value, value, 255
+	}
+	// Few colors, scattered so they don't compress well in full color
+	few := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(few.Pix); i += 4 {
+		few.Pix[i], few.Pix[i+1], few.Pix[i+2], few.Pix[i+3] = uint8(random.Intn(4)*80), uint8(random.Intn(4)*80), 40, 255
+	}
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		options       PNGOptions
+		expectedModel color.Model
+		maxColors     int
+	}{
+		{"full color", photo, PNGOptions{}, color.RGBAModel, 0},
+		{"gray", gray, PNGOptions{}, color.GrayModel, 0},
+		{"few colors", few, PNGOptions{}, nil, 16},
+		{"median cut", photo, PNGOptions{Quantize: QuantizeMedianCut, Colors: 32}, nil, 32},
+		{"octree", photo, PNGOptions{Quantize: QuantizeOctree, Colors: 32}, nil, 32},
+		{"dithered", photo, PNGOptions{Quantize: QuantizeMedianCut, Colors: 32, Dither: true}, nil, 32},
+		{"best compression", photo, PNGOptions{Compression: png.BestCompression}, color.RGBAModel, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, unoptimized, err := encodePNG(test.img, test.options)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if test.maxColors > 0 {
+				paletted, ok := decoded.(*image.Paletted)
+				if !ok || len(paletted.Palette) > test.maxColors {
+					t.Fatalf("Expected a palette of at most %d colors, but was %T", test.maxColors, decoded)
+				}
+			} else if decoded.ColorModel() != test.expectedModel {
+				t.Errorf("Expected %T to have been encoded", decoded)
+			}
+			if len(data) > unoptimized {
+				t.Errorf("Expected at most %d bytes, but was %d", unoptimized, len(data))
+			}
+
+			// Only quantizing loses anything
+			if test.options.Quantize == "" {
+				if !bytes.Equal(toNRGBA(decoded).Pix, toNRGBA(test.img).Pix) {
+					t.Error("Expected the pixels to be unchanged")
+				}
+				return
+			}
+			// Quantized colors should stay close to the originals on average
+			original, quantized := toNRGBA(test.img), toNRGBA(decoded)
+			var difference int
+			for i := range original.Pix {
+				d := int(original.Pix[i]) - int(quantized.Pix[i])
+				difference += d * d
+			}
+			if mean := difference / len(original.Pix); mean > 200 {
+				t.Errorf("Expected the quantized image to be close to the original, mean squared error was %d", mean)
+			}
+		})
+	}
+}
+
+func TestParsePNGOptions(t *testing.T) {
+	tests := []struct {
+		compression string
+		quantize    string
+		colors      int
+		dither      bool
+		expected    PNGOptions
+		valid       bool
+	}{
+		{"", "", 0, false, PNGOptions{Colors: MaxPaletteColors}, true},
+		{"best", "octree", 32, true, PNGOptions{Compression: png.BestCompression, Quantize: QuantizeOctree, Colors: 32, Dither: true}, true},
+		{"none", "median-cut", 0, false, PNGOptions{Compression: png.NoCompression, Quantize: QuantizeMedianCut, Colors: MaxPaletteColors}, true},
+		{"maximum", "", 0, false, PNGOptions{}, false},
+		{"", "kmeans", 0, false, PNGOptions{}, false},
+		{"", "octree", 1, false, PNGOptions{}, false},
+		{"", "octree", 257, false, PNGOptions{}, false},
+		{"", "", 16, false, PNGOptions{}, false},
+		{"", "", 0, true, PNGOptions{}, false},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			options, err := ParsePNGOptions(test.compression, test.quantize, test.colors, test.dither)
+			if (err == nil) != test.valid {
+				t.Fatalf("Expected valid to be %t, but error was %v", test.valid, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidOperation) {
+				t.Errorf("Expected %v to wrap ErrInvalidOperation", err)
+			}
+			if options != test.expected {
+				t.Errorf("Expected %+v, but was %+v", test.expected, options)
+			}
+		})
+	}
+}
+
+func TestHandlerReportsSavings(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	tests := []struct {
+		query                string
+		expectedResponseCode int
+		expectSavings        bool
+	}{
+		{"", http.StatusOK, false},
+		{"?quantize=octree&colors=64&dither=true", http.StatusOK, true},
+		{"?quantize=median-cut&compression=best", http.StatusOK, true},
+		{"?op=grayscale", http.StatusOK, true},
+		{"?quantize=octree&colors=many", http.StatusBadRequest, false},
+		{"?compression=smallest", http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			defaultHandler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var saved int
+			var percent float64
+			if _, err := fmt.Sscanf(w.Header().Get(SavingsHeader), "%d bytes (%f%%)", &saved, &percent); err != nil {
+				t.Fatalf("Expected %s to report the savings, was %q", SavingsHeader, w.Header().Get(SavingsHeader))
+			}
+			if (saved > 0) != test.expectSavings || percent < 0 || percent >= 100 {
+				t.Errorf("Unexpected savings of %d bytes (%.1f%%)", saved, percent)
+			}
+		})
+	}
+}
+
+func TestEncodeInterlaced(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 13, 9))
+	paletted := image.NewPaletted(image.Rect(0, 0, 10, 3), color.Palette{color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 128}, color.NRGBA{}})
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 5, 17))
+	for i := range transparent.Pix {
+		transparent.Pix[i] = uint8(i * 13)
+	}
+
+	for name, img := range map[string]image.Image{
+		"gray":        gray,
+		"paletted":    paletted,
+		"rgb":         goldenSource(),
+		"transparent": transparent,
+		"one pixel":   image.NewGray(image.Rect(0, 0, 1, 1)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			encoded := new(bytes.Buffer)
+			if err := encodeInterlaced(encoded, img, png.BestCompression); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			// The interlace method is the last byte of the IHDR chunk
+			if encoded.Bytes()[pngHeaderSize-5] != 1 {
+				t.Error("Expected an interlaced PNG")
+			}
+			decoded, err := png.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if decoded.Bounds() != img.Bounds() {
+				t.Fatalf("Expected bounds %v, but was %v", img.Bounds(), decoded.Bounds())
+			}
+			if !bytes.Equal(toNRGBA(decoded).Pix, toNRGBA(img).Pix) {
+				t.Error("Pixels differ from the original")
+			}
+		})
+	}
+}
+
+func TestHandlerOutputFormats(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	tests := []struct {
+		query                string
+		body                 []byte
+		expectedResponseCode int
+		expectedContentType  string
+	}{
+		{"?format=jpeg", testImg, http.StatusOK, "image/jpeg"},
+		{"?format=jpeg&quality=40&embed_icc=true", testImg, http.StatusOK, "image/jpeg"},
+		{"?format=png&progressive=true", testImg, http.StatusOK, "image/png"},
+		{"?progressive=true&quantize=octree&embed_icc=true", testImg, http.StatusOK, "image/png"},
+		{"?format=jpeg&progressive=true", testImg, http.StatusBadRequest, ""},
+		{"?format=jpeg&quantize=octree", testImg, http.StatusBadRequest, ""},
+		{"?format=jpeg&quality=101", testImg, http.StatusBadRequest, ""},
+		{"?quality=80", testImg, http.StatusBadRequest, ""},
+		{"?format=webp", testImg, http.StatusBadRequest, ""},
+		{"?format=jpeg", animatedGIF(t), http.StatusBadRequest, ""},
+		{"?format=jpeg&frame=1", animatedGIF(t), http.StatusOK, "image/jpeg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/v2/image"+test.query, bytes.NewReader(test.body))
+			w := httptest.NewRecorder()
+
+			defaultHandler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if contentType := http.DetectContentType(w.Body.Bytes()); contentType != test.expectedContentType {
+				t.Fatalf("Expected %s, but was %s", test.expectedContentType, contentType)
+			}
+			decoded, _, err := image.Decode(bytes.NewReader(w.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if size := decoded.Bounds().Size(); size.X > 256 || size.Y > 256 {
+				t.Errorf("Expected the image to fit within 256x256, but was %v", size)
+			}
+			if strings.Contains(test.query, "embed_icc") && test.expectedContentType == "image/jpeg" {
+				if _, err := ParseProfile(jpegProfile(w.Body.Bytes())); err != nil {
+					t.Errorf("Expected an embedded profile: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerResponseHeaders(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	original, err := jpeg.DecodeConfig(bytes.NewReader(testImg))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	form, formContentType := multipartUpload(t, []string{"holiday photo.jpeg"}, [][]byte{testImg}, url.Values{"format": {"jpeg"}})
+	animation := animatedGIF(t)
+
+	tests := []struct {
+		name                string
+		request             *http.Request
+		expectedContentType string
+		expectedFilename    string
+		originalWidth       int
+		originalHeight      int
+	}{
+		{"raw", httptest.NewRequest("POST", "http://localhost:8080/v2/image", bytes.NewReader(testImg)), "image/png", "image.png", original.Width, original.Height},
+		{"rotated", httptest.NewRequest("POST", "http://localhost:8080/v2/image?op=rotate:90", bytes.NewReader(testImg)), "image/png", "image.png", original.Width, original.Height},
+		{"multipart", httptest.NewRequest("POST", "http://localhost:8080/v2/image", form), "image/jpeg", "holiday photo.jpeg", original.Width, original.Height},
+		{"animated", httptest.NewRequest("POST", "http://localhost:8080/v2/image", bytes.NewReader(animation)), "image/gif", "image.gif", 400, 200},
+	}
+	tests[2].request.Header.Set("Content-Type", formContentType)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			defaultHandler.ServeHTTP(w, test.request)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			decoded, _, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			expected := map[string]string{
+				"Content-Type":        test.expectedContentType,
+				"Content-Length":      strconv.Itoa(w.Body.Len()),
+				"Content-Disposition": mime.FormatMediaType("inline", map[string]string{"filename": test.expectedFilename}),
+				WidthHeader:           strconv.Itoa(decoded.Width),
+				HeightHeader:          strconv.Itoa(decoded.Height),
+				OriginalWidthHeader:   strconv.Itoa(test.originalWidth),
+				OriginalHeightHeader:  strconv.Itoa(test.originalHeight),
+			}
+			// The recorder's result only has the headers set before the
+			// status was written, like a real response
+			header := w.Result().Header
+			for key, value := range expected {
+				if actual := header.Get(key); actual != value {
+					t.Errorf("Expected %s to be %q, but was %q", key, value, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSigner(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, MinSigningKeyBytes), bytes.Repeat([]byte{2}, MinSigningKeyBytes)
+	oldSigner, err := NewSigner(oldKey)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Rotated, signing with the new key while still accepting the old
+	signer, err := NewSigner(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	newOnly, err := NewSigner(newKey)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	sign := func(signer *Signer, rawURL string, expires time.Time) string {
+		signed, err := signer.Sign(rawURL, expires)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return signed
+	}
+	signed := sign(signer, "/v2/image/signed?key=abc.jpeg&op=rotate:90&op=grayscale", time.Time{})
+
+	tests := []struct {
+		name          string
+		signer        *Signer
+		url           string
+		expectedError error
+	}{
+		{"signed", signer, signed, nil},
+		{"reordered", signer, strings.Replace(signed, "key=abc.jpeg&", "", 1) + "&key=abc.jpeg", nil},
+		{"old key", signer, sign(oldSigner, "/v2/image/signed?key=abc.jpeg", time.Time{}), nil},
+		{"removed key", newOnly, sign(oldSigner, "/v2/image/signed?key=abc.jpeg", time.Time{}), ErrInvalidSignature},
+		{"unexpired", signer, sign(signer, "/v2/image/signed?key=abc.jpeg", now.Add(time.Minute)), nil},
+		{"expired", signer, sign(signer, "/v2/image/signed?key=abc.jpeg", now.Add(-time.Minute)), ErrExpiredSignature},
+		{"extended", signer, strings.Replace(sign(signer, "/v2/image/signed?key=abc.jpeg", now.Add(-time.Minute)), "expires=1699", "expires=1799", 1), ErrInvalidSignature},
+		{"tampered", signer, strings.Replace(signed, "grayscale", "blur:5", 1), ErrInvalidSignature},
+		{"ops reordered", signer, strings.NewReplacer("rotate%3A90", "grayscale", "grayscale", "rotate%3A90").Replace(signed), ErrInvalidSignature},
+		{"other path", signer, strings.Replace(signed, "/v2/image/signed", "/v2/image/other", 1), ErrInvalidSignature},
+		{"unsigned", signer, "/v2/image/signed?key=abc.jpeg", ErrInvalidSignature},
+		{"malformed", signer, "/v2/image/signed?key=abc.jpeg&signature=not+base64", ErrInvalidSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			err = test.signer.Verify(parsed, now)
+			if !errors.Is(err, test.expectedError) || (test.expectedError == nil) != (err == nil) {
+				t.Errorf("Expected %v, but was %v", test.expectedError, err)
+			}
+		})
+	}
+
+	if _, err := NewSigner([]byte("short")); err == nil {
+		t.Error("Expected short keys to be rejected")
+	}
+	keys, err := ParseSigningKeys(" 0102 , ff")
+	if err != nil || !reflect.DeepEqual(keys, [][]byte{{1, 2}, {0xff}}) {
+		t.Errorf("Expected the keys to be parsed, but were %v: %v", keys, err)
+	}
+	if _, err := ParseSigningKeys("xyz"); err == nil {
+		t.Error("Expected keys which aren't hex to be rejected")
+	}
+}
+
+func TestHandlerServesSigned(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	key := storage.ContentKey(testImg, ".jpeg")
+	if err := store.Put(context.Background(), key, testImg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	server := newImageServer(t)
+	signer, err := NewSigner(bytes.Repeat([]byte{1}, MinSigningKeyBytes))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	handler := NewHandler(WithStorage(store, "/v2/images/"), WithFetcher(NewFetcher(FetchConfig{AllowPrivateNetworks: true})), WithSigner(signer))
+
+	sign := func(query string, expires time.Time) string {
+		signed, err := signer.Sign("/v2/image/signed?"+query, expires)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name                 string
+		method               string
+		url                  string
+		expectedResponseCode int
+		expectedContentType  string
+	}{
+		{"stored", "GET", sign("key="+key+"&op=rotate:90", time.Time{}), http.StatusOK, "image/png"},
+		{"fetched", "GET", sign("url="+url.QueryEscape(server.URL+"/photos/beach.jpeg")+"&format=jpeg", time.Now().Add(time.Hour)), http.StatusOK, "image/jpeg"},
+		{"head", "HEAD", sign("key="+key, time.Time{}), http.StatusOK, "image/png"},
+		{"unsigned", "GET", "/v2/image/signed?key=" + key, http.StatusForbidden, ""},
+		{"tampered", "GET", strings.Replace(sign("key="+key+"&op=grayscale", time.Time{}), "grayscale", "blur%3A5", 1), http.StatusForbidden, ""},
+		{"expired", "GET", sign("key="+key, time.Now().Add(-time.Hour)), http.StatusForbidden, ""},
+		{"missing", "GET", sign("key="+storage.ContentKey([]byte("other"), ".jpeg"), time.Time{}), http.StatusNotFound, ""},
+		{"no image", "GET", sign("op=grayscale", time.Time{}), http.StatusBadRequest, ""},
+		{"invalid", "GET", sign("key="+key+"&op=rotate:45", time.Time{}), http.StatusBadRequest, ""},
+		{"post", "POST", sign("key="+key, time.Time{}), http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost:8080"+test.url, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeSigned(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != test.expectedContentType {
+				t.Errorf("Expected %s, but was %s", test.expectedContentType, contentType)
+			}
+			if !strings.HasPrefix(w.Header().Get("Cache-Control"), "public, max-age=") {
+				t.Errorf("Expected the image to be cacheable, but Cache-Control was %q", w.Header().Get("Cache-Control"))
+			}
+			if test.method == "GET" {
+				if _, _, err := image.Decode(bytes.NewReader(w.Body.Bytes())); err != nil {
+					t.Errorf("Error: %v", err)
+				}
+			}
+		})
+	}
+
+	// Stored images over the size limit are refused rather than truncated
+	limited := NewHandler(WithStorage(store, "/v2/images/"), WithSigner(signer), WithMaxBodyBytes(int64(len(testImg))-1))
+	w := httptest.NewRecorder()
+	limited.ServeSigned(w, httptest.NewRequest("GET", "http://localhost:8080"+sign("key="+key, time.Time{}), nil))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code to be %d, but was %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerStreams(t *testing.T) {
+	testImg, err := os.ReadFile("./test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	server := httptest.NewServer(NewHandler(WithStorage(store, "/v2/images/")))
+	defer server.Close()
+
+	tests := []struct {
+		query                string
+		expectedResponseCode int
+		expectedContentType  string
+	}{
+		{"?stream=true", http.StatusOK, "image/png"},
+		{"?stream=true&format=jpeg", http.StatusOK, "image/jpeg"},
+		{"?stream=true&progressive=true&embed_icc=true", http.StatusOK, "image/png"},
+		{"?stream=true&op=rotate&angle=45", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			resp, err := http.Post(server.URL+"/v2/image"+test.query, "image/jpeg", bytes.NewReader(testImg))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			if resp.StatusCode != test.expectedResponseCode {
+				t.Fatalf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, resp.StatusCode, body)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if resp.ContentLength != -1 || resp.Header.Get("Content-Type") != test.expectedContentType {
+				t.Errorf("Expected a streamed %s, but was %d bytes of %s", test.expectedContentType, resp.ContentLength, resp.Header.Get("Content-Type"))
+			}
+			if _, _, err := image.Decode(bytes.NewReader(body)); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if resp.Trailer.Get(StreamErrorTrailer) != "" {
+				t.Errorf("Unexpected error trailer %q", resp.Trailer.Get(StreamErrorTrailer))
+			}
+			// Stored images are named in trailers, once they've been sent
+			key := strings.TrimPrefix(resp.Trailer.Get("Content-Location"), "/v2/images/")
+			if key != storage.ContentKey(body, extension(body)) {
+				t.Errorf("Expected the image to have been stored as %q, but was %q", storage.ContentKey(body, extension(body)), key)
+			}
+			blob, err := store.Get(context.Background(), key)
+			if err != nil {
+				t.Fatalf("Expected the image to have been stored: %v", err)
+			}
+			blob.Content.Close()
+		})
+	}
+}
+
+func TestSendStreamErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", StreamErrorTrailer)
+		w.WriteHeader(http.StatusOK)
+		sendStream(w, r, func(output io.Writer) error {
+			io.WriteString(output, "partial")
+			return errors.New("encoding failed")
+		})
+	}))
+	defer server.Close()
+
+	for _, trailers := range []bool{true, false} {
+		t.Run(fmt.Sprintf("trailers=%t", trailers), func(t *testing.T) {
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if trailers {
+				req.Header.Set("TE", "trailers")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+
+			if !trailers {
+				// The connection is aborted rather than ending the response
+				if err == nil {
+					t.Errorf("Expected reading %q to fail", body)
+				}
+				return
+			}
+			if err != nil || string(body) != "partial" {
+				t.Fatalf("Expected the partial body, but was %q: %v", body, err)
+			}
+			if resp.Trailer.Get(StreamErrorTrailer) != "encoding failed" {
+				t.Errorf("Expected the error in a trailer, but was %q", resp.Trailer.Get(StreamErrorTrailer))
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package images
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+// Record is an uploaded image and its perceptual hashes.
+type Record struct {
+	// Key is the storage key of the original image.
+	Key string `json:"key"`
+	// Owner identifies the client which uploaded the image, and is empty
+	// when clients aren't told apart.
+	Owner     string    `json:"owner,omitempty"`
+	Hashes    Hashes    `json:"hashes"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+// Match is a record found near a query image.
+type Match struct {
+	Record
+	Distance int `json:"distance"`
+	// URL serves the original image, when images are stored.
+	URL string `json:"url,omitempty"`
+}
+
+// Index finds records with hashes within a Hamming distance of a query,
+// keeping a BK-tree for each kind of hash. Records are appended to a file
+// as JSON lines, so the index survives restarts. Each owner's records are
+// only found by that owner's searches.
+type Index struct {
+	mu      sync.RWMutex
+	file    *os.File
+	records []Record
+	keys    map[string]bool
+	trees   map[string]*bkTree
+}
+
+// NewIndex creates an in-memory index.
+func NewIndex() *Index {
+	return &Index{
+		keys: map[string]bool{},
+		trees: map[string]*bkTree{
+			HashAverage:    {},
+			HashDifference: {},
+			HashPerceptual: {},
+		},
+	}
+}
+
+// OpenIndex loads the records in the file, creating it if needed, and
+// appends new records to it.
+func OpenIndex(path string) (*Index, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	index := NewIndex()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		// A partially written last line is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		index.insert(record)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	index.file = file
+	return index, nil
+}
+
+// Add indexes the record, ignoring records whose key is already indexed
+// for its owner.
+func (i *Index) Add(record Record) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.keys[record.indexKey()] {
+		return nil
+	}
+	if i.file != nil {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := i.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	i.insert(record)
+	return nil
+}
+
+func (i *Index) insert(record Record) {
+	if i.keys[record.indexKey()] {
+		return
+	}
+	i.keys[record.indexKey()] = true
+	i.records = append(i.records, record)
+	for kind, tree := range i.trees {
+		hash, _ := record.Hashes.Get(kind)
+		tree.add(hash, len(i.records)-1)
+	}
+}
+
+// indexKey tells apart the same image uploaded by different owners.
+func (r Record) indexKey() string {
+	return r.Owner + "/" + r.Key
+}
+
+// Search returns the owner's records whose hash of the kind is within
+// maxDistance of the query's, nearest first.
+func (i *Index) Search(owner string, kind string, hashes Hashes, maxDistance int) []Match {
+	query, ok := hashes.Get(kind)
+	if !ok {
+		return nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var matches []Match
+	i.trees[kind].search(query, maxDistance, func(record int, distance int) {
+		if i.records[record].Owner == owner {
+			matches = append(matches, Match{Record: i.records[record], Distance: distance})
+		}
+	})
+	sort.SliceStable(matches, func(a, b int) bool {
+		if matches[a].Distance != matches[b].Distance {
+			return matches[a].Distance < matches[b].Distance
+		}
+		return matches[a].CreatedOn.Before(matches[b].CreatedOn)
+	})
+	return matches
+}
+
+// Len returns the number of indexed records.
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.records)
+}
+
+func (i *Index) Close() error {
+	if i.file == nil {
+		return nil
+	}
+	return i.file.Close()
+}
+
+// bkTree is a Burkhard-Keller tree over Hamming distance. Each child is
+// filed under its distance from the parent, so by the triangle inequality
+// a search only descends into children within maxDistance of the query's
+// distance from the parent.
+type bkTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	hash Hash
+	// records share the node's hash
+	records  []int
+	children map[int]*bkNode
+}
+
+func (t *bkTree) add(hash Hash, record int) {
+	if t.root == nil {
+		t.root = &bkNode{hash: hash, records: []int{record}}
+		return
+	}
+	node := t.root
+	for {
+		distance := node.hash.Distance(hash)
+		if distance == 0 {
+			node.records = append(node.records, record)
+			return
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = map[int]*bkNode{}
+			}
+			node.children[distance] = &bkNode{hash: hash, records: []int{record}}
+			return
+		}
+		node = child
+	}
+}
+
+func (t *bkTree) search(query Hash, maxDistance int, found func(record int, distance int)) {
+	if t.root == nil {
+		return
+	}
+	pending := []*bkNode{t.root}
+	for len(pending) > 0 {
+		node := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		distance := node.hash.Distance(query)
+		if distance <= maxDistance {
+			for _, record := range node.records {
+				found(record, distance)
+			}
+		}
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				pending = append(pending, child)
+			}
+		}
+	}
+}
+
+const (
+	defaultSimilarDistance = 10
+	// MaxSimilarMatches bounds the matches ServeSimilar responds with.
+	MaxSimilarMatches  = 50
+	ErrorInvalidSearch = "Invalid similarity search"
+)
+
+// similarImages is the response of ServeSimilar.
+type similarImages struct {
+	Hashes  Hashes  `json:"hashes"`
+	Matches []Match `json:"matches"`
+}
+
+// ServeSimilar hashes the uploaded image and responds with the nearest
+// MaxSimilarMatches of the images the client uploaded within the distance
+// query parameter (10 by default) of it, using the hash query parameter's
+// kind of hash (phash by default).
+func (h *Handler) ServeSimilar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
+		return
+	}
+
+	kind := r.URL.Query().Get("hash")
+	if kind == "" {
+		kind = HashPerceptual
+	}
+	maxDistance := defaultSimilarDistance
+	if r.URL.Query().Has("distance") {
+		var err error
+		maxDistance, err = strconv.Atoi(r.URL.Query().Get("distance"))
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidSearch).
+				WithDetail("distance must be between 0 and 64"))
+			return
+		}
+	}
+	if _, ok := (Hashes{}).Get(kind); !ok {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidSearch).
+			WithDetail("hash must be ahash, dhash or phash"))
+		return
+	}
+
+	request, release, ok := h.readRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if len(request.files) > 1 {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidRequest).
+			WithDetail("only one image may be uploaded"))
+		return
+	}
+
+	decoded, err := decode(request.Image)
+	if err != nil {
+		problem.Write(w, r, ConversionProblem(err))
+		return
+	}
+
+	response := similarImages{Hashes: ComputeHashes(decoded), Matches: []Match{}}
+	if h.index != nil {
+		matches := h.index.Search(h.requestOwner(r), kind, response.Hashes, maxDistance)
+		if len(matches) > MaxSimilarMatches {
+			matches = matches[:MaxSimilarMatches]
+		}
+		for _, match := range matches {
+			if h.store != nil {
+				match.URL = h.storeURL + match.Key
+			}
+			response.Matches = append(response.Matches, match)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
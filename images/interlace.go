@@ -0,0 +1,226 @@
+package images
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	// pngHeaderSize covers the signature and the IHDR chunk's length, type,
+	// 13 bytes of data and checksum.
+	pngHeaderSize = 8 + 4 + 4 + 13 + 4
+)
+
+// adam7 are the passes of Adam7 interlacing, as the column and row each
+// starts from and the distance between the pixels it holds.
+var adam7 = []struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+var zlibLevels = map[png.CompressionLevel]int{
+	png.DefaultCompression: zlib.DefaultCompression,
+	png.NoCompression:      zlib.NoCompression,
+	png.BestSpeed:          zlib.BestSpeed,
+	png.BestCompression:    zlib.BestCompression,
+}
+
+// pngChunk encodes a PNG chunk with its length and checksum.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// idatWriter writes each block of compressed image data as an IDAT chunk.
+type idatWriter struct {
+	w io.Writer
+}
+
+func (iw idatWriter) Write(data []byte) (int, error) {
+	if _, err := iw.w.Write(pngChunk("IDAT", data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// encodeInterlaced writes the image as an 8 bit Adam7 interlaced PNG,
+// which image/png can't encode. Gray and paletted images keep their color
+// types, while other images are encoded as RGB, or RGBA when they aren't
+// opaque.
+func encodeInterlaced(w io.Writer, img image.Image, level png.CompressionLevel) error {
+	bounds := img.Bounds()
+	var colorType byte
+	var pixelSize int
+	var pixel func(x int, y int, dst []byte)
+	switch m := img.(type) {
+	case *image.Gray:
+		colorType, pixelSize = 0, 1
+		pixel = func(x int, y int, dst []byte) { dst[0] = m.Pix[m.PixOffset(x, y)] }
+	case *image.Paletted:
+		colorType, pixelSize = 3, 1
+		pixel = func(x int, y int, dst []byte) { dst[0] = m.Pix[m.PixOffset(x, y)] }
+	default:
+		colorType, pixelSize = 2, 3
+		if hasTransparency(img) {
+			colorType, pixelSize = 6, 4
+		}
+		pixel = func(x int, y int, dst []byte) {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			copy(dst, []byte{c.R, c.G, c.B, c.A}[:pixelSize])
+		}
+	}
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header, uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(bounds.Dy()))
+	// Bit depth, color type, compression, filter and interlace methods
+	copy(header[8:], []byte{8, colorType, 0, 0, 1})
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return err
+	}
+	if _, err := w.Write(pngChunk("IHDR", header)); err != nil {
+		return err
+	}
+	if paletted, ok := img.(*image.Paletted); ok {
+		if err := writePalette(w, paletted.Palette); err != nil {
+			return err
+		}
+	}
+
+	buffered := bufio.NewWriterSize(idatWriter{w}, 1<<15)
+	compressor, err := zlib.NewWriterLevel(buffered, zlibLevels[level])
+	if err != nil {
+		return err
+	}
+	for _, pass := range adam7 {
+		width := (bounds.Dx() - pass.x + pass.dx - 1) / pass.dx
+		height := (bounds.Dy() - pass.y + pass.dy - 1) / pass.dy
+		if width <= 0 || height <= 0 {
+			continue
+		}
+		// Each row is filtered against the row above it in the same pass
+		previous := make([]byte, width*pixelSize)
+		current := make([]byte, width*pixelSize)
+		for row := 0; row < height; row++ {
+			y := bounds.Min.Y + pass.y + row*pass.dy
+			for column := 0; column < width; column++ {
+				pixel(bounds.Min.X+pass.x+column*pass.dx, y, current[column*pixelSize:])
+			}
+			// Palette indices don't filter well, as the PNG specification
+			// advises
+			filtered := append([]byte{0}, current...)
+			if colorType != 3 {
+				filtered = filterRow(current, previous, pixelSize)
+			}
+			if _, err := compressor.Write(filtered); err != nil {
+				return err
+			}
+			previous, current = current, previous
+		}
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(pngChunk("IEND", nil))
+	return err
+}
+
+// writePalette writes the PLTE chunk, and a tRNS chunk holding the alpha
+// of every entry up to the last transparent one.
+func writePalette(w io.Writer, palette color.Palette) error {
+	colors := make([]byte, 0, 3*len(palette))
+	alphas := make([]byte, len(palette))
+	transparent := 0
+	for i, entry := range palette {
+		c := color.NRGBAModel.Convert(entry).(color.NRGBA)
+		colors = append(colors, c.R, c.G, c.B)
+		alphas[i] = c.A
+		if c.A != 0xff {
+			transparent = i + 1
+		}
+	}
+	if _, err := w.Write(pngChunk("PLTE", colors)); err != nil {
+		return err
+	}
+	if transparent > 0 {
+		if _, err := w.Write(pngChunk("tRNS", alphas[:transparent])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterRow tries each PNG filter on the row, returning the filter type
+// followed by the filtered row which has the smallest sum of absolute
+// differences, the heuristic the PNG specification suggests.
+func filterRow(current []byte, previous []byte, pixelSize int) []byte {
+	var best []byte
+	bestSum := -1
+	for filter := byte(0); filter <= 4; filter++ {
+		filtered := make([]byte, 1+len(current))
+		filtered[0] = filter
+		sum := 0
+		for i, value := range current {
+			var left, up, upperLeft byte
+			if i >= pixelSize {
+				left, upperLeft = current[i-pixelSize], previous[i-pixelSize]
+			}
+			up = previous[i]
+			switch filter {
+			case 1:
+				value -= left
+			case 2:
+				value -= up
+			case 3:
+				value -= byte((int(left) + int(up)) / 2)
+			case 4:
+				value -= paeth(left, up, upperLeft)
+			}
+			filtered[1+i] = value
+			sum += absInt(int(int8(value)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = filtered, sum
+		}
+	}
+	return best
+}
+
+// paeth predicts a byte from its neighbors to the left, above and above
+// to the left, whichever is closest to left + up - upperLeft.
+func paeth(left byte, up byte, upperLeft byte) byte {
+	estimate := int(left) + int(up) - int(upperLeft)
+	distanceLeft, distanceUp, distanceUpperLeft := absInt(estimate-int(left)), absInt(estimate-int(up)), absInt(estimate-int(upperLeft))
+	if distanceLeft <= distanceUp && distanceLeft <= distanceUpperLeft {
+		return left
+	}
+	if distanceUp <= distanceUpperLeft {
+		return up
+	}
+	return upperLeft
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Limiter.Acquire when the queue has no room.
+var ErrQueueFull = errors.New("the image queue is full")
+
+// Limiter bounds how many images are processed at once. Requests beyond
+// the worker count wait in a queue of bounded depth, and are rejected once
+// the queue is full so that bursts of uploads can't starve other routes.
+type Limiter struct {
+	slots      chan struct{}
+	mu         sync.Mutex
+	queued     int
+	queueDepth int
+	// RetryAfter is suggested to clients rejected because the queue is full.
+	RetryAfter time.Duration
+	metrics    *expvar.Map
+}
+
+// NewLimiter creates a limiter running at most workers jobs at once, with
+// at most queueDepth more waiting for a worker.
+func NewLimiter(workers int, queueDepth int) *Limiter {
+	if workers < 1 {
+		workers = 1
+	}
+	metrics := new(expvar.Map).Init()
+	for _, name := range []string{"running", "queued", "completed", "rejected", "abandoned", "queue_wait_count"} {
+		metrics.Set(name, new(expvar.Int))
+	}
+	for _, name := range []string{"queue_wait_seconds_total", "queue_wait_seconds_max"} {
+		metrics.Set(name, new(expvar.Float))
+	}
+
+	return &Limiter{
+		slots:      make(chan struct{}, workers),
+		queueDepth: queueDepth,
+		RetryAfter: time.Second,
+		metrics:    metrics,
+	}
+}
+
+// Acquire waits for a worker to become available, returning a function
+// which must be called to release it once the job is done. It fails with
+// ErrQueueFull if the queue has no room, or the context's error if the
+// context ends while waiting.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	// Skip the queue when a worker is free
+	select {
+	case l.slots <- struct{}{}:
+		l.recordWait(0)
+		return l.release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.queueDepth {
+		l.mu.Unlock()
+		l.metrics.Add("rejected", 1)
+		return nil, ErrQueueFull
+	}
+	l.queued++
+	l.mu.Unlock()
+	l.metrics.Add("queued", 1)
+
+	start := time.Now()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+		l.metrics.Add("queued", -1)
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.recordWait(time.Since(start))
+		return l.release, nil
+	case <-ctx.Done():
+		l.metrics.Add("abandoned", 1)
+		return nil, ctx.Err()
+	}
+}
+
+// Metrics exposes the limiter's counters and queue wait times, and can be
+// published with expvar.Publish.
+func (l *Limiter) Metrics() *expvar.Map {
+	return l.metrics
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+	l.metrics.Add("running", -1)
+	l.metrics.Add("completed", 1)
+}
+
+func (l *Limiter) recordWait(wait time.Duration) {
+	l.metrics.Add("running", 1)
+	l.metrics.Add("queue_wait_count", 1)
+	l.metrics.AddFloat("queue_wait_seconds_total", wait.Seconds())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maxWait := l.metrics.Get("queue_wait_seconds_max").(*expvar.Float)
+	if wait.Seconds() > maxWait.Value() {
+		maxWait.Set(wait.Seconds())
+	}
+}
@@ -0,0 +1,168 @@
+package images
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxUploadFiles bounds the number of files in a multipart upload.
+	MaxUploadFiles = 10
+	// maxFieldBytes bounds each form field of a multipart upload.
+	maxFieldBytes = 64 << 10
+)
+
+// imageFile is one of the images uploaded in a request.
+type imageFile struct {
+	// name is the uploaded file's name, which may be empty.
+	name string
+	data []byte
+}
+
+// fileTooLargeError is returned for a file in a multipart upload larger
+// than the limit of each file.
+type fileTooLargeError struct {
+	name  string
+	limit int64
+}
+
+func (e *fileTooLargeError) Error() string {
+	return fmt.Sprintf("%s: each image may be at most %d bytes", e.name, e.limit)
+}
+
+// parseMultipart reads the files and form fields of a multipart/form-data
+// body. Files larger than maxFileBytes return a *fileTooLargeError.
+func parseMultipart(body []byte, boundary string, maxFileBytes int64) ([]imageFile, url.Values, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("multipart/form-data requires a boundary")
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var files []imageFile
+	fields := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		limit := int64(maxFieldBytes)
+		if part.FileName() != "" {
+			limit = maxFileBytes
+		}
+		data, err := io.ReadAll(io.LimitReader(part, limit+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FileName() == "" {
+			if int64(len(data)) > limit {
+				return nil, nil, fmt.Errorf("form field %s may be at most %d bytes", part.FormName(), limit)
+			}
+			fields.Add(part.FormName(), string(data))
+			continue
+		}
+
+		if int64(len(data)) > limit {
+			return nil, nil, &fileTooLargeError{name: part.FileName(), limit: limit}
+		}
+		if len(files) == MaxUploadFiles {
+			return nil, nil, fmt.Errorf("at most %d files may be uploaded at once", MaxUploadFiles)
+		}
+		files = append(files, imageFile{name: part.FileName(), data: data})
+	}
+
+	if len(files) == 0 {
+		return nil, nil, errors.New("at least one file is required")
+	}
+	return files, fields, nil
+}
+
+// convertedFile is a converted upload along with the headers describing
+// it, such as where it's stored.
+type convertedFile struct {
+	name       string
+	conversion *Conversion
+	header     http.Header
+}
+
+// convertedNames names each converted file after its upload, with the
+// extension of its new format. Unnamed and repeated names are numbered.
+func convertedNames(files []convertedFile) []string {
+	names := make([]string, len(files))
+	used := map[string]bool{}
+	for i, file := range files {
+		base := strings.TrimSuffix(file.name, path.Ext(file.name))
+		if base == "" {
+			base = fmt.Sprintf("image-%d", i+1)
+		}
+		ext := extension(file.conversion.Data)
+		name := base + ext
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// encodeZIP archives the converted files. They're stored uncompressed since
+// PNGs and GIFs are already compressed.
+func encodeZIP(files []convertedFile) ([]byte, error) {
+	archive := new(bytes.Buffer)
+	writer := zip.NewWriter(archive)
+	modified := time.Now()
+	for i, name := range convertedNames(files) {
+		entry, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := entry.Write(files[i].conversion.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return archive.Bytes(), nil
+}
+
+// encodeMultipart writes the converted files as the parts of a
+// multipart/mixed body, each with the headers of a single conversion,
+// returning the body and its content type.
+func encodeMultipart(files []convertedFile) ([]byte, string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for i, name := range convertedNames(files) {
+		header := textproto.MIMEHeader{}
+		for key, values := range files[i].header {
+			header[key] = values
+		}
+		header.Set("Content-Type", files[i].conversion.ContentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(files[i].conversion.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()}), nil
+}
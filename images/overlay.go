@@ -0,0 +1,286 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Position is where an overlay is placed on the image.
+type Position string
+
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTopRight    Position = "top-right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottomRight Position = "bottom-right"
+	PositionCenter      Position = "center"
+
+	// MaxTextOverlays bounds the number of text overlays on an image.
+	MaxTextOverlays         = 5
+	maxTextLength           = 200
+	maxTextSize             = 200
+	defaultTextSize         = 16
+	defaultWatermarkScale   = 0.25
+	defaultWatermarkOpacity = 0.5
+	// defaultWatermarkMinOpacity keeps a request from overriding the
+	// watermark until it can no longer be seen.
+	defaultWatermarkMinOpacity = 0.25
+	overlayMarginRate          = 40
+)
+
+func (p Position) valid() bool {
+	switch p {
+	case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+		return true
+	}
+	return false
+}
+
+// place returns the top left corner of an overlay of the given size,
+// inset from the edges of bounds by a margin proportional to the image.
+func place(bounds image.Rectangle, size image.Point, position Position) image.Point {
+	margin := bounds.Dx()
+	if bounds.Dy() > margin {
+		margin = bounds.Dy()
+	}
+	margin /= overlayMarginRate
+	if margin < 2 {
+		margin = 2
+	}
+
+	at := image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	switch position {
+	case PositionTopRight:
+		at.X = bounds.Max.X - margin - size.X
+	case PositionBottomLeft:
+		at.Y = bounds.Max.Y - margin - size.Y
+	case PositionBottomRight:
+		at = image.Pt(bounds.Max.X-margin-size.X, bounds.Max.Y-margin-size.Y)
+	case PositionCenter:
+		at = image.Pt(bounds.Min.X+(bounds.Dx()-size.X)/2, bounds.Min.Y+(bounds.Dy()-size.Y)/2)
+	}
+	return at
+}
+
+// Watermark is an image composited over converted images.
+type Watermark struct {
+	Image    image.Image
+	Position Position
+	// Opacity scales the watermark's own alpha, from 0 to 1.
+	Opacity float64
+	// MinOpacity is the lowest opacity a request can override Opacity to.
+	MinOpacity float64
+	// Scale is the watermark's width as a fraction of the image's width.
+	Scale float64
+}
+
+// LoadWatermark reads a PNG watermark, placed in the bottom right corner at
+// half opacity and a quarter of the image's width unless changed. Requests
+// can lower its opacity to a quarter at most.
+func LoadWatermark(path string) (*Watermark, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Watermark{Image: img, Position: PositionBottomRight, Opacity: defaultWatermarkOpacity, MinOpacity: defaultWatermarkMinOpacity, Scale: defaultWatermarkScale}, nil
+}
+
+// Validate checks the watermark's placement.
+func (w *Watermark) Validate() error {
+	if w.MinOpacity < 0 || w.MinOpacity > w.Opacity {
+		return fmt.Errorf("%w: watermark: minimum opacity must be between 0 and the opacity", ErrInvalidOperation)
+	}
+	return (&WatermarkOptions{Position: w.Position, Opacity: &w.Opacity, Scale: &w.Scale}).Validate()
+}
+
+// With returns a copy of the watermark with the request's overrides. The
+// opacity is never lowered below MinOpacity.
+func (w *Watermark) With(options *WatermarkOptions) *Watermark {
+	overridden := *w
+	if options == nil {
+		return &overridden
+	}
+	if options.Position != "" {
+		overridden.Position = options.Position
+	}
+	if options.Opacity != nil {
+		overridden.Opacity = math.Max(*options.Opacity, w.MinOpacity)
+	}
+	if options.Scale != nil {
+		overridden.Scale = *options.Scale
+	}
+	return &overridden
+}
+
+func (w *Watermark) apply(dst *image.RGBA) {
+	bounds, watermarkBounds := dst.Bounds(), w.Image.Bounds()
+	width := int(math.Round(w.Scale * float64(bounds.Dx())))
+	if width < 1 {
+		width = 1
+	}
+	height := int(math.Round(float64(width) * float64(watermarkBounds.Dy()) / float64(watermarkBounds.Dx())))
+	if height < 1 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Rect, w.Image, watermarkBounds, draw.Src, nil)
+
+	at := place(bounds, scaled.Rect.Size(), w.Position)
+	opacity := image.NewUniform(color.Alpha16{uint16(math.Round(w.Opacity * 0xffff))})
+	draw.DrawMask(dst, image.Rectangle{at, at.Add(scaled.Rect.Size())}, scaled, image.Point{}, opacity, image.Point{}, draw.Over)
+}
+
+// WatermarkOptions overrides how the configured watermark is placed for a
+// single request. Unset fields keep the configured values.
+type WatermarkOptions struct {
+	Position Position `json:"position,omitempty"`
+	Opacity  *float64 `json:"opacity,omitempty"`
+	Scale    *float64 `json:"scale,omitempty"`
+}
+
+func (o *WatermarkOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Position != "" && !o.Position.valid() {
+		return fmt.Errorf("%w: watermark: unknown position %q", ErrInvalidOperation, o.Position)
+	}
+	if o.Opacity != nil && (*o.Opacity < 0 || *o.Opacity > 1) {
+		return fmt.Errorf("%w: watermark: opacity must be between 0 and 1", ErrInvalidOperation)
+	}
+	if o.Scale != nil && (*o.Scale <= 0 || *o.Scale > 1) {
+		return fmt.Errorf("%w: watermark: scale must be greater than 0 and at most 1", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// TextOverlay is text drawn over the converted image.
+type TextOverlay struct {
+	Text     string   `json:"text"`
+	Position Position `json:"position,omitempty"`
+	// Size is the height of the font in pixels, 16 by default.
+	Size float64 `json:"size,omitempty"`
+	// Color is a hex RRGGBB or RRGGBBAA color, white by default.
+	Color string `json:"color,omitempty"`
+}
+
+// Validate checks the overlay and fills in its defaults.
+func (t *TextOverlay) Validate() error {
+	if t.Text == "" || len(t.Text) > maxTextLength {
+		return fmt.Errorf("%w: text must be between 1 and %d bytes", ErrInvalidOperation, maxTextLength)
+	}
+	if t.Position == "" {
+		t.Position = PositionTopLeft
+	}
+	if !t.Position.valid() {
+		return fmt.Errorf("%w: text: unknown position %q", ErrInvalidOperation, t.Position)
+	}
+	if t.Size == 0 {
+		t.Size = defaultTextSize
+	}
+	if t.Size < 1 || t.Size > maxTextSize {
+		return fmt.Errorf("%w: text: size must be between 1 and %d", ErrInvalidOperation, maxTextSize)
+	}
+	if _, err := parseColor(t.Color); err != nil {
+		return fmt.Errorf("%w: text: %s", ErrInvalidOperation, err.Error())
+	}
+	return nil
+}
+
+func (t *TextOverlay) apply(dst *image.RGBA, typeface *opentype.Font) error {
+	face, err := opentype.NewFace(typeface, &opentype.FaceOptions{Size: t.Size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	textColor, _ := parseColor(t.Color)
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(textColor), Face: face}
+	metrics := face.Metrics()
+	size := image.Pt(drawer.MeasureString(t.Text).Ceil(), (metrics.Ascent + metrics.Descent).Ceil())
+	at := place(dst.Bounds(), size, t.Position)
+	drawer.Dot = fixed.P(at.X, at.Y+metrics.Ascent.Ceil())
+	drawer.DrawString(t.Text)
+	return nil
+}
+
+// ValidateTextOverlays checks every overlay, filling in their defaults.
+func ValidateTextOverlays(overlays []TextOverlay) error {
+	if len(overlays) > MaxTextOverlays {
+		return fmt.Errorf("%w: at most %d text overlays may be drawn", ErrInvalidOperation, MaxTextOverlays)
+	}
+	for i := range overlays {
+		if err := overlays[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFont reads a TrueType or OpenType font for text overlays.
+func LoadFont(path string) (*opentype.Font, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.Parse(data)
+}
+
+var (
+	defaultFontOnce sync.Once
+	defaultFont     *opentype.Font
+)
+
+// goRegular returns the Go Regular font, used when no font is configured.
+func goRegular() *opentype.Font {
+	defaultFontOnce.Do(func() {
+		var err error
+		if defaultFont, err = opentype.Parse(goregular.TTF); err != nil {
+			panic(err)
+		}
+	})
+	return defaultFont
+}
+
+// applyOverlays composites the watermark and then the text over the image,
+// returning it unchanged when there's nothing to draw.
+func applyOverlays(img image.Image, options Options) (image.Image, error) {
+	if options.Watermark == nil && len(options.Text) == 0 {
+		return img, nil
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Rect, img, bounds.Min, draw.Src)
+
+	if options.Watermark != nil {
+		options.Watermark.apply(dst)
+	}
+	typeface := options.Font
+	if typeface == nil {
+		typeface = goRegular()
+	}
+	for i := range options.Text {
+		if err := options.Text[i].apply(dst, typeface); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
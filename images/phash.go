@@ -0,0 +1,175 @@
+package images
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Hash is a 64 bit perceptual hash, encoded as 16 hex characters.
+type Hash uint64
+
+func (h Hash) MarshalText() ([]byte, error) {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(h))
+	return []byte(hex.EncodeToString(encoded[:])), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil || len(decoded) != 8 {
+		return fmt.Errorf("hash %q must be 16 hex characters", text)
+	}
+	*h = Hash(binary.BigEndian.Uint64(decoded))
+	return nil
+}
+
+// Distance is the number of bits which differ between the hashes.
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+// Hashes are the perceptual hashes of an image. Images which look alike,
+// such as the same photo at a different size or compression, have hashes a
+// small Hamming distance apart.
+type Hashes struct {
+	// AHash compares each pixel of an 8x8 thumbnail with the mean.
+	AHash Hash `json:"ahash"`
+	// DHash compares each pixel of a 9x8 thumbnail with its right neighbor.
+	DHash Hash `json:"dhash"`
+	// PHash compares the low frequencies of a 32x32 thumbnail's DCT with
+	// their median, making it the most robust to changes.
+	PHash Hash `json:"phash"`
+}
+
+const (
+	HashAverage    = "ahash"
+	HashDifference = "dhash"
+	HashPerceptual = "phash"
+)
+
+// Get returns the hash of the kind, such as phash.
+func (h Hashes) Get(kind string) (Hash, bool) {
+	switch kind {
+	case HashAverage:
+		return h.AHash, true
+	case HashDifference:
+		return h.DHash, true
+	case HashPerceptual:
+		return h.PHash, true
+	}
+	return 0, false
+}
+
+// ComputeHashes hashes the image.
+func ComputeHashes(img image.Image) Hashes {
+	return Hashes{
+		AHash: averageHash(grayThumbnail(img, 8, 8)),
+		DHash: differenceHash(grayThumbnail(img, 9, 8)),
+		PHash: perceptualHash(grayThumbnail(img, 32, 32)),
+	}
+}
+
+// grayThumbnail averages the luminance of the pixels falling within each
+// cell of a width by height grid, returned row by row.
+func grayThumbnail(img image.Image, width int, height int) []float64 {
+	bounds := img.Bounds()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+	luminance := func(x int, y int) float64 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+	}
+	// JPEGs already hold their luminance
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		luminance = func(x int, y int) float64 {
+			return float64(ycbcr.Y[ycbcr.YOffset(x, y)])
+		}
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cell := row*width + (x-bounds.Min.X)*width/bounds.Dx()
+			sums[cell] += luminance(x, y)
+			counts[cell]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= counts[i]
+			continue
+		}
+		// Images smaller than the grid leave cells empty, so sample the
+		// pixel they cover instead
+		sums[i] = luminance(bounds.Min.X+(i%width)*bounds.Dx()/width, bounds.Min.Y+(i/width)*bounds.Dy()/height)
+	}
+	return sums
+}
+
+func averageHash(pixels []float64) Hash {
+	var mean float64
+	for _, pixel := range pixels {
+		mean += pixel
+	}
+	mean /= float64(len(pixels))
+
+	var hash Hash
+	for i, pixel := range pixels {
+		if pixel > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func differenceHash(pixels []float64) Hash {
+	var hash Hash
+	bit := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1 << uint(bit)
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+func perceptualHash(pixels []float64) Hash {
+	const size = 32
+	// Only the top left 8x8 coefficients of the DCT are needed
+	var coefficients []float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y*size+x] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*size)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*size))
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	// The DC coefficient is the overall brightness, which would skew the
+	// median
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash Hash
+	for i, coefficient := range coefficients {
+		if coefficient > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
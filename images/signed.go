@@ -0,0 +1,271 @@
+package images
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/storage"
+)
+
+const (
+	ErrorSignedMethodNotSupported = "Only GET and HEAD are supported"
+	ErrorInvalidSignature         = "The image URL's signature is invalid"
+	ErrorStorageDisabled          = "Stored images can't be transformed by this server"
+
+	// MinSigningKeyBytes is the shortest key a Signer accepts, the size of
+	// the HMAC-SHA256 it computes.
+	MinSigningKeyBytes = sha256.Size
+
+	// maxSignedAge is how long responses to signed URLs without an expiry
+	// may be cached.
+	maxSignedAge = 365 * 24 * time.Hour
+)
+
+var (
+	// ErrInvalidSignature is returned for a URL which is unsigned or whose
+	// signature doesn't match any of the Signer's keys.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpiredSignature is returned for a correctly signed URL whose
+	// expires parameter has passed.
+	ErrExpiredSignature = errors.New("expired signature")
+)
+
+// Signer signs transform URLs with HMAC-SHA256, so only URLs generated by
+// holders of a key are served. The signature covers the URL's path and
+// every query parameter, including an optional expires timestamp.
+type Signer struct {
+	keys [][]byte
+}
+
+// NewSigner signs URLs with the first key and accepts URLs signed with any
+// of them, so keys can be rotated by adding the new key first and removing
+// the old one once the URLs signed with it have expired or been replaced.
+func NewSigner(keys ...[]byte) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+	for i, key := range keys {
+		if len(key) < MinSigningKeyBytes {
+			return nil, fmt.Errorf("signing key %d is %d bytes, but must be at least %d", i+1, len(key), MinSigningKeyBytes)
+		}
+	}
+	return &Signer{keys: keys}, nil
+}
+
+// ParseSigningKeys reads comma separated hex encoded keys, newest first.
+func ParseSigningKeys(value string) ([][]byte, error) {
+	var keys [][]byte
+	for _, encoded := range strings.Split(value, ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %d: %s", len(keys)+1, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Sign returns the URL with its signature added in the signature query
+// parameter, replacing any signature it already had. Unless expires is
+// zero, the URL stops being accepted after it.
+func (s *Signer) Sign(rawURL string, expires time.Time) (string, error) {
+	signed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := signed.Query()
+	query.Del("signature")
+	if !expires.IsZero() {
+		query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	}
+	query.Set("signature", base64.RawURLEncoding.EncodeToString(sign(s.keys[0], signed.EscapedPath(), query)))
+	signed.RawQuery = query.Encode()
+	return signed.String(), nil
+}
+
+// Verify checks the URL's signature against each key, then its expiry.
+// The errors wrap ErrInvalidSignature or ErrExpiredSignature.
+func (s *Signer) Verify(signed *url.URL, now time.Time) error {
+	query := signed.Query()
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("%w: the signature parameter is missing or malformed", ErrInvalidSignature)
+	}
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal(signature, sign(key, signed.EscapedPath(), query)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("%w: the signature doesn't match the URL", ErrInvalidSignature)
+	}
+
+	if query.Has("expires") {
+		expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: expires: %s", ErrInvalidSignature, err.Error())
+		}
+		if now.Unix() > expires {
+			return fmt.Errorf("%w: the URL expired at %s", ErrExpiredSignature, time.Unix(expires, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// sign computes the signature of the path and query, excluding the
+// signature itself. The query is encoded with its keys sorted, so the
+// order of different parameters doesn't matter, but repeated parameters
+// such as op keep their order.
+func sign(key []byte, escapedPath string, query url.Values) []byte {
+	unsigned := url.Values{}
+	for name, values := range query {
+		if name != "signature" {
+			unsigned[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, escapedPath+"?"+unsigned.Encode())
+	return mac.Sum(nil)
+}
+
+// WithSigner enables ServeSigned, serving transforms given in URLs signed
+// by the signer.
+func WithSigner(signer *Signer) Option {
+	return func(h *Handler) {
+		h.signer = signer
+	}
+}
+
+// ServeSigned converts the image named by a signed URL, with the options
+// given in its query string like a raw upload's. The image is either a
+// stored image, named by key, or fetched from url. Requests without a
+// valid signature are forbidden, so only the variants the signer's key
+// holders generate can be requested.
+func (h *Handler) ServeSigned(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorSignedMethodNotSupported))
+		return
+	}
+	if h.signer == nil {
+		problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeForbidden, ErrorInvalidSignature).WithDetail("signed URLs aren't enabled"))
+		return
+	}
+	now := time.Now()
+	if err := h.signer.Verify(r.URL, now); err != nil {
+		problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeForbidden, ErrorInvalidSignature).WithDetail(err.Error()))
+		return
+	}
+
+	query := r.URL.Query()
+	request := &imageRequest{URL: query.Get("url")}
+	key := query.Get("key")
+	err := request.parseQuery(query)
+	if err == nil && (key == "") == (request.URL == "") {
+		err = errors.New("exactly one of key and url is required")
+	}
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidRequest).WithDetail(err.Error()))
+		return
+	}
+
+	name, upload, ok := h.signedImage(w, r, key, request.URL)
+	if !ok {
+		return
+	}
+	release, ok := h.acquire(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	options := h.options(request)
+	options.Hash = false
+	conversion, err := ConvertContext(r.Context(), upload, options)
+	if err != nil {
+		problem.Write(w, r, ConversionProblem(err))
+		return
+	}
+	header := conversionHeader(conversion)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(signedAge(query, now).Seconds())))
+	writeConversion(w, name, conversion, header)
+}
+
+// signedImage loads the stored image with the key, or fetches the URL,
+// returning its name and content. When ok is false a problem has already
+// been written.
+func (h *Handler) signedImage(w http.ResponseWriter, r *http.Request, key string, rawURL string) (name string, upload []byte, ok bool) {
+	if rawURL != "" {
+		if h.fetcher == nil {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorFetchDisabled))
+			return "", nil, false
+		}
+		fetched, err := h.fetcher.Fetch(r.Context(), rawURL)
+		if err != nil {
+			problem.Write(w, r, FetchProblem(err))
+			return "", nil, false
+		}
+		return fetchedName(rawURL), fetched, true
+	}
+
+	if h.store == nil {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorStorageDisabled))
+		return "", nil, false
+	}
+	blob, err := h.store.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		problem.Write(w, r, problem.New(http.StatusNotFound, problem.CodeNotFound, storage.ErrorBlobNotFound))
+		return "", nil, false
+	}
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, storage.ErrorReadingBlob).WithDetail(err.Error()))
+		return "", nil, false
+	}
+	defer blob.Content.Close()
+	// Read a byte past the limit, so larger blobs are refused rather than
+	// converted truncated
+	stored, err := io.ReadAll(io.LimitReader(blob.Content, h.maxBodyBytes+1))
+	if err != nil {
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, storage.ErrorReadingBlob).WithDetail(err.Error()))
+		return "", nil, false
+	}
+	if int64(len(stored)) > h.maxBodyBytes {
+		problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, ErrorImageTooLarge).
+			WithDetail(fmt.Sprintf("stored images may be at most %d bytes to be transformed", h.maxBodyBytes)))
+		return "", nil, false
+	}
+	return key, stored, true
+}
+
+// signedAge is how long the response to a signed URL may be cached: until
+// it expires, or a year when it doesn't.
+func signedAge(query url.Values, now time.Time) time.Duration {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return maxSignedAge
+	}
+	if age := time.Unix(expires, 0).Sub(now); age < maxSignedAge {
+		return age
+	}
+	return maxSignedAge
+}
@@ -0,0 +1,238 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	CropCenter = "center"
+	CropSmart  = "smart"
+
+	// analysisSize is the longest side of the copy of the image scored by
+	// the smart crop, keeping it fast for large images.
+	analysisSize = 128
+	// The weights of each signal in a window's score. Skin is weighted
+	// highly since people are usually the subject of a photo, and a small
+	// pull towards the center breaks ties in featureless images.
+	edgeWeight    = 1.0
+	entropyWeight = 0.5
+	skinWeight    = 2.0
+	centerWeight  = 0.05
+	entropyBins   = 16
+)
+
+// CropOptions crops the image to an aspect ratio before it's resized.
+type CropOptions struct {
+	// Mode is center, which keeps the middle of the image, or smart, which
+	// keeps the window scoring highest for edges, entropy and skin tones.
+	Mode string
+	// Aspect is the ratio of the window's width to its height.
+	Aspect image.Point
+}
+
+// ParseCrop reads a crop mode and an aspect ratio such as 16:9, which is
+// 1:1 when empty.
+func ParseCrop(mode string, aspect string) (*CropOptions, error) {
+	if mode == "" {
+		if aspect != "" {
+			return nil, fmt.Errorf("%w: aspect requires a crop mode", ErrInvalidOperation)
+		}
+		return nil, nil
+	}
+	if mode != CropCenter && mode != CropSmart {
+		return nil, fmt.Errorf("%w: crop must be center or smart", ErrInvalidOperation)
+	}
+
+	options := &CropOptions{Mode: mode, Aspect: image.Pt(1, 1)}
+	if aspect == "" {
+		return options, nil
+	}
+	width, height, _ := strings.Cut(aspect, ":")
+	var err error
+	if options.Aspect.X, err = strconv.Atoi(width); err == nil {
+		options.Aspect.Y, err = strconv.Atoi(height)
+	}
+	if err != nil || options.Aspect.X <= 0 || options.Aspect.Y <= 0 || options.Aspect.X > 100 || options.Aspect.Y > 100 {
+		return nil, fmt.Errorf("%w: aspect must be WIDTH:HEIGHT with both between 1 and 100", ErrInvalidOperation)
+	}
+	return options, nil
+}
+
+// cropWindow returns the largest rectangle of the image with the aspect
+// ratio, positioned according to the mode.
+func cropWindow(img image.Image, options CropOptions) image.Rectangle {
+	bounds := img.Bounds()
+	size := bounds.Size()
+	// Keep the full width or height, whichever is limiting
+	if size.X*options.Aspect.Y > size.Y*options.Aspect.X {
+		size.X = maxInt(1, size.Y*options.Aspect.X/options.Aspect.Y)
+	} else {
+		size.Y = maxInt(1, size.X*options.Aspect.Y/options.Aspect.X)
+	}
+
+	offset := image.Pt((bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2)
+	if options.Mode == CropSmart && size != bounds.Size() {
+		offset = smartOffset(img, size)
+	}
+	return image.Rectangle{Min: offset, Max: offset.Add(size)}.Add(bounds.Min)
+}
+
+// smartOffset slides a window of the given size along the image's longer
+// free axis, returning the offset of the highest scoring position. The
+// image is scored at a reduced size.
+func smartOffset(img image.Image, window image.Point) image.Point {
+	bounds := img.Bounds()
+	scale := math.Min(1, float64(analysisSize)/float64(maxInt(bounds.Dx(), bounds.Dy())))
+	small := image.NewNRGBA(image.Rect(0, 0,
+		maxInt(1, int(math.Round(float64(bounds.Dx())*scale))),
+		maxInt(1, int(math.Round(float64(bounds.Dy())*scale)))))
+	draw.ApproxBiLinear.Scale(small, small.Rect, img, bounds, draw.Src, nil)
+
+	features := scoreFeatures(small)
+	width, height := small.Rect.Dx(), small.Rect.Dy()
+	smallWindow := image.Pt(
+		clampInt(int(math.Round(float64(window.X)*scale)), 1, width),
+		clampInt(int(math.Round(float64(window.Y)*scale)), 1, height))
+
+	// Only one axis is free, since the window spans the other completely
+	horizontal := smallWindow.X < width
+	positions := height - smallWindow.Y
+	if horizontal {
+		positions = width - smallWindow.X
+	}
+
+	best, bestScore := positions/2, math.Inf(-1)
+	for position := 0; position <= positions; position++ {
+		rect := image.Rect(0, position, width, position+smallWindow.Y)
+		if horizontal {
+			rect = image.Rect(position, 0, position+smallWindow.X, height)
+		}
+		score := features.score(rect)
+		if positions > 0 {
+			score -= centerWeight * math.Abs(float64(position)/float64(positions)-0.5) * 2
+		}
+		if score > bestScore {
+			best, bestScore = position, score
+		}
+	}
+
+	// Map the best position back to the full sized image
+	free := bounds.Dy() - window.Y
+	if horizontal {
+		free = bounds.Dx() - window.X
+	}
+	offset := 0
+	if positions > 0 {
+		offset = int(math.Round(float64(best) / float64(positions) * float64(free)))
+	}
+	if horizontal {
+		return image.Pt(offset, 0)
+	}
+	return image.Pt(0, offset)
+}
+
+// features holds per-pixel signals as summed area tables, so the total of
+// any window is found with four lookups.
+type features struct {
+	width     int
+	edges     []float64
+	skin      []float64
+	luminance []uint8
+}
+
+func scoreFeatures(img *image.NRGBA) *features {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	luminance := make([]uint8, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.NRGBAAt(x, y)
+			luminance[y*width+x] = clampUint8(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B))
+		}
+	}
+
+	f := &features{
+		width:     width,
+		edges:     make([]float64, (width+1)*(height+1)),
+		skin:      make([]float64, (width+1)*(height+1)),
+		luminance: luminance,
+	}
+	at := func(x int, y int) float64 {
+		return float64(luminance[clampInt(y, 0, height-1)*width+clampInt(x, 0, width-1)])
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Sobel operator
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			edge := math.Min(1, math.Hypot(gx, gy)/(4*255))
+			skin := 0.0
+			if isSkin(img.NRGBAAt(x, y)) {
+				skin = 1
+			}
+
+			index := (y+1)*(width+1) + x + 1
+			f.edges[index] = edge + f.edges[index-1] + f.edges[index-width-1] - f.edges[index-width-2]
+			f.skin[index] = skin + f.skin[index-1] + f.skin[index-width-1] - f.skin[index-width-2]
+		}
+	}
+	return f
+}
+
+// score combines the window's mean edge strength, the entropy of its
+// luminance and the fraction of skin toned pixels.
+func (f *features) score(rect image.Rectangle) float64 {
+	area := float64(rect.Dx() * rect.Dy())
+	sum := func(table []float64) float64 {
+		stride := f.width + 1
+		return table[rect.Max.Y*stride+rect.Max.X] - table[rect.Min.Y*stride+rect.Max.X] -
+			table[rect.Max.Y*stride+rect.Min.X] + table[rect.Min.Y*stride+rect.Min.X]
+	}
+
+	var histogram [entropyBins]int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			histogram[int(f.luminance[y*f.width+x])*entropyBins/256]++
+		}
+	}
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / area
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return edgeWeight*sum(f.edges)/area + entropyWeight*entropy/math.Log2(entropyBins) + skinWeight*sum(f.skin)/area
+}
+
+// isSkin applies a widely used RGB rule for skin tones in daylight.
+func isSkin(c color.NRGBA) bool {
+	r, g, b := int(c.R), int(c.G), int(c.B)
+	maximum := maxInt(r, maxInt(g, b))
+	minimum := r
+	if g < minimum {
+		minimum = g
+	}
+	if b < minimum {
+		minimum = b
+	}
+	difference := r - g
+	if difference < 0 {
+		difference = -difference
+	}
+	return c.A > 127 && r > 95 && g > 40 && b > 20 && maximum-minimum > 15 && difference > 15 && r > g && r > b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	// StreamErrorTrailer reports an error which interrupted a streamed
+	// image after its headers were sent, to clients accepting trailers.
+	StreamErrorTrailer = "X-Stream-Error"
+
+	// streamChunkSize bounds each write of a streamed image.
+	streamChunkSize = 32 << 10
+)
+
+// errStreamWrite is wrapped by errors writing a streamed image to the
+// client, as opposed to errors encoding it.
+var errStreamWrite = errors.New("writing the image failed")
+
+// Streaming reports whether the request asks for its image to be streamed,
+// with stream=true in the query string. Middleware which buffers responses
+// can use it to let streamed responses through.
+func Streaming(r *http.Request) bool {
+	stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+	return stream
+}
+
+// streamConversion sends the converted image as it's encoded instead of
+// buffering it. The image is prepared first, so errors caused by the upload
+// or options are still reported as problems. Stored images are saved once
+// they've been sent, with their Content-Location and Link headers sent as
+// trailers.
+func (h *Handler) streamConversion(w http.ResponseWriter, r *http.Request, file imageFile, options Options) {
+	upload := file.data
+	prepared, err := prepare(r.Context(), upload, options)
+	if err != nil {
+		problem.Write(w, r, ConversionProblem(err))
+		return
+	}
+	h.indexImage(r, upload, prepared.conversion)
+
+	for key, values := range conversionHeader(prepared.conversion) {
+		w.Header()[key] = values
+	}
+	trailers := []string{StreamErrorTrailer}
+	var stored *bytes.Buffer
+	if h.store != nil {
+		trailers = append(trailers, "Content-Location", "Link")
+		stored = new(bytes.Buffer)
+	}
+	w.Header().Set("Content-Type", prepared.conversion.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(file.name, prepared.conversion.ContentType))
+	w.Header().Set("Trailer", strings.Join(trailers, ", "))
+	w.WriteHeader(http.StatusOK)
+
+	sent := sendStream(w, r, func(output io.Writer) error {
+		if stored != nil {
+			output = io.MultiWriter(output, stored)
+		}
+		return prepared.write(output)
+	})
+	if sent && stored != nil {
+		h.storeImages(r, w.Header(), upload, stored.Bytes())
+	}
+}
+
+// sendStream runs write on its own goroutine, writing into a pipe which
+// the response is copied from, and reports whether everything was sent.
+// The headers must already have been written, declaring the
+// StreamErrorTrailer.
+//
+// An error from write is reported in the StreamErrorTrailer when the
+// client accepts trailers. Otherwise the connection is aborted, so a
+// truncated image isn't mistaken for a whole one.
+func sendStream(w http.ResponseWriter, r *http.Request, write func(io.Writer) error) bool {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(write(writer))
+	}()
+	err := copyFlushing(w, r, reader)
+	// Stops write if the copy ended early
+	reader.CloseWithError(err)
+
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errStreamWrite):
+		// The client is gone, so there's no one to tell
+		return false
+	case acceptsTrailers(r):
+		w.Header().Set(StreamErrorTrailer, err.Error())
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Error occurred while streaming image for request %s: %s\n", problem.RequestID(w, r), err.Error())
+	panic(http.ErrAbortHandler)
+}
+
+// copyFlushing copies the encoded image to the response, flushing after
+// every chunk so it reaches the client as it's encoded. It stops when the
+// request's context is done.
+func copyFlushing(w http.ResponseWriter, r *http.Request, reader io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, streamChunkSize)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				return fmt.Errorf("%w: %s", errStreamWrite, err.Error())
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// acceptsTrailers reports whether the client can receive trailers, which
+// HTTP/2 always supports and HTTP/1.1 clients announce with TE.
+func acceptsTrailers(r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	for _, value := range strings.Split(r.Header.Get("TE"), ",") {
+		if name, _, _ := strings.Cut(strings.TrimSpace(value), ";"); strings.EqualFold(name, "trailers") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,473 @@
+package images
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidOperation is wrapped by errors caused by a transformation the
+// pipeline can't apply.
+var ErrInvalidOperation = errors.New("invalid operation")
+
+const (
+	OpCrop       = "crop"
+	OpRotate     = "rotate"
+	OpFlip       = "flip"
+	OpGrayscale  = "grayscale"
+	OpBrightness = "brightness"
+	OpContrast   = "contrast"
+	OpBlur       = "blur"
+	OpSharpen    = "sharpen"
+	OpPad        = "pad"
+
+	// MaxOperations bounds the length of a pipeline.
+	MaxOperations = 20
+	// MaxOperationPixels bounds the pixels of the image each operation
+	// produces, since repeated pads can grow a small upload into a huge
+	// image.
+	MaxOperationPixels = 64 << 20
+	maxBlurSigma       = 50
+	maxSharpen         = 10
+	maxPadding         = 1000
+	// maxBlurSamples bounds the pixels read by a blur or sharpen, which
+	// grow with the image and the blur's radius.
+	maxBlurSamples = 1 << 30
+	// blurCheckRows is how many rows a blur convolves between checks of
+	// its context.
+	blurCheckRows = 64
+	// sharpenSigma is the blur subtracted by sharpen.
+	sharpenSigma = 1
+)
+
+// Operation is one step of a transformation pipeline. Only the fields used
+// by Op are read.
+type Operation struct {
+	Op string `json:"op"`
+	// X, Y, Width and Height are the rectangle kept by crop.
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Angle is the clockwise rotation in degrees: 90, 180 or 270.
+	Angle int `json:"angle,omitempty"`
+	// Direction is horizontal or vertical for flip.
+	Direction string `json:"direction,omitempty"`
+	// Amount is the percentage from -100 to 100 for brightness and
+	// contrast, and the strength from 0 to 10 for sharpen.
+	Amount float64 `json:"amount,omitempty"`
+	// Sigma is the standard deviation of blur in pixels.
+	Sigma float64 `json:"sigma,omitempty"`
+	// Padding is the number of pixels pad adds to every side, filled with
+	// Color, a hex RRGGBB or RRGGBBAA color which is white by default.
+	Padding int    `json:"padding,omitempty"`
+	Color   string `json:"color,omitempty"`
+}
+
+// Validate checks the operation's parameters before any image is decoded.
+func (o Operation) Validate() error {
+	switch o.Op {
+	case OpCrop:
+		if o.Width <= 0 || o.Height <= 0 || o.X < 0 || o.Y < 0 {
+			return o.invalid("x and y must not be negative, and width and height must be positive")
+		}
+	case OpRotate:
+		if o.Angle != 90 && o.Angle != 180 && o.Angle != 270 {
+			return o.invalid("angle must be 90, 180 or 270")
+		}
+	case OpFlip:
+		if o.Direction != "horizontal" && o.Direction != "vertical" {
+			return o.invalid("direction must be horizontal or vertical")
+		}
+	case OpGrayscale:
+	case OpBrightness, OpContrast:
+		if o.Amount < -100 || o.Amount > 100 {
+			return o.invalid("amount must be between -100 and 100")
+		}
+	case OpBlur:
+		if o.Sigma <= 0 || o.Sigma > maxBlurSigma {
+			return o.invalid(fmt.Sprintf("sigma must be greater than 0 and at most %d", maxBlurSigma))
+		}
+	case OpSharpen:
+		if o.Amount <= 0 || o.Amount > maxSharpen {
+			return o.invalid(fmt.Sprintf("amount must be greater than 0 and at most %d", maxSharpen))
+		}
+	case OpPad:
+		if o.Padding <= 0 || o.Padding > maxPadding {
+			return o.invalid(fmt.Sprintf("padding must be between 1 and %d", maxPadding))
+		}
+		if _, err := parseColor(o.Color); err != nil {
+			return o.invalid(err.Error())
+		}
+	default:
+		return fmt.Errorf("%w: unknown operation %q", ErrInvalidOperation, o.Op)
+	}
+	return nil
+}
+
+// checkSize checks that applying the operation to an image with the bounds
+// stays within MaxOperationPixels and maxBlurSamples.
+func (o Operation) checkSize(bounds image.Rectangle) error {
+	width, height := int64(bounds.Dx()), int64(bounds.Dy())
+	switch o.Op {
+	case OpPad:
+		width, height = width+2*int64(o.Padding), height+2*int64(o.Padding)
+		if width*height > MaxOperationPixels {
+			return o.invalid(fmt.Sprintf("the padded %dx%d image exceeds the limit of %d pixels", width, height, MaxOperationPixels))
+		}
+	case OpBlur, OpSharpen:
+		sigma := o.Sigma
+		if o.Op == OpSharpen {
+			sigma = sharpenSigma
+		}
+		if width*height*int64(2*blurRadius(sigma)+1) > maxBlurSamples {
+			return o.invalid(fmt.Sprintf("the blur is too large for a %dx%d image", width, height))
+		}
+	}
+	return nil
+}
+
+func (o Operation) invalid(reason string) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidOperation, o.Op, reason)
+}
+
+// Apply runs the operation, returning a new image.
+func (o Operation) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	switch o.Op {
+	case OpCrop:
+		return crop(img, o.X, o.Y, o.Width, o.Height)
+	case OpRotate:
+		return rotate(img, o.Angle), nil
+	case OpFlip:
+		return flip(img, o.Direction == "horizontal"), nil
+	case OpGrayscale:
+		return mapColors(img, func(c color.NRGBA) color.NRGBA {
+			y := clampUint8(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B))
+			return color.NRGBA{y, y, y, c.A}
+		}), nil
+	case OpBrightness:
+		offset := 255 * o.Amount / 100
+		return mapChannels(img, func(v float64) float64 { return v + offset }), nil
+	case OpContrast:
+		factor := (100 + o.Amount) / 100
+		return mapChannels(img, func(v float64) float64 { return (v-128)*factor + 128 }), nil
+	case OpBlur:
+		return blur(ctx, toNRGBA(img), o.Sigma)
+	case OpSharpen:
+		return sharpen(ctx, toNRGBA(img), o.Amount)
+	case OpPad:
+		background, _ := parseColor(o.Color)
+		return pad(img, o.Padding, background), nil
+	}
+	return nil, o.Validate()
+}
+
+// ValidateOperations checks every operation of a pipeline.
+func ValidateOperations(operations []Operation) error {
+	if len(operations) > MaxOperations {
+		return fmt.Errorf("%w: at most %d operations may be applied", ErrInvalidOperation, MaxOperations)
+	}
+	for _, operation := range operations {
+		if err := operation.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyOperations runs the pipeline in order, checking that each operation
+// stays within MaxOperationPixels before applying it. It stops with the
+// context's error once the context is done.
+func ApplyOperations(ctx context.Context, img image.Image, operations []Operation) (image.Image, error) {
+	for _, operation := range operations {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := operation.checkSize(img.Bounds()); err != nil {
+			return nil, err
+		}
+		var err error
+		if img, err = operation.Apply(ctx, img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// ParseOperations reads a pipeline from repeated op query parameters, such
+// as op=crop:0,0,100,100&op=rotate:90&op=grayscale, in the order given.
+func ParseOperations(query url.Values) ([]Operation, error) {
+	var operations []Operation
+	for _, value := range query["op"] {
+		name, args, _ := strings.Cut(value, ":")
+		operation, err := parseOperation(name, strings.Split(args, ","))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidOperation, value, err.Error())
+		}
+		operations = append(operations, operation)
+	}
+	return operations, ValidateOperations(operations)
+}
+
+func parseOperation(name string, args []string) (Operation, error) {
+	operation := Operation{Op: name}
+	if len(args) == 1 && args[0] == "" {
+		args = nil
+	}
+	expectArgs := func(min int, max int) error {
+		if len(args) < min || len(args) > max {
+			return fmt.Errorf("expected between %d and %d arguments, received %d", min, max, len(args))
+		}
+		return nil
+	}
+
+	var err error
+	switch name {
+	case OpCrop:
+		if err = expectArgs(4, 4); err != nil {
+			return operation, err
+		}
+		var values [4]int
+		for i, arg := range args {
+			if values[i], err = strconv.Atoi(arg); err != nil {
+				return operation, err
+			}
+		}
+		operation.X, operation.Y, operation.Width, operation.Height = values[0], values[1], values[2], values[3]
+	case OpRotate:
+		if err = expectArgs(1, 1); err == nil {
+			operation.Angle, err = strconv.Atoi(args[0])
+		}
+	case OpFlip:
+		if err = expectArgs(1, 1); err == nil {
+			operation.Direction = args[0]
+		}
+	case OpGrayscale:
+		err = expectArgs(0, 0)
+	case OpBrightness, OpContrast, OpSharpen:
+		if err = expectArgs(1, 1); err == nil {
+			operation.Amount, err = strconv.ParseFloat(args[0], 64)
+		}
+	case OpBlur:
+		if err = expectArgs(1, 1); err == nil {
+			operation.Sigma, err = strconv.ParseFloat(args[0], 64)
+		}
+	case OpPad:
+		if err = expectArgs(1, 2); err == nil {
+			operation.Padding, err = strconv.Atoi(args[0])
+			if len(args) == 2 {
+				operation.Color = args[1]
+			}
+		}
+	default:
+		err = errors.New("unknown operation")
+	}
+	return operation, err
+}
+
+// parseColor reads a hex RRGGBB or RRGGBBAA color, defaulting to white.
+func parseColor(value string) (color.NRGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if value == "" {
+		return color.NRGBA{255, 255, 255, 255}, nil
+	}
+	channels, err := hex.DecodeString(value)
+	if err != nil || (len(channels) != 3 && len(channels) != 4) {
+		return color.NRGBA{}, fmt.Errorf("color %q must be RRGGBB or RRGGBBAA", value)
+	}
+	if len(channels) == 3 {
+		channels = append(channels, 255)
+	}
+	return color.NRGBA{channels[0], channels[1], channels[2], channels[3]}, nil
+}
+
+// toNRGBA copies the image into non-premultiplied pixels with bounds
+// starting at the origin, which every operation works on.
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	converted := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(converted, converted.Rect, img, bounds.Min, draw.Src)
+	return converted
+}
+
+func crop(img image.Image, x int, y int, width int, height int) (image.Image, error) {
+	bounds := img.Bounds()
+	rect := image.Rect(x, y, x+width, y+height).Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return nil, fmt.Errorf("%w: crop: the rectangle is outside the %dx%d image", ErrInvalidOperation, bounds.Dx(), bounds.Dy())
+	}
+	cropped := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Rect, img, rect.Min, draw.Src)
+	return cropped, nil
+}
+
+// rotate turns the image clockwise by a multiple of 90 degrees.
+func rotate(img image.Image, angle int) image.Image {
+	src := toNRGBA(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dstWidth, dstHeight := height, width
+	if angle == 180 {
+		dstWidth, dstHeight = width, height
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch angle {
+			case 90:
+				srcX, srcY = y, height-1-x
+			case 180:
+				srcX, srcY = width-1-x, height-1-y
+			case 270:
+				srcX, srcY = width-1-y, x
+			}
+			dst.SetNRGBA(x, y, src.NRGBAAt(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+func flip(img image.Image, horizontal bool) image.Image {
+	src := toNRGBA(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewNRGBA(src.Rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if horizontal {
+				dst.SetNRGBA(x, y, src.NRGBAAt(width-1-x, y))
+			} else {
+				dst.SetNRGBA(x, y, src.NRGBAAt(x, height-1-y))
+			}
+		}
+	}
+	return dst
+}
+
+func mapColors(img image.Image, mapColor func(color.NRGBA) color.NRGBA) image.Image {
+	dst := toNRGBA(img)
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			dst.SetNRGBA(x, y, mapColor(dst.NRGBAAt(x, y)))
+		}
+	}
+	return dst
+}
+
+// mapChannels applies the function to the red, green and blue channels,
+// leaving alpha unchanged.
+func mapChannels(img image.Image, mapChannel func(float64) float64) image.Image {
+	var table [256]uint8
+	for i := range table {
+		table[i] = clampUint8(mapChannel(float64(i)))
+	}
+	return mapColors(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{table[c.R], table[c.G], table[c.B], c.A}
+	})
+}
+
+// blur convolves the image with a gaussian kernel, horizontally and then
+// vertically, extending the edge pixels past the border. The context is
+// checked every blurCheckRows rows, so a wide blur stops soon after it's
+// done.
+func blur(ctx context.Context, src *image.NRGBA, sigma float64) (*image.NRGBA, error) {
+	radius := blurRadius(sigma)
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		offset := float64(i - radius)
+		kernel[i] = math.Exp(-offset * offset / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	convolve := func(src *image.NRGBA, dx int, dy int) (*image.NRGBA, error) {
+		dst := image.NewNRGBA(src.Rect)
+		for y := 0; y < height; y++ {
+			if y%blurCheckRows == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			for x := 0; x < width; x++ {
+				var channels [4]float64
+				for i, weight := range kernel {
+					sampleX := clampInt(x+(i-radius)*dx, 0, width-1)
+					sampleY := clampInt(y+(i-radius)*dy, 0, height-1)
+					offset := src.PixOffset(sampleX, sampleY)
+					for c := range channels {
+						channels[c] += weight * float64(src.Pix[offset+c])
+					}
+				}
+				offset := dst.PixOffset(x, y)
+				for c, value := range channels {
+					dst.Pix[offset+c] = clampUint8(value)
+				}
+			}
+		}
+		return dst, nil
+	}
+	horizontal, err := convolve(src, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return convolve(horizontal, 0, 1)
+}
+
+// blurRadius is the number of pixels on each side of the kernel for sigma.
+func blurRadius(sigma float64) int {
+	return int(math.Ceil(3 * sigma))
+}
+
+// sharpen applies an unsharp mask, adding the difference between the image
+// and a blurred copy scaled by the amount.
+func sharpen(ctx context.Context, src *image.NRGBA, amount float64) (*image.NRGBA, error) {
+	blurred, err := blur(ctx, src, sharpenSigma)
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewNRGBA(src.Rect)
+	for i := range src.Pix {
+		// Leave alpha unchanged
+		if i%4 == 3 {
+			dst.Pix[i] = src.Pix[i]
+			continue
+		}
+		value := float64(src.Pix[i])
+		dst.Pix[i] = clampUint8(value + amount*(value-float64(blurred.Pix[i])))
+	}
+	return dst, nil
+}
+
+func pad(img image.Image, padding int, background color.NRGBA) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*padding, bounds.Dy()+2*padding))
+	draw.Draw(dst, dst.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(padding, padding, padding+bounds.Dx(), padding+bounds.Dy()), img, bounds.Min, draw.Over)
+	return dst
+}
+
+func clampUint8(value float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(value))))
+}
+
+func clampInt(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
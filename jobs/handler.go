@@ -0,0 +1,148 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	ErrorMethodNotSupported = "Method not supported"
+	ErrorReadingUpload      = "Error while reading image"
+	ErrorUploadTooLarge     = "The image is too large"
+	ErrorInvalidCallback    = "The callback URL is not valid"
+	ErrorQueueFull          = "The job queue is full"
+	ErrorSavingJob          = "Error while saving the job"
+	ErrorJobNotFound        = "The job was not found"
+	ErrorJobNotFinished     = "The job has not finished"
+	ErrorJobFailed          = "The job failed"
+	ErrorLoadingJob         = "Error while loading the job"
+)
+
+// ServeHTTP serves the job API under any path containing /jobs:
+//
+//	POST .../jobs              queues the uploaded image and responds with 202
+//	GET  .../jobs/{id}         reports the job's state
+//	GET  .../jobs/{id}/result  responds with the converted image
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	rest := strings.Trim(path[strings.Index(path, "/jobs")+len("/jobs"):], "/")
+	segments := strings.Split(rest, "/")
+
+	switch {
+	case rest == "":
+		if r.Method != "POST" {
+			methodNotAllowed(w, r, "POST")
+			return
+		}
+		m.handleSubmit(w, r)
+	case len(segments) == 1:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, r, "GET, HEAD")
+			return
+		}
+		m.handleStatus(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "result":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w, r, "GET, HEAD")
+			return
+		}
+		m.handleResult(w, r, segments[0])
+	default:
+		problem.Write(w, r, problem.New(http.StatusNotFound, problem.CodeNotFound, ErrorJobNotFound))
+	}
+}
+
+func (m *Manager) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	defer body.Close()
+
+	upload, err := io.ReadAll(http.MaxBytesReader(w, body, m.maxUploadBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, problem.CodeTooLarge, ErrorUploadTooLarge).
+				WithDetail(fmt.Sprintf("images may be at most %d bytes", m.maxUploadBytes)))
+			return
+		}
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidImage, ErrorReadingUpload).WithDetail(err.Error()))
+		return
+	}
+
+	job, err := m.Submit(upload, r.URL.Query().Get("callback_url"))
+	switch {
+	case errors.Is(err, ErrNoCallback):
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorInvalidCallback).
+			WithDetail(err.Error()).
+			WithFieldErrors(problem.FieldError{Field: "callback_url", Message: err.Error()}))
+		return
+	case errors.Is(err, ErrQueueFull):
+		w.Header().Set("Retry-After", "1")
+		problem.Write(w, r, problem.New(http.StatusServiceUnavailable, problem.CodeOverloaded, ErrorQueueFull))
+		return
+	case err != nil:
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorSavingJob).WithDetail(err.Error()))
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimRight(r.URL.Path, "/")+"/"+job.ID)
+	writeJob(w, http.StatusAccepted, job)
+}
+
+func (m *Manager) handleStatus(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := m.Get(id)
+	if err != nil {
+		writeLoadError(w, r, err)
+		return
+	}
+	writeJob(w, http.StatusOK, job)
+}
+
+func (m *Manager) handleResult(w http.ResponseWriter, r *http.Request, id string) {
+	result, job, err := m.Result(id)
+	switch {
+	case errors.Is(err, ErrNotDone) && job.State == StateFailed:
+		problem.Write(w, r, problem.New(http.StatusConflict, problem.CodeJobFailed, ErrorJobFailed).WithDetail(job.Error))
+		return
+	case errors.Is(err, ErrNotDone):
+		w.Header().Set("Retry-After", "1")
+		problem.Write(w, r, problem.New(http.StatusConflict, problem.CodeJobNotFinished, ErrorJobNotFinished).
+			WithDetail("the job is "+string(job.State)))
+		return
+	case err != nil:
+		writeLoadError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(result))
+	w.Header().Set("Content-Length", fmt.Sprint(len(result)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(result)
+	}
+}
+
+func writeLoadError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNotFound) {
+		problem.Write(w, r, problem.New(http.StatusNotFound, problem.CodeNotFound, ErrorJobNotFound))
+		return
+	}
+	problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorLoadingJob).WithDetail(err.Error()))
+}
+
+func writeJob(w http.ResponseWriter, statusCode int, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(job)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
+}
@@ -0,0 +1,343 @@
+// Package jobs converts images asynchronously. Uploads are persisted to a
+// local directory and processed by background workers, so queued jobs
+// survive restarts, and results are kept until their TTL expires.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle stage of a job.
+type State string
+
+const (
+	StateQueued  State = "queued"
+	StateRunning State = "running"
+	StateDone    State = "done"
+	StateFailed  State = "failed"
+)
+
+var (
+	ErrNotFound   = errors.New("job not found")
+	ErrNotDone    = errors.New("job has not finished")
+	ErrQueueFull  = errors.New("the job queue is full")
+	ErrNoCallback = errors.New("callback URLs must be absolute http or https URLs")
+)
+
+// Job describes an asynchronous conversion.
+type Job struct {
+	ID          string    `json:"id"`
+	State       State     `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	CallbackURL string    `json:"callback_url,omitempty"`
+	CreatedOn   time.Time `json:"created_on"`
+	UpdatedOn   time.Time `json:"updated_on"`
+	// ExpiresOn is when the job and its result will be deleted, set once
+	// the job has finished.
+	ExpiresOn *time.Time `json:"expires_on,omitempty"`
+}
+
+func (j *Job) finished() bool {
+	return j.State == StateDone || j.State == StateFailed
+}
+
+// ConvertFunc converts an upload into the job's result.
+type ConvertFunc func(upload []byte) ([]byte, error)
+
+// Manager queues jobs, runs them on background workers and expires their
+// results.
+type Manager struct {
+	store          *Store
+	convert        ConvertFunc
+	notifier       *Notifier
+	workers        int
+	maxQueue       int
+	maxUploadBytes int64
+	ttl            time.Duration
+	now            func() time.Time
+
+	mu      sync.Mutex
+	pending []string
+	wake    chan struct{}
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithWorkers sets how many jobs run at once.
+func WithWorkers(workers int) Option {
+	return func(m *Manager) {
+		m.workers = workers
+	}
+}
+
+// WithMaxQueue sets how many jobs may wait before submissions are rejected.
+func WithMaxQueue(maxQueue int) Option {
+	return func(m *Manager) {
+		m.maxQueue = maxQueue
+	}
+}
+
+// WithMaxUploadBytes bounds the size of an uploaded image.
+func WithMaxUploadBytes(maxUploadBytes int64) Option {
+	return func(m *Manager) {
+		m.maxUploadBytes = maxUploadBytes
+	}
+}
+
+// WithTTL sets how long finished jobs and their results are kept.
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.ttl = ttl
+	}
+}
+
+// WithNotifier overrides how callback URLs are notified.
+func WithNotifier(notifier *Notifier) Option {
+	return func(m *Manager) {
+		m.notifier = notifier
+	}
+}
+
+// NewManager creates a manager persisting jobs to dir. Jobs which were
+// queued or running when the process last stopped are queued again.
+func NewManager(dir string, convert ConvertFunc, options ...Option) (*Manager, error) {
+	store, err := NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		store:          store,
+		convert:        convert,
+		notifier:       NewNotifier(false),
+		workers:        1,
+		maxQueue:       100,
+		maxUploadBytes: 32 << 20,
+		ttl:            24 * time.Hour,
+		now:            time.Now,
+		wake:           make(chan struct{}, 1),
+	}
+	for _, option := range options {
+		option(m)
+	}
+
+	jobs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedOn.Before(jobs[j].CreatedOn) })
+	for _, job := range jobs {
+		if job.finished() {
+			continue
+		}
+		job.State = StateQueued
+		if err := store.SaveJob(job); err != nil {
+			return nil, err
+		}
+		m.pending = append(m.pending, job.ID)
+	}
+
+	return m, nil
+}
+
+// Start runs the workers and the expiry sweeper until the context ends.
+func (m *Manager) Start(ctx context.Context) {
+	for i := 0; i < m.workers; i++ {
+		go m.work(ctx)
+	}
+	go m.sweep(ctx)
+	m.signal()
+}
+
+// Submit persists the upload and queues a job to convert it.
+func (m *Manager) Submit(upload []byte, callbackURL string) (*Job, error) {
+	if callbackURL != "" && !validCallbackURL(callbackURL) {
+		return nil, ErrNoCallback
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) >= m.maxQueue {
+		return nil, ErrQueueFull
+	}
+
+	now := m.now()
+	job := &Job{
+		ID:          newJobID(),
+		State:       StateQueued,
+		CallbackURL: callbackURL,
+		CreatedOn:   now,
+		UpdatedOn:   now,
+	}
+	if err := m.store.SaveUpload(job.ID, upload); err != nil {
+		return nil, err
+	}
+	if err := m.store.SaveJob(job); err != nil {
+		m.store.Delete(job.ID)
+		return nil, err
+	}
+
+	m.pending = append(m.pending, job.ID)
+	m.signal()
+	return job, nil
+}
+
+// Get returns the job with the given ID.
+func (m *Manager) Get(id string) (*Job, error) {
+	job, err := m.store.LoadJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.expired(job) {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+// Result returns the output of a finished job.
+func (m *Manager) Result(id string) ([]byte, *Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.State != StateDone {
+		return nil, job, ErrNotDone
+	}
+	result, err := m.store.LoadResult(id)
+	return result, job, err
+}
+
+func (m *Manager) work(ctx context.Context) {
+	for {
+		id, ok := m.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+				continue
+			}
+		}
+		m.run(id)
+	}
+}
+
+func (m *Manager) next() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return "", false
+	}
+	id := m.pending[0]
+	m.pending = m.pending[1:]
+	if len(m.pending) > 0 {
+		m.signal()
+	}
+	return id, true
+}
+
+func (m *Manager) run(id string) {
+	job, err := m.store.LoadJob(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while loading job %s: %s\n", id, err.Error())
+		return
+	}
+	job.State = StateRunning
+	job.UpdatedOn = m.now()
+	if err := m.store.SaveJob(job); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while saving job %s: %s\n", id, err.Error())
+	}
+
+	result, err := m.process(id)
+	if err == nil {
+		err = m.store.SaveResult(id, result)
+	}
+
+	now := m.now()
+	expiresOn := now.Add(m.ttl)
+	job.State = StateDone
+	job.UpdatedOn = now
+	job.ExpiresOn = &expiresOn
+	if err != nil {
+		job.State = StateFailed
+		job.Error = err.Error()
+	}
+	if err := m.store.SaveJob(job); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while saving job %s: %s\n", id, err.Error())
+	}
+	// The upload is no longer needed once the job has finished
+	m.store.DeleteUpload(id)
+
+	if job.CallbackURL != "" {
+		go m.notifier.Notify(context.Background(), job)
+	}
+}
+
+// process converts the job's upload, turning panics into failures so that
+// one bad image can't take down a worker.
+func (m *Manager) process(id string) (result []byte, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("conversion panicked: %v", recovered)
+		}
+	}()
+
+	upload, err := m.store.LoadUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.convert(upload)
+}
+
+func (m *Manager) sweep(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		m.deleteExpired()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) deleteExpired() {
+	jobs, err := m.store.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while listing jobs: %s\n", err.Error())
+		return
+	}
+	for _, job := range jobs {
+		if m.expired(job) {
+			m.store.Delete(job.ID)
+		}
+	}
+}
+
+func (m *Manager) expired(job *Job) bool {
+	return job.ExpiresOn != nil && !m.now().Before(*job.ExpiresOn)
+}
+
+// signal wakes a worker without blocking if one is already being woken.
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
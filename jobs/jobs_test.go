@@ -0,0 +1,289 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elehner/takehomeserver/netguard"
+)
+
+func reverse(upload []byte) ([]byte, error) {
+	if len(upload) == 0 {
+		return nil, errors.New("empty upload")
+	}
+	result := make([]byte, len(upload))
+	for i, b := range upload {
+		result[len(upload)-1-i] = b
+	}
+	return result, nil
+}
+
+// waitForState polls until the job reaches the state, failing after a second.
+func waitForState(t *testing.T, m *Manager, id string, state State) *Job {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(id)
+		if err == nil && job.State == state {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Job %s never reached the %s state", id, state)
+	return nil
+}
+
+func TestManagerRunsJobs(t *testing.T) {
+	m, err := NewManager(t.TempDir(), reverse)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+
+	tests := []struct {
+		upload         string
+		expectedState  State
+		expectedResult string
+	}{
+		{"abc", StateDone, "cba"},
+		{"", StateFailed, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Submit=%d", i), func(t *testing.T) {
+			job, err := m.Submit([]byte(test.upload), "")
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			job = waitForState(t, m, job.ID, test.expectedState)
+			if job.ExpiresOn == nil {
+				t.Error("Expected finished jobs to expire")
+			}
+
+			result, _, err := m.Result(job.ID)
+			if test.expectedState == StateDone && (err != nil || string(result) != test.expectedResult) {
+				t.Errorf("Result was %q (%v), expected %q", result, err, test.expectedResult)
+			}
+			if test.expectedState == StateFailed && (!errors.Is(err, ErrNotDone) || job.Error == "") {
+				t.Errorf("Expected the failed job to report its error, received %v", err)
+			}
+		})
+	}
+}
+
+func TestManagerRequeuesJobsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	stopped, err := NewManager(dir, reverse)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Never started, as though the process stopped before running the job
+	job, err := stopped.Submit([]byte("abc"), "")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	restarted, err := NewManager(dir, reverse)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted.Start(ctx)
+
+	waitForState(t, restarted, job.ID, StateDone)
+}
+
+func TestManagerExpiresJobs(t *testing.T) {
+	now := time.Unix(1642612034, 0)
+	m, err := NewManager(t.TempDir(), reverse, WithTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	m.now = func() time.Time { return now }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+
+	job, err := m.Submit([]byte("abc"), "")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	waitForState(t, m, job.ID, StateDone)
+
+	m.now = func() time.Time { return now.Add(time.Hour) }
+	if _, err := m.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the expired job to be gone, received %v", err)
+	}
+	m.deleteExpired()
+	if _, err := m.store.LoadJob(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the expired job to be deleted, received %v", err)
+	}
+}
+
+func TestManagerRejectsFullQueue(t *testing.T) {
+	m, err := NewManager(t.TempDir(), reverse, WithMaxQueue(1))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if _, err := m.Submit([]byte("abc"), ""); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := m.Submit([]byte("abc"), ""); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected %v, received %v", ErrQueueFull, err)
+	}
+}
+
+func TestManagerNotifiesCallback(t *testing.T) {
+	notified := make(chan Job, 1)
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// Fail the first attempt to check it's retried
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var job Job
+		json.NewDecoder(r.Body).Decode(&job)
+		notified <- job
+	}))
+	defer callback.Close()
+
+	notifier := NewNotifier(true)
+	notifier.backoff = time.Millisecond
+	m, err := NewManager(t.TempDir(), reverse, WithNotifier(notifier))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+
+	if _, err := m.Submit([]byte("abc"), "ftp://example.com/callback"); !errors.Is(err, ErrNoCallback) {
+		t.Errorf("Expected %v, received %v", ErrNoCallback, err)
+	}
+	job, err := m.Submit([]byte("abc"), callback.URL)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	select {
+	case received := <-notified:
+		if received.ID != job.ID || received.State != StateDone {
+			t.Errorf("Received: %+v, expected job %s to be done", received, job.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The callback was never notified")
+	}
+}
+
+func TestNotifierBlocksInternalAddresses(t *testing.T) {
+	called := false
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer callback.Close()
+
+	notifier := NewNotifier(false)
+	notifier.backoff = time.Millisecond
+	err := notifier.Notify(context.Background(), &Job{ID: "blocked", CallbackURL: callback.URL})
+	if !errors.Is(err, netguard.ErrBlocked) {
+		t.Errorf("Expected %v, received %v", netguard.ErrBlocked, err)
+	}
+	if called {
+		t.Error("Expected the loopback callback not to be called")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m, err := NewManager(t.TempDir(), reverse, WithMaxUploadBytes(8))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/v2/image/jobs", "abc")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code to be %d, but was %d", http.StatusAccepted, w.Code)
+	}
+	var job Job
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if w.Header().Get("Location") != "/v2/image/jobs/"+job.ID {
+		t.Errorf("Location was %s, expected /v2/image/jobs/%s", w.Header().Get("Location"), job.ID)
+	}
+	waitForState(t, m, job.ID, StateDone)
+
+	tests := []struct {
+		method               string
+		path                 string
+		body                 string
+		expectedResponseCode int
+		expectedBody         string
+	}{
+		{"GET", "/v2/image/jobs/" + job.ID + "/result", "", http.StatusOK, "cba"},
+		{"GET", "/v2/image/jobs/" + job.ID, "", http.StatusOK, ""},
+		{"GET", "/v2/image/jobs/0123456789abcdef0123456789abcdef", "", http.StatusNotFound, ""},
+		// IDs can't be used to escape the store's directory
+		{"GET", "/v2/image/jobs/..%2F..%2Fetc%2Fpasswd", "", http.StatusNotFound, ""},
+		{"GET", "/v2/image/jobs/" + job.ID + "/other", "", http.StatusNotFound, ""},
+		{"POST", "/v2/image/jobs?callback_url=not-a-url", "abc", http.StatusBadRequest, ""},
+		{"POST", "/v2/image/jobs", "more than eight bytes", http.StatusRequestEntityTooLarge, ""},
+		{"GET", "/v2/image/jobs", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/v2/image/jobs/" + job.ID, "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s %s=%d", test.method, test.path, i), func(t *testing.T) {
+			w := serve(test.method, test.path, test.body)
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if test.expectedBody != "" && !bytes.Equal(w.Body.Bytes(), []byte(test.expectedBody)) {
+				t.Errorf("Body was %s, expected %s", w.Body.String(), test.expectedBody)
+			}
+		})
+	}
+}
+
+func TestHandlerResultBeforeDone(t *testing.T) {
+	// Never started, so the job stays queued
+	m, err := NewManager(t.TempDir(), reverse)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	job, err := m.Submit([]byte("abc"), "")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/image/jobs/"+job.ID+"/result", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusConflict, w.Code)
+	}
+}
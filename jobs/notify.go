@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/elehner/takehomeserver/netguard"
+)
+
+// Notifier POSTs a finished job to its callback URL, retrying with
+// exponential backoff when the callback fails.
+type Notifier struct {
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+// NewNotifier creates a Notifier. Unless allowPrivateNetworks is set,
+// callbacks to loopback, private and other internal addresses are refused
+// once their host is resolved, including after redirects, so clients can't
+// use callbacks to reach the server's own network.
+func NewNotifier(allowPrivateNetworks bool) *Notifier {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivateNetworks {
+		dialer.Control = netguard.Control
+	}
+	return &Notifier{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// Proxies are ignored, since the address check must see the
+			// address actually connected to
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		attempts: 3,
+		backoff:  time.Second,
+	}
+}
+
+// Notify sends the job as JSON to its callback URL, returning the last
+// error if every attempt failed.
+func (n *Notifier) Notify(ctx context.Context, job *Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, job.CallbackURL, body)
+		if err == nil {
+			return nil
+		}
+		if attempt >= n.attempts {
+			fmt.Fprintf(os.Stderr, "Error occurred while notifying the callback for job %s: %s\n", job.ID, err.Error())
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, callbackURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func validCallbackURL(callbackURL string) bool {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
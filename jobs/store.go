@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validID matches the IDs generated by newJobID, so that IDs taken from
+// request paths can't escape the store's directory.
+var validID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Store persists jobs as files in a local directory: <id>.json holds the
+// job, <id>.upload the image to convert and <id>.result the output.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) SaveJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.write(job.ID, ".json", data)
+}
+
+func (s *Store) LoadJob(id string) (*Job, error) {
+	data, err := s.read(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *Store) SaveUpload(id string, upload []byte) error {
+	return s.write(id, ".upload", upload)
+}
+
+func (s *Store) LoadUpload(id string) ([]byte, error) {
+	return s.read(id, ".upload")
+}
+
+func (s *Store) DeleteUpload(id string) {
+	os.Remove(s.path(id, ".upload"))
+}
+
+func (s *Store) SaveResult(id string, result []byte) error {
+	return s.write(id, ".result", result)
+}
+
+func (s *Store) LoadResult(id string) ([]byte, error) {
+	return s.read(id, ".result")
+}
+
+// Delete removes every file belonging to the job.
+func (s *Store) Delete(id string) {
+	for _, extension := range []string{".upload", ".result", ".json"} {
+		os.Remove(s.path(id, extension))
+	}
+}
+
+// List loads every job in the store, skipping files which can't be parsed.
+func (s *Store) List() ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || id == entry.Name() || !validID.MatchString(id) {
+			continue
+		}
+		job, err := s.LoadJob(id)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *Store) path(id string, extension string) string {
+	return filepath.Join(s.dir, id+extension)
+}
+
+func (s *Store) read(id string, extension string) ([]byte, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(s.path(id, extension))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// write replaces the file atomically, so a crash can't leave a partial job.
+func (s *Store) write(id string, extension string, data []byte) error {
+	temp, err := os.CreateTemp(s.dir, id+extension+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path(id, extension))
+}
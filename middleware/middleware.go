@@ -0,0 +1,19 @@
+// Package middleware provides composable http.Handler wrappers for
+// behavior shared by every route, such as panic recovery and compression.
+package middleware
+
+import "net/http"
+
+// Middleware wraps a handler with additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes middlewares so that the first one given is the outermost,
+// i.e. Chain(a, b)(h) is equivalent to a(b(h)).
+func Chain(middlewares ...Middleware) Middleware {
+	return func(handler http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			handler = middlewares[i](handler)
+		}
+		return handler
+	}
+}
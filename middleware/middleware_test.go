@@ -0,0 +1,336 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := Chain(record("first"), record("second"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:8080", nil))
+
+	if strings.Join(order, ",") != "first,second,handler" {
+		t.Errorf("Order was %v, expected [first second handler]", order)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		accept               string
+		expectedContentType  string
+		expectedBodyContains string
+	}{
+		{"", "text/plain; charset=utf-8", ErrorInternal},
+		{"application/problem+json", "application/problem+json", `"code":"internal_error"`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Recover=%d", i), func(t *testing.T) {
+			handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("something went wrong")
+			}))
+			req := httptest.NewRequest("GET", "http://localhost:8080", nil)
+			req.Header.Set("Accept", test.accept)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusInternalServerError, w.Code)
+			}
+			if w.Header().Get("Content-Type") != test.expectedContentType {
+				t.Errorf("Content-Type was %s, expected %s", w.Header().Get("Content-Type"), test.expectedContentType)
+			}
+			if !strings.Contains(w.Body.String(), test.expectedBodyContains) {
+				t.Errorf("Body was %s, expected it to contain %s", w.Body.String(), test.expectedBodyContains)
+			}
+		})
+	}
+}
+
+func TestRecoverRepanicsOnAbort(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Expected ErrAbortHandler to be re-panicked, received %v", recovered)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:8080", nil))
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`{"user_id":1,"name":"Joe Smith"}`, 100)
+	pngHeader := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+
+	tests := []struct {
+		acceptEncoding   string
+		contentType      string
+		body             string
+		expectedEncoding string
+	}{
+		{"", "application/json", body, ""},
+		{"gzip", "application/json", body, "gzip"},
+		{"br", "application/json", body, "br"},
+		{"gzip, deflate, br", "application/json", body, "br"},
+		{"gzip;q=1.0, br;q=0.5", "application/json", body, "gzip"},
+		{"br;q=0, gzip", "application/json", body, "gzip"},
+		{"identity", "application/json", body, ""},
+		// Images are already compressed
+		{"gzip", "image/png", pngHeader, ""},
+		// The content type is sniffed when the handler doesn't set one
+		{"gzip", "", pngHeader, ""},
+		{"gzip", "", body, "gzip"},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Compress=%d", i), func(t *testing.T) {
+			handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				io.WriteString(w, test.body)
+			}))
+			req := httptest.NewRequest("GET", "http://localhost:8080", nil)
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Header().Get("Content-Encoding") != test.expectedEncoding {
+				t.Errorf("Content-Encoding was %q, expected %q", w.Header().Get("Content-Encoding"), test.expectedEncoding)
+			}
+			var reader io.Reader = w.Body
+			switch test.expectedEncoding {
+			case "gzip":
+				gzipReader, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				reader = gzipReader
+			case "br":
+				reader = brotli.NewReader(w.Body)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if string(decoded) != test.body {
+				t.Errorf("Decoded body differed from the original")
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		config                 CORSConfig
+		method                 string
+		origin                 string
+		requestMethod          string
+		expectedResponseCode   int
+		expectedAllowOrigin    string
+		expectedAllowMethods   string
+		expectedHandlerCalled  bool
+		expectedAllowsCookies  bool
+		expectedExposedHeaders string
+	}{
+		// Requests without an origin are not cross-origin
+		{CORSConfig{AllowedOrigins: []string{"*"}}, "GET", "", "", http.StatusOK, "", "", true, false, ""},
+		{CORSConfig{AllowedOrigins: []string{"*"}}, "GET", "https://example.com", "", http.StatusOK, "*", "", true, false, ""},
+		{
+			CORSConfig{AllowedOrigins: []string{"https://example.com"}, ExposedHeaders: []string{"X-Request-ID"}},
+			"POST", "https://example.com", "", http.StatusOK, "https://example.com", "", true, false, "X-Request-ID",
+		},
+		// Disallowed origins pass through without CORS headers
+		{CORSConfig{AllowedOrigins: []string{"https://example.com"}}, "GET", "https://evil.com", "", http.StatusOK, "", "", true, false, ""},
+		// Preflight requests are answered without calling the handler
+		{
+			CORSConfig{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{"POST"}},
+			"OPTIONS", "https://example.com", "POST", http.StatusNoContent, "https://example.com", "POST", false, false, "",
+		},
+		// Credentials require the origin to be echoed rather than a wildcard
+		{
+			CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			"GET", "https://example.com", "", http.StatusOK, "https://example.com", "", true, true, "",
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("CORS=%d", i), func(t *testing.T) {
+			handlerCalled := false
+			handler := CORS(test.config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerCalled = true
+			}))
+			req := httptest.NewRequest(test.method, "http://localhost:8080", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if test.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", test.requestMethod)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if handlerCalled != test.expectedHandlerCalled {
+				t.Errorf("Handler called was %t, expected %t", handlerCalled, test.expectedHandlerCalled)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != test.expectedAllowOrigin {
+				t.Errorf("Allowed origin was %q, expected %q", w.Header().Get("Access-Control-Allow-Origin"), test.expectedAllowOrigin)
+			}
+			if w.Header().Get("Access-Control-Allow-Methods") != test.expectedAllowMethods {
+				t.Errorf("Allowed methods were %q, expected %q", w.Header().Get("Access-Control-Allow-Methods"), test.expectedAllowMethods)
+			}
+			if (w.Header().Get("Access-Control-Allow-Credentials") == "true") != test.expectedAllowsCookies {
+				t.Errorf("Expected credentials to be allowed: %t", test.expectedAllowsCookies)
+			}
+			if w.Header().Get("Access-Control-Expose-Headers") != test.expectedExposedHeaders {
+				t.Errorf("Exposed headers were %q, expected %q", w.Header().Get("Access-Control-Expose-Headers"), test.expectedExposedHeaders)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		delay                time.Duration
+		expectedResponseCode int
+		expectedBody         string
+	}{
+		{0, http.StatusOK, "done"},
+		{time.Second, http.StatusServiceUnavailable, ErrorTimeout},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Timeout=%d", i), func(t *testing.T) {
+			handler := Timeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(test.delay):
+					io.WriteString(w, "done")
+				case <-r.Context().Done():
+				}
+			}))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080", nil))
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if w.Body.String() != test.expectedBody {
+				t.Errorf("Body was %s, expected %s", w.Body.String(), test.expectedBody)
+			}
+		})
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	var flushed, deadline bool
+	handler := ContextTimeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flushed = w.(http.Flusher)
+		_, deadline = r.Context().Deadline()
+		io.WriteString(w, "done")
+	}))
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080", nil))
+
+	if !flushed {
+		t.Errorf("Expected the response not to be buffered")
+	}
+	if !deadline {
+		t.Errorf("Expected the request to have a deadline")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStreamingTimeout(t *testing.T) {
+	isStreaming := func(r *http.Request) bool { return r.URL.Query().Get("stream") == "true" }
+	tests := []struct {
+		url            string
+		expectFlushed  bool
+		expectDeadline bool
+	}{
+		{"http://localhost:8080", false, true},
+		{"http://localhost:8080?stream=true", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			var flushed, deadline bool
+			handler := StreamingTimeout(time.Second, isStreaming)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, flushed = w.(http.Flusher)
+				_, deadline = r.Context().Deadline()
+				io.WriteString(w, "done")
+			}))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+
+			if flushed != test.expectFlushed {
+				t.Errorf("Expected the response to be flushable to be %t", test.expectFlushed)
+			}
+			if deadline != test.expectDeadline {
+				t.Errorf("Expected the request to have a deadline")
+			}
+			if w.Code != http.StatusOK || w.Body.String() != "done" {
+				t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := SecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, useTLS := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SecurityHeaders=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost:8080", bytes.NewReader(nil))
+			if useTLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			for _, name := range []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy", "Content-Security-Policy"} {
+				if w.Header().Get(name) == "" {
+					t.Errorf("Expected %s to be set", name)
+				}
+			}
+			if (w.Header().Get("Strict-Transport-Security") != "") != useTLS {
+				t.Errorf("Expected Strict-Transport-Security to be set only over TLS")
+			}
+		})
+	}
+}
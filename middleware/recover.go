@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const ErrorInternal = "Internal server error"
+
+// Recover converts panics in the wrapped handler into a 500 response, and
+// writes the panic along with its stack trace to stderr.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// ErrAbortHandler is the supported way to abort a response, so
+			// leave it for the server to handle
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			requestID := problem.RequestID(w, r)
+			fmt.Fprintf(os.Stderr, "Panic while serving %s %s (request %s): %v\n%s",
+				r.Method, r.URL.Path, requestID, recovered, debug.Stack())
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorInternal))
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const ErrorTimeout = "The request timed out"
+
+// Timeout cancels the request's context and responds with 503 if the
+// wrapped handler takes longer than the given duration. The response is
+// buffered until the handler returns, so it should not wrap streaming routes.
+func Timeout(duration time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, duration, ErrorTimeout)
+	}
+}
+
+// ContextTimeout cancels the request's context after the given duration,
+// leaving the wrapped handler to end the response. Unlike Timeout, the
+// response isn't buffered, so large or streamed responses are written as
+// they're produced.
+func ContextTimeout(duration time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), duration)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// StreamingTimeout is Timeout for routes which may stream their responses.
+// Requests which isStreaming reports as streamed are given a
+// ContextTimeout instead.
+func StreamingTimeout(duration time.Duration, isStreaming func(*http.Request) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		buffered := Timeout(duration)(next)
+		streamed := ContextTimeout(duration)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStreaming(r) {
+				streamed.ServeHTTP(w, r)
+			} else {
+				buffered.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Package netguard keeps requests the server makes on behalf of clients,
+// such as fetching images and notifying callbacks, from reaching the
+// machine itself or its internal networks.
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+)
+
+// ErrBlocked is wrapped by errors for connections to internal addresses.
+var ErrBlocked = errors.New("internal address blocked")
+
+// blockedPrefixes are the special purpose ranges, besides the loopback,
+// private, link local and multicast ranges, which are never connected to.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	// 6to4 and Teredo embed IPv4 addresses, which relays may forward to
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("2001::/32"),
+}
+
+// Internal reports whether the address belongs to the machine, a private
+// network or a special purpose range.
+func Internal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Control is a net.Dialer Control function rejecting internal addresses.
+// It runs before every connection, once the host has been resolved, so
+// neither DNS nor redirects can be used to reach them.
+func Control(network string, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlocked, err.Error())
+	}
+	if addr := addrPort.Addr().Unmap(); Internal(addr) {
+		return fmt.Errorf("%w: %s is an internal address", ErrBlocked, addr)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package netguard
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestInternal(t *testing.T) {
+	for address, expected := range map[string]bool{
+		"127.0.0.1":          true,
+		"10.1.2.3":           true,
+		"172.16.0.1":         true,
+		"192.168.1.1":        true,
+		"169.254.169.254":    true,
+		"100.64.0.1":         true,
+		"0.0.0.0":            true,
+		"::1":                true,
+		"fd00::1":            true,
+		"fe80::1":            true,
+		"::ffff:127.0.0.1":   true,
+		"64:ff9b::a00:1":     true,
+		"2002:7f00:1::1":     true,
+		"2001:0:4136:e378::": true,
+		"93.184.216.34":      false,
+		"2606:4700:4700::64": false,
+	} {
+		if Internal(netip.MustParseAddr(address)) != expected {
+			t.Errorf("Expected Internal(%s) to be %t", address, expected)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	for address, expected := range map[string]error{
+		"127.0.0.1:80":         ErrBlocked,
+		"[::ffff:10.0.0.1]:80": ErrBlocked,
+		"localhost:80":         ErrBlocked,
+		"93.184.216.34:443":    nil,
+	} {
+		if err := Control("tcp", address, nil); !errors.Is(err, expected) {
+			t.Errorf("Expected Control(%s) to return %v, received %v", address, expected, err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package openapi serves the OpenAPI document describing the service, and
+// validates responses against it so the document can't drift from the handlers.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ErrorMethodNotSupported = "Only GET and HEAD are supported"
+
+//go:embed openapi.json
+var spec []byte
+
+// Schema is the subset of the OpenAPI schema object used by this service.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Nullable             bool               `json:"nullable"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type response struct {
+	Ref     string               `json:"$ref"`
+	Content map[string]mediaType `json:"content"`
+}
+
+type operation struct {
+	OperationID string               `json:"operationId"`
+	Deprecated  bool                 `json:"deprecated"`
+	Responses   map[string]*response `json:"responses"`
+}
+
+// pathItem holds the operations of a path by method, or a reference to
+// another path item, as used for aliases such as /v1/user.
+type pathItem struct {
+	Ref        string
+	Operations map[string]*operation
+}
+
+func (item *pathItem) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	item.Operations = make(map[string]*operation)
+	for name, value := range fields {
+		switch name {
+		case "$ref":
+			if err := json.Unmarshal(value, &item.Ref); err != nil {
+				return err
+			}
+		case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+			op := &operation{}
+			if err := json.Unmarshal(value, op); err != nil {
+				return err
+			}
+			item.Operations[name] = op
+		}
+	}
+	return nil
+}
+
+// Document is a parsed OpenAPI document.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Paths      map[string]*pathItem `json:"paths"`
+	Components struct {
+		Schemas   map[string]*Schema   `json:"schemas"`
+		Responses map[string]*response `json:"responses"`
+	} `json:"components"`
+}
+
+// Spec returns the raw OpenAPI document.
+func Spec() []byte {
+	return spec
+}
+
+// Load parses the embedded OpenAPI document.
+func Load() (*Document, error) {
+	var document Document
+	if err := json.Unmarshal(spec, &document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// HandleSpec responds with the OpenAPI document.
+func HandleSpec(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(spec)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(spec)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, ErrorMethodNotSupported, http.StatusMethodNotAllowed)
+	}
+}
+
+// ValidateResponse checks that a response to the given path and method is
+// described by the document: the status code must be documented, and JSON
+// bodies must match the schema given for their content type.
+func (d *Document) ValidateResponse(path string, method string, statusCode int, contentType string, body []byte) error {
+	item, err := d.pathItem(path)
+	if err != nil {
+		return err
+	}
+	op, ok := item.Operations[strings.ToLower(method)]
+	if !ok {
+		// Rejecting an undocumented method is always allowed
+		if statusCode == http.StatusMethodNotAllowed {
+			return nil
+		}
+		return fmt.Errorf("%s %s is not documented", method, path)
+	}
+	resp, ok := op.Responses[strconv.Itoa(statusCode)]
+	if !ok {
+		return fmt.Errorf("status %d is not documented for %s %s", statusCode, method, path)
+	}
+	if ref := resp.Ref; ref != "" {
+		resp, ok = d.Components.Responses[strings.TrimPrefix(ref, "#/components/responses/")]
+		if !ok {
+			return fmt.Errorf("unknown response reference %s", ref)
+		}
+	}
+
+	if len(resp.Content) == 0 {
+		if len(body) != 0 {
+			return fmt.Errorf("status %d for %s %s should not have a body", statusCode, method, path)
+		}
+		return nil
+	}
+
+	mediaTypeName, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	media, ok := resp.Content[mediaTypeName]
+	if !ok {
+		return fmt.Errorf("content type %s is not documented for status %d of %s %s", mediaTypeName, statusCode, method, path)
+	}
+	if media.Schema == nil || !strings.HasSuffix(mediaTypeName, "json") {
+		return nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return d.validate(media.Schema, value, "$")
+}
+
+// pathItem finds the documented path, following references to other paths.
+func (d *Document) pathItem(path string) (*pathItem, error) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item, ok = d.templatedPath(path)
+	}
+	if !ok {
+		return nil, fmt.Errorf("path %s is not documented", path)
+	}
+	for seen := 0; item.Ref != ""; seen++ {
+		if seen > len(d.Paths) {
+			return nil, fmt.Errorf("path %s has a circular reference", path)
+		}
+		referenced := strings.NewReplacer("~1", "/", "~0", "~").Replace(strings.TrimPrefix(item.Ref, "#/paths/"))
+		item, ok = d.Paths[referenced]
+		if !ok {
+			return nil, fmt.Errorf("path %s references unknown path %s", path, referenced)
+		}
+	}
+	return item, nil
+}
+
+// templatedPath finds a path with parameters, such as /image/jobs/{id},
+// matching the request path.
+func (d *Document) templatedPath(path string) (*pathItem, bool) {
+	segments := strings.Split(path, "/")
+	for template, item := range d.Paths {
+		templateSegments := strings.Split(template, "/")
+		if !strings.Contains(template, "{") || len(templateSegments) != len(segments) {
+			continue
+		}
+		matches := true
+		for index, templateSegment := range templateSegments {
+			isParameter := strings.HasPrefix(templateSegment, "{") && strings.HasSuffix(templateSegment, "}")
+			if !isParameter && templateSegment != segments[index] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// validate checks a decoded JSON value against a schema, returning the first
+// mismatch found. Location is the JSON path used in error messages.
+func (d *Document) validate(schema *Schema, value interface{}, location string) error {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		referenced, ok := d.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema reference %s", location, schema.Ref)
+		}
+		schema = referenced
+	}
+
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", location)
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", location, value, schema.Enum)
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", location)
+		}
+		return d.validateObject(schema, object, location)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", location)
+		}
+		if schema.Items == nil {
+			return nil
+		}
+		for index, item := range array {
+			if err := d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", location, index)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", location)
+		}
+		return validateFormat(schema.Format, str, location)
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: must be an integer", location)
+		}
+		if _, err := number.Int64(); err != nil {
+			return fmt.Errorf("%s: must be an integer", location)
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return fmt.Errorf("%s: must be a number", location)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", location)
+		}
+	}
+
+	return nil
+}
+
+func (d *Document) validateObject(schema *Schema, object map[string]interface{}, location string) error {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("%s: missing required property %s", location, name)
+		}
+	}
+
+	var additional *Schema
+	allowAdditional := true
+	if len(schema.AdditionalProperties) > 0 {
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowAdditional); err != nil {
+			allowAdditional = true
+			additional = &Schema{}
+			if err := json.Unmarshal(schema.AdditionalProperties, additional); err != nil {
+				return fmt.Errorf("%s: invalid additionalProperties: %w", location, err)
+			}
+		}
+	}
+
+	for name, propertyValue := range object {
+		propertyLocation := location + "." + name
+		if property, ok := schema.Properties[name]; ok {
+			if err := d.validate(property, propertyValue, propertyLocation); err != nil {
+				return err
+			}
+			continue
+		}
+		if !allowAdditional {
+			return fmt.Errorf("%s: property is not documented", propertyLocation)
+		}
+		if additional != nil {
+			if err := d.validate(additional, propertyValue, propertyLocation); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateFormat(format string, value string, location string) error {
+	var err error
+	switch format {
+	case "date":
+		_, err = time.Parse("2006-01-02", value)
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a valid %s", location, value, format)
+	}
+	return nil
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
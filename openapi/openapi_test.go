@@ -0,0 +1,226 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/elehner/takehomeserver/health"
+	"github.com/elehner/takehomeserver/images"
+	"github.com/elehner/takehomeserver/jobs"
+	"github.com/elehner/takehomeserver/storage"
+	"github.com/elehner/takehomeserver/users"
+)
+
+// TestHandlersMatchSpec sends real requests to the handlers and checks every
+// response against the document.
+func TestHandlersMatchSpec(t *testing.T) {
+	document, err := Load()
+	if err != nil {
+		t.Fatalf("Error loading the document: %v", err)
+	}
+
+	testImage, err := os.ReadFile("../images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	frame := image.NewPaletted(image.Rect(0, 0, 300, 10), color.Palette{color.Black, color.White})
+	animation := new(bytes.Buffer)
+	if err := gif.EncodeAll(animation, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{5, 5}}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", users.HandleUserRequest)
+	mux.HandleFunc("/image", images.HandleImageRequest)
+	mux.HandleFunc("/v1/user", users.HandleUserRequest)
+	mux.HandleFunc("/v1/image", images.HandleImageRequest)
+	mux.HandleFunc("/v2/user", users.HandleUserRequestV2)
+	imageStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	imageHandler := images.NewHandler(images.WithStorage(imageStore, "/v2/images/"), images.WithIndex(images.NewIndex()))
+	mux.Handle("/v2/image", imageHandler)
+	mux.Handle("/v2/images/", storage.Handler(imageStore))
+	mux.HandleFunc("/v2/image/analyze", images.NewHandler().ServeAnalyze)
+	mux.HandleFunc("/v2/image/similar", imageHandler.ServeSimilar)
+	mux.HandleFunc("/healthz", health.HandleLiveness)
+	mux.HandleFunc("/readyz", health.NewChecker().HandleReadiness)
+	mux.HandleFunc("/version", health.HandleVersion)
+	mux.HandleFunc("/openapi.json", HandleSpec)
+
+	imageJobs, err := jobs.NewManager(t.TempDir(), images.Convert)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	mux.Handle("/image/jobs", imageJobs)
+	mux.Handle("/image/jobs/", imageJobs)
+
+	tests := []struct {
+		method string
+		path   string
+		accept string
+		body   string
+	}{
+		{"POST", "/user", "", `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }]`},
+		{"POST", "/user", "", ""},
+		{"POST", "/user", "", "this is not json"},
+		{"POST", "/user", "application/problem+json", "this is not json"},
+		{"POST", "/user", "application/problem+json", `[{"name": "Joe Smith"}]`},
+		{"POST", "/user", "application/problem+json", `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-124", "created_on": 1642612034 }]`},
+		{"GET", "/user", "application/problem+json", ""},
+		{"POST", "/image", "", string(testImage)},
+		{"POST", "/image", "application/problem+json", "this is not an image"},
+		{"GET", "/image", "", ""},
+		{"POST", "/v1/user", "", `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }]`},
+		{"POST", "/v1/image", "application/problem+json", "this is not an image"},
+		{"POST", "/v2/user", "", `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }]`},
+		{"POST", "/v2/user", "application/problem+json", `[{"name": "Joe Smith"}]`},
+		{"POST", "/v2/image", "", string(testImage)},
+		{"POST", "/v2/image", "", animation.String()},
+		{"POST", "/v2/image?frame=1", "", animation.String()},
+		{"POST", "/v2/image?frame=2", "application/problem+json", animation.String()},
+		{"POST", "/image?op=rotate:90&op=grayscale", "", string(testImage)},
+		{"POST", "/image?crop=smart&aspect=4:3", "", string(testImage)},
+		{"POST", "/v2/image/analyze", "", string(testImage)},
+		{"POST", "/v2/image/analyze", "application/problem+json", "this is not an image"},
+		{"POST", "/v2/image/similar?hash=dhash&distance=4", "", string(testImage)},
+		{"POST", "/v2/image/similar?distance=65", "application/problem+json", string(testImage)},
+		{"POST", "/image?op=swirl", "application/problem+json", string(testImage)},
+		{"GET", "/healthz", "", ""},
+		{"GET", "/readyz", "", ""},
+		{"GET", "/version", "", ""},
+		{"GET", "/openapi.json", "", ""},
+		{"GET", "/v2/images/" + storage.ContentKey(testImage, ".jpeg"), "", ""},
+		{"GET", "/v2/images/" + storage.ContentKey(nil, ".jpeg"), "application/problem+json", ""},
+		{"POST", "/image/jobs", "", string(testImage)},
+		{"POST", "/image/jobs?callback_url=not-a-url", "application/problem+json", string(testImage)},
+		{"GET", "/image/jobs/0123456789abcdef0123456789abcdef", "application/problem+json", ""},
+		{"GET", "/image/jobs/0123456789abcdef0123456789abcdef/result", "application/problem+json", ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s %s=%d", test.method, test.path, i), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost:8080"+test.path, strings.NewReader(test.body))
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			contentType := resp.Header.Get("Content-Type")
+			if contentType == "" && len(body) > 0 {
+				contentType = http.DetectContentType(body)
+			}
+			path := strings.Split(test.path, "?")[0]
+			if err := document.ValidateResponse(path, test.method, resp.StatusCode, contentType, body); err != nil {
+				t.Errorf("Response did not match the document: %v", err)
+			}
+		})
+	}
+}
+
+func TestMultipartUploadsMatchSpec(t *testing.T) {
+	document, err := Load()
+	if err != nil {
+		t.Fatalf("Error loading the document: %v", err)
+	}
+	testImage, err := os.ReadFile("../images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	for i, test := range []struct {
+		accept string
+		files  int
+	}{
+		{"", 1},
+		{"", 2},
+		{"multipart/mixed", 2},
+	} {
+		t.Run(fmt.Sprintf("%s %d=%d", test.accept, test.files, i), func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			writer.WriteField("op", "grayscale")
+			for j := 0; j < test.files; j++ {
+				part, err := writer.CreateFormFile("image", fmt.Sprintf("photo-%d.jpeg", j))
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				part.Write(testImage)
+			}
+			writer.Close()
+			req := httptest.NewRequest("POST", "http://localhost:8080/image", body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+
+			images.HandleImageRequest(w, req)
+
+			contentType := w.Header().Get("Content-Type")
+			if contentType == "" {
+				contentType = http.DetectContentType(w.Body.Bytes())
+			}
+			if err := document.ValidateResponse("/image", "POST", w.Code, contentType, w.Body.Bytes()); err != nil {
+				t.Errorf("Response did not match the document: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateResponseRejectsMismatches(t *testing.T) {
+	document, err := Load()
+	if err != nil {
+		t.Fatalf("Error loading the document: %v", err)
+	}
+
+	tests := []struct {
+		statusCode  int
+		contentType string
+		body        string
+	}{
+		// Undocumented status code
+		{http.StatusTeapot, "application/json", "[]"},
+		// Undocumented content type
+		{http.StatusOK, "text/html", "[]"},
+		// Missing required property
+		{http.StatusOK, "application/json", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday"}]`},
+		// Wrong type
+		{http.StatusOK, "application/json", `[{"user_id":"1","name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00"}]`},
+		// Not in the enum
+		{http.StatusOK, "application/json", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Someday","created_on":"2022-01-19T12:07:14-05:00"}]`},
+		// Bad format
+		{http.StatusOK, "application/json", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"yesterday"}]`},
+		// Undocumented property
+		{http.StatusOK, "application/json", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00","age":38}]`},
+		// Body on a response which should be empty
+		{http.StatusNoContent, "application/json", "[]"},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("ValidateResponse=%d", i), func(t *testing.T) {
+			err := document.ValidateResponse("/user", "POST", test.statusCode, test.contentType, []byte(test.body))
+			if err == nil {
+				t.Error("Expected the response to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Package problem writes RFC 7807 problem details responses, falling back
+// to the plain text form for clients which don't ask for JSON.
+package problem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	ContentType     = "application/problem+json"
+	RequestIDHeader = "X-Request-ID"
+
+	// typeBase prefixes each problem's code to build its type URI.
+	typeBase = "https://github.com/elehner/takehomeserver/problems/"
+)
+
+// Stable error codes shared by every handler. Clients should match on these
+// rather than on the title or detail text.
+const (
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInvalidInput     = "invalid_input"
+	CodeProcessingFailed = "processing_failed"
+	CodeEncodingFailed   = "encoding_failed"
+	CodeInvalidImage     = "invalid_image"
+	CodeInternal         = "internal_error"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeRateLimited      = "rate_limited"
+	CodeTooLarge         = "too_large"
+	CodeOverloaded       = "overloaded"
+	CodeNotFound         = "not_found"
+	CodeJobNotFinished   = "job_not_finished"
+	CodeJobFailed        = "job_failed"
+	CodeFetchBlocked     = "fetch_blocked"
+	CodeFetchFailed      = "fetch_failed"
+)
+
+// FieldError describes a problem with a single field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is the body of an application/problem+json response.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// New creates a Problem with the given status, stable code and title.
+// The title doubles as the plain text body sent to legacy clients.
+func New(status int, code string, title string) *Problem {
+	return &Problem{
+		Type:   typeBase + code,
+		Title:  title,
+		Status: status,
+		Code:   code,
+	}
+}
+
+// WithDetail sets the human readable explanation specific to this occurrence.
+func (p *Problem) WithDetail(detail string) *Problem {
+	p.Detail = detail
+	return p
+}
+
+// WithFieldErrors appends errors about individual request fields.
+func (p *Problem) WithFieldErrors(fieldErrors ...FieldError) *Problem {
+	p.Errors = append(p.Errors, fieldErrors...)
+	return p
+}
+
+// Error allows a Problem to be passed around as an error.
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// Write sends the problem to the client. Clients which accept JSON receive
+// the problem+json form, while everyone else receives the title as plain
+// text, matching the responses given before problem details were added.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	requestID := RequestID(w, r)
+
+	if !WantsJSON(r) {
+		http.Error(w, p.Title, p.Status)
+		return
+	}
+
+	body := *p
+	body.RequestID = requestID
+	if body.Instance == "" {
+		body.Instance = r.URL.Path
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// RequestID returns the ID the client sent in the X-Request-ID header,
+// generating one if necessary, and echoes it on the response.
+func RequestID(w http.ResponseWriter, r *http.Request) string {
+	requestID := w.Header().Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = r.Header.Get(RequestIDHeader)
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	return requestID
+}
+
+// WantsJSON reports whether the request's Accept header allows a JSON response.
+func WantsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case ContentType, "application/json":
+			return true
+		}
+	}
+
+	return false
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
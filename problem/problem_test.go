@@ -0,0 +1,100 @@
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/plain", false},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/json;q=0", false},
+		{"not a media type", false},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("WantsJSON=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("GET", "localhost:8080", nil)
+			req.Header.Set("Accept", test.accept)
+			if WantsJSON(req) != test.expected {
+				t.Errorf("Expected WantsJSON to be %t for %q", test.expected, test.accept)
+			}
+		})
+	}
+}
+
+func TestWritePlainText(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8080/user", nil)
+	w := httptest.NewRecorder()
+
+	Write(w, req, New(http.StatusBadRequest, CodeInvalidInput, "Error parsing user input").WithDetail("unexpected EOF"))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if strings.TrimSpace(string(body)) != "Error parsing user input" {
+		t.Errorf("Body was %s, expected %s", string(body), "Error parsing user input")
+	}
+	if resp.Header.Get(RequestIDHeader) == "" {
+		t.Error("Expected a request ID to be generated")
+	}
+}
+
+func TestWriteProblemJSON(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://localhost:8080/user", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	req.Header.Set(RequestIDHeader, "abc123")
+	w := httptest.NewRecorder()
+
+	Write(w, req, New(http.StatusBadRequest, CodeInvalidInput, "Error parsing user input").
+		WithDetail("missing fields").
+		WithFieldErrors(FieldError{Field: "[0].name", Message: "is required"}))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("Content-Type was %s, expected %s", resp.Header.Get("Content-Type"), ContentType)
+	}
+	if resp.Header.Get(RequestIDHeader) != "abc123" {
+		t.Errorf("Request ID was %s, expected abc123", resp.Header.Get(RequestIDHeader))
+	}
+
+	var received Problem
+	if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	expected := Problem{
+		Type:      typeBase + CodeInvalidInput,
+		Title:     "Error parsing user input",
+		Status:    http.StatusBadRequest,
+		Detail:    "missing fields",
+		Instance:  "/user",
+		Code:      CodeInvalidInput,
+		RequestID: "abc123",
+		Errors:    []FieldError{{Field: "[0].name", Message: "is required"}},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Received: %v, Expected: %v", received, expected)
+	}
+}
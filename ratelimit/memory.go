@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// MemoryBackend holds token buckets in memory, so limits only apply per node.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+	// idle buckets are dropped once they would have refilled completely
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take removes a token from the key's bucket if one is available.
+func (m *MemoryBackend) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+
+	// Refill the bucket for the time since it was last used
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	result := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else if limit.Rate > 0 {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	} else {
+		result.RetryAfter = time.Hour
+	}
+	result.Remaining = int(b.tokens)
+	if limit.Rate > 0 {
+		result.Reset = secondsToDuration((float64(limit.Burst) - b.tokens) / limit.Rate)
+	}
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+// sweep drops full buckets at most once a minute, as they are equivalent
+// to a new bucket.
+func (m *MemoryBackend) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
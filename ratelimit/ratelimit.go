@@ -0,0 +1,95 @@
+// Package ratelimit limits request rates with token buckets, keyed by
+// client IP or API key. Buckets are held by a pluggable Backend.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elehner/takehomeserver/middleware"
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	ErrorRateLimited = "Too many requests"
+	ErrorBackend     = "Error checking the rate limit"
+)
+
+// Limit is a token bucket refilled at Rate (> 0) tokens per second, holding
+// at most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result describes the state of a bucket after taking a token.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available, when not allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Backend stores token buckets. Implementations shared between nodes (such
+// as Redis) can be swapped in for the in-memory one.
+type Backend interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// KeyFunc picks the bucket a request draws from. Returning an empty string
+// skips rate limiting for the request.
+type KeyFunc func(r *http.Request) string
+
+// ByIP keys requests by the client's IP address.
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Middleware rejects requests with 429 once their bucket is empty. Every
+// response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset headers, and rejections carry Retry-After.
+func Middleware(backend Backend, limit Limit, keyFunc KeyFunc) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := backend.Take(r.Context(), key, limit)
+			if err != nil {
+				problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorBackend))
+				return
+			}
+
+			header := w.Header()
+			header.Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				problem.Write(w, r, problem.New(http.StatusTooManyRequests, problem.CodeRateLimited, ErrorRateLimited).
+					WithDetail(fmt.Sprintf("retry in %d seconds", ceilSeconds(result.RetryAfter))))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+type failingBackend struct{}
+
+func (failingBackend) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	return Result{}, errors.New("backend unavailable")
+}
+
+func TestMemoryBackendTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1642612034, 0)}
+	backend := NewMemoryBackend()
+	backend.now = clock.Now
+	limit := Limit{Rate: 1, Burst: 2}
+
+	tests := []struct {
+		advance           time.Duration
+		key               string
+		expectedAllowed   bool
+		expectedRemaining int
+		expectedRetry     time.Duration
+	}{
+		{0, "a", true, 1, 0},
+		{0, "a", true, 0, 0},
+		{0, "a", false, 0, time.Second},
+		// Buckets are independent
+		{0, "b", true, 1, 0},
+		{500 * time.Millisecond, "a", false, 0, 500 * time.Millisecond},
+		{500 * time.Millisecond, "a", true, 0, 0},
+		// The bucket never holds more than the burst
+		{time.Minute, "a", true, 1, 0},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Take=%d", i), func(t *testing.T) {
+			clock.now = clock.now.Add(test.advance)
+			result, err := backend.Take(context.Background(), test.key, limit)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if result.Allowed != test.expectedAllowed || result.Remaining != test.expectedRemaining || result.RetryAfter != test.expectedRetry {
+				t.Errorf("Received: %+v, expected allowed %t, remaining %d, retry after %s",
+					result, test.expectedAllowed, test.expectedRemaining, test.expectedRetry)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendSweepsFullBuckets(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1642612034, 0)}
+	backend := NewMemoryBackend()
+	backend.now = clock.Now
+
+	backend.Take(context.Background(), "a", Limit{Rate: 1, Burst: 5})
+	clock.now = clock.now.Add(2 * time.Minute)
+	backend.Take(context.Background(), "b", Limit{Rate: 1, Burst: 5})
+
+	if _, ok := backend.buckets["a"]; ok {
+		t.Error("Expected the full bucket to be dropped")
+	}
+	if _, ok := backend.buckets["b"]; !ok {
+		t.Error("Expected the new bucket to be kept")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := Middleware(NewMemoryBackend(), Limit{Rate: 0.5, Burst: 1}, ByIP)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	tests := []struct {
+		remoteAddr           string
+		expectedResponseCode int
+		expectedRemaining    string
+		expectedRetryAfter   string
+	}{
+		{"192.0.2.1:1234", http.StatusOK, "0", ""},
+		// The port doesn't matter
+		{"192.0.2.1:5678", http.StatusTooManyRequests, "0", "2"},
+		{"192.0.2.2:1234", http.StatusOK, "0", ""},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Middleware=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080/image", nil)
+			req.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+			if w.Header().Get("X-RateLimit-Limit") != "1" {
+				t.Errorf("X-RateLimit-Limit was %q, expected 1", w.Header().Get("X-RateLimit-Limit"))
+			}
+			if w.Header().Get("X-RateLimit-Remaining") != test.expectedRemaining {
+				t.Errorf("X-RateLimit-Remaining was %q, expected %q", w.Header().Get("X-RateLimit-Remaining"), test.expectedRemaining)
+			}
+			if w.Header().Get("X-RateLimit-Reset") == "" {
+				t.Error("Expected X-RateLimit-Reset to be set")
+			}
+			if w.Header().Get("Retry-After") != test.expectedRetryAfter {
+				t.Errorf("Retry-After was %q, expected %q", w.Header().Get("Retry-After"), test.expectedRetryAfter)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSkipsEmptyKeysAndFailsClosed(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	w := httptest.NewRecorder()
+	Middleware(failingBackend{}, Limit{Rate: 1, Burst: 1}, func(r *http.Request) string { return "" })(next).
+		ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080", nil))
+	if !called || w.Code != http.StatusOK {
+		t.Error("Expected requests without a key to skip the limiter")
+	}
+
+	called = false
+	w = httptest.NewRecorder()
+	Middleware(failingBackend{}, Limit{Rate: 1, Burst: 1}, ByIP)(next).
+		ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080", nil))
+	if called || w.Code != http.StatusInternalServerError {
+		t.Error("Expected backend errors to reject the request")
+	}
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FSStore keeps blobs as files in a local directory.
+type FSStore struct {
+	dir string
+}
+
+func NewFSStore(dir string) (*FSStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FSStore{dir: dir}, nil
+}
+
+// Put writes the blob through a temporary file, so readers never see a
+// partial blob. Existing blobs are left alone since their content matches.
+func (s *FSStore) Put(ctx context.Context, key string, data []byte) error {
+	if !ValidKey(key) {
+		return ErrNotFound
+	}
+	path := filepath.Join(s.dir, key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	temp, err := os.CreateTemp(s.dir, "."+key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+func (s *FSStore) Get(ctx context.Context, key string) (*Blob, error) {
+	if !ValidKey(key) {
+		return nil, ErrNotFound
+	}
+	file, err := os.Open(filepath.Join(s.dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Blob{Content: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -0,0 +1,95 @@
+// Package storage persists images as blobs under content-hash keys, on the
+// local filesystem or an S3-compatible object store, and serves them back.
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+const (
+	ErrorMethodNotSupported = "Only GET and HEAD are supported"
+	ErrorBlobNotFound       = "The image was not found"
+	ErrorReadingBlob        = "Error while reading the image"
+
+	// immutable lets caches keep blobs for a year without revalidating,
+	// since a key's content never changes.
+	immutable = "public, max-age=31536000, immutable"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// validKey matches the keys generated by ContentKey, so that keys taken
+// from request paths can't escape a store's directory or bucket.
+var validKey = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z]+$`)
+
+// Blob is a stored object opened for reading.
+type Blob struct {
+	Content io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// Store saves and loads blobs. Keys are content hashes, so putting a key
+// which already exists stores identical content.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) (*Blob, error)
+}
+
+// ContentKey names data by its SHA-256 hash followed by the extension,
+// such as ".png", which determines the type it is served with.
+func ContentKey(data []byte, extension string) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]) + extension
+}
+
+// etag is the strong entity tag of the blob with the key, its content hash.
+func etag(key string) string {
+	return `"` + strings.TrimSuffix(key, path.Ext(key)) + `"`
+}
+
+// ValidKey reports whether the key could have been generated by ContentKey.
+func ValidKey(key string) bool {
+	return validKey.MatchString(key)
+}
+
+// Handler serves the blob named by the last segment of the request path,
+// supporting range and conditional requests. Blobs are named by their
+// content, so the hash in their key is their ETag and they're cached as
+// immutable.
+func Handler(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
+			return
+		}
+
+		key := path.Base(r.URL.Path)
+		blob, err := store.Get(r.Context(), key)
+		if errors.Is(err, ErrNotFound) {
+			problem.Write(w, r, problem.New(http.StatusNotFound, problem.CodeNotFound, ErrorBlobNotFound))
+			return
+		}
+		if err != nil {
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal, ErrorReadingBlob).WithDetail(err.Error()))
+			return
+		}
+		defer blob.Content.Close()
+
+		w.Header().Set("ETag", etag(key))
+		w.Header().Set("Cache-Control", immutable)
+		http.ServeContent(w, r, key, blob.ModTime, blob.Content)
+	})
+}
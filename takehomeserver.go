@@ -1,15 +1,449 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
+	"github.com/elehner/takehomeserver/auth"
+	"github.com/elehner/takehomeserver/health"
 	"github.com/elehner/takehomeserver/images"
+	"github.com/elehner/takehomeserver/jobs"
+	"github.com/elehner/takehomeserver/middleware"
+	"github.com/elehner/takehomeserver/openapi"
+	"github.com/elehner/takehomeserver/problem"
+	"github.com/elehner/takehomeserver/ratelimit"
+	"github.com/elehner/takehomeserver/storage"
 	"github.com/elehner/takehomeserver/users"
+	"github.com/elehner/takehomeserver/versioning"
+	"golang.org/x/image/font/opentype"
+
+	_ "github.com/lib/pq"
+)
+
+var (
+	// apiV1 is the original API, also served without a version prefix.
+	apiV1 = versioning.Version{
+		Name:       "v1",
+		Deprecated: time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+		Successor:  "v2",
+	}
+	// apiV2 reports UserOutput.created_on in UTC.
+	apiV2 = versioning.Version{Name: "v2"}
 )
 
+// serverConfig holds the settings for the routes and middleware.
+type serverConfig struct {
+	corsOrigins  []string
+	userTimeout  time.Duration
+	imageTimeout time.Duration
+	// keyStore authenticates API requests. Authentication is disabled when nil.
+	keyStore         auth.Store
+	rateLimitBackend ratelimit.Backend
+	ipLimit          ratelimit.Limit
+	keyLimit         ratelimit.Limit
+	// imageLimiter bounds concurrent image conversions. Conversions are
+	// unbounded when nil.
+	imageLimiter  *images.Limiter
+	maxImageBytes int64
+	// maxUploadBytes bounds a multipart upload, twice maxImageBytes when
+	// zero.
+	maxUploadBytes int64
+	// imageJobs serves the asynchronous image API. It isn't served when nil.
+	imageJobs *jobs.Manager
+	// imageStore keeps original and converted images, served under
+	// storedImagesURL. Images aren't stored when nil.
+	imageStore storage.Store
+	// imageWatermark is composited over every converted image when set.
+	imageWatermark *images.Watermark
+	// imageFont renders text overlays, defaulting to Go Regular when nil.
+	imageFont *opentype.Font
+	// imageFetcher downloads images named by URL, or is nil when fetching
+	// is disabled.
+	imageFetcher *images.Fetcher
+	// imageIndex holds the perceptual hashes of uploaded images, searched
+	// by /image/similar, or is nil when it's disabled.
+	imageIndex *images.Index
+	// imageSigner verifies the transform URLs served by /v2/image/signed,
+	// which isn't served when nil.
+	imageSigner *images.Signer
+}
+
+// storedImagesURL is where images kept in serverConfig.imageStore are served.
+const storedImagesURL = "/v2/images/"
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		userTimeout:      10 * time.Second,
+		imageTimeout:     30 * time.Second,
+		rateLimitBackend: ratelimit.NewMemoryBackend(),
+		ipLimit:          ratelimit.Limit{Rate: 20, Burst: 40},
+		keyLimit:         ratelimit.Limit{Rate: 10, Burst: 20},
+		maxImageBytes:    images.DefaultMaxBodyBytes,
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	config := defaultServerConfig()
+	addr := flag.String("addr", ":8080", "address to listen on")
+	databaseURL := flag.String("database-url", os.Getenv("DATABASE_URL"), "PostgreSQL connection string checked by /readyz (optional)")
+	v1Sunset := flag.String("v1-sunset", "", "date (YYYY-MM-DD) after which /v1 will be removed, sent in the Sunset header (optional)")
+	corsOrigins := flag.String("cors-origins", "", "comma separated origins allowed to make cross-origin requests, or * for any (optional)")
+	flag.DurationVar(&config.userTimeout, "user-timeout", config.userTimeout, "maximum time to spend on a /user request")
+	flag.DurationVar(&config.imageTimeout, "image-timeout", config.imageTimeout, "maximum time to spend on an /image request")
+	apiKeysPath := flag.String("api-keys", "", "JSON file of hashed API keys and their scopes (optional)")
+	apiKeysFromDatabase := flag.Bool("api-keys-from-database", false, "read API keys from the api_keys table of -database-url")
+	requireAuth := flag.Bool("auth", true, "require API keys, refusing to start unless -api-keys or -api-keys-from-database is set")
+	flag.Float64Var(&config.ipLimit.Rate, "ip-rate", config.ipLimit.Rate, "requests per second allowed from each IP")
+	flag.IntVar(&config.ipLimit.Burst, "ip-burst", config.ipLimit.Burst, "requests allowed in a burst from each IP")
+	flag.Float64Var(&config.keyLimit.Rate, "key-rate", config.keyLimit.Rate, "requests per second allowed for each API key")
+	flag.IntVar(&config.keyLimit.Burst, "key-burst", config.keyLimit.Burst, "requests allowed in a burst for each API key")
+	imageWorkers := flag.Int("image-workers", runtime.NumCPU(), "maximum number of images converted at once")
+	imageQueueDepth := flag.Int("image-queue", 2*runtime.NumCPU(), "maximum number of images waiting for a worker before requests are rejected with 503")
+	flag.Int64Var(&config.maxImageBytes, "max-image-bytes", config.maxImageBytes, "maximum size of an uploaded image")
+	flag.Int64Var(&config.maxUploadBytes, "max-upload-bytes", 0, "maximum size of a multipart upload of several images, or 0 for twice -max-image-bytes")
+	jobsDir := flag.String("jobs-dir", filepath.Join(os.TempDir(), "takehomeserver-jobs"), "directory persisting asynchronous image jobs, or empty to disable them")
+	jobWorkers := flag.Int("job-workers", 1, "number of asynchronous image jobs run at once")
+	jobTTL := flag.Duration("job-ttl", 24*time.Hour, "how long finished asynchronous image jobs are kept")
+	callbackAllowPrivate := flag.Bool("callback-allow-private", false, "allow job callbacks to loopback and private network addresses")
+	storageBackend := flag.String("storage", "", "where to store original and converted images: fs, s3, or empty to not store them")
+	storageDir := flag.String("storage-dir", filepath.Join(os.TempDir(), "takehomeserver-images"), "directory storing images when -storage is fs")
+	var s3Config storage.S3Config
+	flag.StringVar(&s3Config.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "base URL of the S3-compatible service when -storage is s3")
+	flag.StringVar(&s3Config.Bucket, "s3-bucket", "", "bucket storing images when -storage is s3")
+	flag.StringVar(&s3Config.Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	flag.StringVar(&s3Config.Prefix, "s3-prefix", "", "prefix prepended to the keys of stored images")
+	watermarkPath := flag.String("watermark", "", "PNG composited over every converted image (optional)")
+	watermarkPosition := flag.String("watermark-position", string(images.PositionBottomRight), "where the watermark is placed: top-left, top-right, bottom-left, bottom-right or center")
+	watermarkOpacity := flag.Float64("watermark-opacity", 0.5, "opacity of the watermark, from 0 to 1")
+	watermarkMinOpacity := flag.Float64("watermark-min-opacity", 0.25, "lowest opacity a request can set with watermark_opacity")
+	watermarkScale := flag.Float64("watermark-scale", 0.25, "width of the watermark as a fraction of the image's width")
+	fontPath := flag.String("font", "", "TrueType font for text overlays, instead of Go Regular (optional)")
+	fetchEnabled := flag.Bool("fetch", true, "let /image requests name an image by URL, fetched by the server")
+	fetchAllowHosts := flag.String("fetch-allow-hosts", "", "comma separated hosts images may be fetched from, such as cdn.example.com or *.example.com, or empty for any (optional)")
+	fetchDenyHosts := flag.String("fetch-deny-hosts", "", "comma separated hosts images may never be fetched from (optional)")
+	fetchConfig := images.FetchConfig{}
+	flag.DurationVar(&fetchConfig.Timeout, "fetch-timeout", images.DefaultFetchTimeout, "maximum time to spend fetching an image by URL")
+	flag.IntVar(&fetchConfig.MaxRedirects, "fetch-max-redirects", images.DefaultFetchMaxRedirects, "maximum redirects followed when fetching an image by URL, or 0 to follow none")
+	flag.BoolVar(&fetchConfig.AllowPrivateNetworks, "fetch-allow-private", false, "allow fetching images from loopback and private network addresses")
+	imageIndexPath := flag.String("image-index", "", "file persisting the perceptual hashes of uploaded images, enabling /image/similar (optional)")
+	debugAddr := flag.String("debug-addr", "localhost:6060", "address serving metrics at /debug/vars, or empty to disable")
+	flag.Parse()
+
+	config.imageLimiter = images.NewLimiter(*imageWorkers, *imageQueueDepth)
+	expvar.Publish("image_limiter", config.imageLimiter.Metrics())
+	if *debugAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*debugAddr, expvar.Handler()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error occurred while serving metrics: %s\n", err.Error())
+			}
+		}()
+	}
+
+	if *watermarkPath != "" {
+		watermark, err := images.LoadWatermark(*watermarkPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while loading the watermark: %s\n", err.Error())
+			os.Exit(1)
+		}
+		watermark.Position = images.Position(*watermarkPosition)
+		watermark.Opacity = *watermarkOpacity
+		watermark.MinOpacity = *watermarkMinOpacity
+		watermark.Scale = *watermarkScale
+		if err := watermark.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while loading the watermark: %s\n", err.Error())
+			os.Exit(1)
+		}
+		config.imageWatermark = watermark
+	}
+	if *fontPath != "" {
+		typeface, err := images.LoadFont(*fontPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while loading the font: %s\n", err.Error())
+			os.Exit(1)
+		}
+		config.imageFont = typeface
+	}
+
+	if *jobsDir != "" {
+		// Asynchronous conversions are watermarked like synchronous ones
+		convert := func(upload []byte) ([]byte, error) {
+			conversion, err := images.ConvertWithOptions(upload, images.Options{Watermark: config.imageWatermark})
+			if err != nil {
+				return nil, err
+			}
+			return conversion.Data, nil
+		}
+		imageJobs, err := jobs.NewManager(*jobsDir, convert,
+			jobs.WithWorkers(*jobWorkers),
+			jobs.WithTTL(*jobTTL),
+			jobs.WithMaxUploadBytes(config.maxImageBytes),
+			jobs.WithNotifier(jobs.NewNotifier(*callbackAllowPrivate)),
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while loading the image jobs: %s\n", err.Error())
+			os.Exit(1)
+		}
+		imageJobs.Start(context.Background())
+		config.imageJobs = imageJobs
+	}
+
+	switch *storageBackend {
+	case "":
+	case "fs":
+		imageStore, err := storage.NewFSStore(*storageDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while opening the image storage: %s\n", err.Error())
+			os.Exit(1)
+		}
+		config.imageStore = imageStore
+	case "s3":
+		if s3Config.Bucket == "" {
+			fmt.Fprintln(os.Stderr, "-storage s3 requires -s3-bucket")
+			os.Exit(1)
+		}
+		s3Config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.imageStore = storage.NewS3Store(s3Config)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown storage %q, expected fs or s3\n", *storageBackend)
+		os.Exit(1)
+	}
+
+	if *fetchEnabled {
+		if *fetchAllowHosts != "" {
+			fetchConfig.AllowedHosts = strings.Split(*fetchAllowHosts, ",")
+		}
+		if *fetchDenyHosts != "" {
+			fetchConfig.DeniedHosts = strings.Split(*fetchDenyHosts, ",")
+		}
+		fetchConfig.MaxBytes = config.maxImageBytes
+		config.imageFetcher = images.NewFetcher(fetchConfig)
+	}
+
+	imageSigner, err := loadSigner()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while loading the signing keys: %s\n", err.Error())
+		os.Exit(1)
+	}
+	config.imageSigner = imageSigner
+
+	if *imageIndexPath != "" {
+		imageIndex, err := images.OpenIndex(*imageIndexPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while opening the image index: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer imageIndex.Close()
+		config.imageIndex = imageIndex
+	}
+
+	if config.ipLimit.Rate <= 0 || config.keyLimit.Rate <= 0 {
+		fmt.Fprintln(os.Stderr, "Rate limits must be greater than zero")
+		os.Exit(1)
+	}
+
+	if *corsOrigins != "" {
+		config.corsOrigins = strings.Split(*corsOrigins, ",")
+	}
+
+	if *v1Sunset != "" {
+		sunset, err := time.Parse("2006-01-02", *v1Sunset)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while parsing the v1 sunset date: %s\n", err.Error())
+			os.Exit(1)
+		}
+		apiV1.Sunset = sunset
+	}
+
+	checker := health.NewChecker()
+	checker.Register("timezone", health.TimeZoneCheck(users.OutputTimeZone))
+	var db *sql.DB
+	if *databaseURL != "" {
+		var err error
+		db, err = sql.Open("postgres", *databaseURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred while opening the database: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer db.Close()
+		checker.Register("database", health.PingCheck(db))
+	}
+
+	keyStore, err := loadKeyStore(*apiKeysPath, *apiKeysFromDatabase, db, *requireAuth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred while loading the API keys: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if keyStore == nil {
+		fmt.Fprintln(os.Stderr, "Warning: -auth=false, so requests will not be authenticated")
+	}
+	config.keyStore = keyStore
+
+	http.ListenAndServe(*addr, newHandler(checker, config))
+}
+
+// loadKeyStore opens the API keys named by the flags. Unless auth is turned
+// off, it fails when no keys are configured, so a missing or misnamed
+// setting can't leave the API open. With auth off it returns nil.
+func loadKeyStore(apiKeysPath string, fromDatabase bool, db *sql.DB, requireAuth bool) (auth.Store, error) {
+	if !requireAuth {
+		if apiKeysPath != "" || fromDatabase {
+			return nil, errors.New("-auth=false can't be combined with -api-keys or -api-keys-from-database")
+		}
+		return nil, nil
+	}
+	switch {
+	case apiKeysPath != "":
+		keyStore, err := auth.LoadFileStore(apiKeysPath)
+		if err != nil {
+			return nil, err
+		}
+		return keyStore, nil
+	case fromDatabase:
+		if db == nil {
+			return nil, errors.New("-api-keys-from-database requires -database-url")
+		}
+		return auth.NewSQLStore(db), nil
+	}
+	return nil, errors.New("no API keys are configured, set -api-keys or -api-keys-from-database, or -auth=false to serve requests without authentication")
+}
+
+// newHandler registers every route served by the server, wrapped in the
+// middleware shared by all of them.
+func newHandler(checker *health.Checker, config serverConfig) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/user", users.HandleUserRequest)
-	mux.HandleFunc("/image", images.HandleImageRequest)
-	http.ListenAndServe(":8080", mux)
+
+	userV1 := config.protect(auth.ScopeUserWrite, config.userTimeout, http.HandlerFunc(users.HandleUserRequest))
+	userV2 := config.protect(auth.ScopeUserWrite, config.userTimeout, http.HandlerFunc(users.HandleUserRequestV2))
+	imageOptions := []images.Option{images.WithLimiter(config.imageLimiter), images.WithMaxBodyBytes(config.maxImageBytes)}
+	if config.maxUploadBytes > 0 {
+		imageOptions = append(imageOptions, images.WithMaxUploadBytes(config.maxUploadBytes))
+	}
+	if config.imageStore != nil {
+		imageOptions = append(imageOptions, images.WithStorage(config.imageStore, storedImagesURL))
+	}
+	if config.imageWatermark != nil {
+		imageOptions = append(imageOptions, images.WithWatermark(config.imageWatermark))
+	}
+	if config.imageFont != nil {
+		imageOptions = append(imageOptions, images.WithFont(config.imageFont))
+	}
+	if config.imageIndex != nil {
+		imageOptions = append(imageOptions, images.WithIndex(config.imageIndex), images.WithOwner(auth.ByKey))
+	}
+	if config.imageFetcher != nil {
+		imageOptions = append(imageOptions, images.WithFetcher(config.imageFetcher))
+	}
+	if config.imageSigner != nil {
+		imageOptions = append(imageOptions, images.WithSigner(config.imageSigner))
+	}
+	imageHandler := images.NewHandler(imageOptions...)
+	image := config.protectWith(auth.ScopeImageConvert, middleware.StreamingTimeout(config.imageTimeout, images.Streaming), imageHandler)
+	imageAnalysis := config.protect(auth.ScopeImageConvert, config.imageTimeout, http.HandlerFunc(imageHandler.ServeAnalyze))
+
+	router := versioning.NewRouter(mux)
+	router.Handle(apiV1, "/user", userV1)
+	router.Handle(apiV1, "/image", image)
+	router.Handle(apiV2, "/user", userV2)
+	router.Handle(apiV2, "/image", image)
+	router.HandleUnversioned(apiV1, "/user", userV1)
+	router.HandleUnversioned(apiV1, "/image", image)
+	for _, version := range []versioning.Version{apiV1, apiV2} {
+		router.Handle(version, "/image/analyze", imageAnalysis)
+	}
+	router.HandleUnversioned(apiV1, "/image/analyze", imageAnalysis)
+	if config.imageIndex != nil {
+		similarImages := config.protect(auth.ScopeImageConvert, config.imageTimeout, http.HandlerFunc(imageHandler.ServeSimilar))
+		router.Handle(apiV1, "/image/similar", similarImages)
+		router.Handle(apiV2, "/image/similar", similarImages)
+		router.HandleUnversioned(apiV1, "/image/similar", similarImages)
+	}
+	if config.imageJobs != nil {
+		imageJobs := config.protect(auth.ScopeImageConvert, config.imageTimeout, config.imageJobs)
+		for _, pattern := range []string{"/image/jobs", "/image/jobs/"} {
+			router.Handle(apiV1, pattern, imageJobs)
+			router.Handle(apiV2, pattern, imageJobs)
+			router.HandleUnversioned(apiV1, pattern, imageJobs)
+		}
+	}
+
+	if config.imageStore != nil {
+		// Stored images are named by their content hash, so their URLs can
+		// be shared without an API key. Blobs can be large, so they're
+		// written as they're read rather than buffered by Timeout
+		storedImages := middleware.Chain(
+			ratelimit.Middleware(config.rateLimitBackend, config.ipLimit, ratelimit.ByIP),
+			middleware.ContextTimeout(config.imageTimeout),
+		)(storage.Handler(config.imageStore))
+		router.Handle(apiV2, "/images/", storedImages)
+	}
+	if config.imageSigner != nil {
+		// Like stored images, signed URLs can be shared without an API key,
+		// since only holders of the signing keys can generate them
+		signedImages := middleware.Chain(
+			ratelimit.Middleware(config.rateLimitBackend, config.ipLimit, ratelimit.ByIP),
+			middleware.Timeout(config.imageTimeout),
+		)(http.HandlerFunc(imageHandler.ServeSigned))
+		router.Handle(apiV2, "/image/signed", signedImages)
+	}
+
+	mux.HandleFunc("/healthz", health.HandleLiveness)
+	mux.HandleFunc("/readyz", checker.HandleReadiness)
+	mux.HandleFunc("/version", health.HandleVersion)
+	mux.HandleFunc("/openapi.json", openapi.HandleSpec)
+
+	return middleware.Chain(
+		middleware.Recover,
+		middleware.SecurityHeaders,
+		middleware.CORS(middleware.CORSConfig{
+			AllowedOrigins: config.corsOrigins,
+			AllowedMethods: []string{"GET", "HEAD", "POST"},
+			AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", auth.APIKeyHeader, problem.RequestIDHeader},
+			ExposedHeaders: []string{
+				problem.RequestIDHeader, "API-Version", "Deprecation", "Sunset", "Link", "Content-Location", "Content-Disposition",
+				"Retry-After", images.CropHeader, images.SavingsHeader, images.StreamErrorTrailer,
+				images.WidthHeader, images.HeightHeader, images.OriginalWidthHeader, images.OriginalHeightHeader,
+				"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+			},
+			MaxAge: time.Hour,
+		}),
+		middleware.Compress,
+	)(mux)
+}
+
+// protect wraps an API route with per-IP rate limiting, authentication for
+// the scope, per-key rate limiting and the route's timeout.
+func (config serverConfig) protect(scope string, timeout time.Duration, handler http.Handler) http.Handler {
+	return config.protectWith(scope, middleware.Timeout(timeout), handler)
+}
+
+// protectWith wraps an API route like protect, with the given timeout
+// middleware.
+func (config serverConfig) protectWith(scope string, timeout middleware.Middleware, handler http.Handler) http.Handler {
+	middlewares := []middleware.Middleware{
+		ratelimit.Middleware(config.rateLimitBackend, config.ipLimit, ratelimit.ByIP),
+	}
+	if config.keyStore != nil {
+		middlewares = append(middlewares,
+			auth.Require(config.keyStore, scope),
+			ratelimit.Middleware(config.rateLimitBackend, config.keyLimit, auth.ByKey),
+		)
+	}
+	middlewares = append(middlewares, timeout)
+
+	return middleware.Chain(middlewares...)(handler)
 }
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elehner/takehomeserver/auth"
+	"github.com/elehner/takehomeserver/health"
+	"github.com/elehner/takehomeserver/images"
+	"github.com/elehner/takehomeserver/jobs"
+	"github.com/elehner/takehomeserver/storage"
+)
+
+const compatibilityInput = `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }]`
+
+// TestUserVersionCompatibility freezes the response of each version of /user,
+// so that changes to one version can't leak into another.
+func TestUserVersionCompatibility(t *testing.T) {
+	handler := newHandler(health.NewChecker(), defaultServerConfig())
+
+	tests := []struct {
+		path                 string
+		expectedResponseBody string
+		expectsDeprecation   bool
+	}{
+		{"/user", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00"}]`, true},
+		{"/v1/user", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00"}]`, true},
+		{"/v2/user", `[{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T17:07:14Z"}]`, false},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s=%d", test.path, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+test.path, strings.NewReader(compatibilityInput))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusOK, resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if strings.TrimSpace(string(body)) != test.expectedResponseBody {
+				t.Errorf("Body was %s, expected %s", string(body), test.expectedResponseBody)
+			}
+			if (resp.Header.Get("Deprecation") != "") != test.expectsDeprecation {
+				t.Errorf("Deprecation header was %q, expected it to be set: %t", resp.Header.Get("Deprecation"), test.expectsDeprecation)
+			}
+		})
+	}
+}
+
+// TestImageVersionCompatibility checks that every version of /image
+// converts images identically.
+func TestImageVersionCompatibility(t *testing.T) {
+	handler := newHandler(health.NewChecker(), defaultServerConfig())
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	var expectedBody []byte
+	for i, path := range []string{"/image", "/v1/image", "/v2/image"} {
+		t.Run(fmt.Sprintf("%s=%d", path, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+path, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusOK, w.Code)
+			}
+			if expectedBody == nil {
+				expectedBody = w.Body.Bytes()
+			} else if !bytes.Equal(w.Body.Bytes(), expectedBody) {
+				t.Error("Images differ between versions")
+			}
+		})
+	}
+}
+
+func TestAPIKeysProtectRoutes(t *testing.T) {
+	keyStore, err := auth.NewFileStore([]*auth.Key{
+		{ID: "users-only", Hash: auth.HashKey("user-secret"), Scopes: []string{auth.ScopeUserWrite}},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config := defaultServerConfig()
+	config.keyStore = keyStore
+	handler := newHandler(health.NewChecker(), config)
+
+	tests := []struct {
+		path                 string
+		apiKey               string
+		expectedResponseCode int
+	}{
+		{"/v1/user", "", http.StatusUnauthorized},
+		{"/v1/user", "user-secret", http.StatusOK},
+		{"/v1/image", "user-secret", http.StatusForbidden},
+		// Probes don't need a key
+		{"/healthz", "", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("%s=%d", test.path, i), func(t *testing.T) {
+			method := "POST"
+			if test.path == "/healthz" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, "http://localhost:8080"+test.path, strings.NewReader(compatibilityInput))
+			if test.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+test.apiKey)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestLoadKeyStore(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(keysPath, []byte(`[{"id": "test", "hash": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "scopes": ["user:write"]}]`), 0644)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		apiKeysPath  string
+		fromDatabase bool
+		requireAuth  bool
+		expectsError bool
+		expectsStore bool
+	}{
+		// Startup fails rather than serving every route anonymously
+		{"no keys", "", false, true, true, false},
+		{"database without url", "", true, true, true, false},
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), false, true, true, false},
+		{"key file", keysPath, false, true, false, true},
+		{"auth off", "", false, false, false, false},
+		{"auth off with keys", keysPath, false, false, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyStore, err := loadKeyStore(test.apiKeysPath, test.fromDatabase, nil, test.requireAuth)
+			if (err != nil) != test.expectsError {
+				t.Fatalf("Expected an error to be %t, but was %v", test.expectsError, err)
+			}
+			if (keyStore != nil) != test.expectsStore {
+				t.Errorf("Expected a key store to be %t, but was %v", test.expectsStore, keyStore)
+			}
+		})
+	}
+}
+
+func TestImageJobsRoutes(t *testing.T) {
+	imageJobs, err := jobs.NewManager(t.TempDir(), images.Convert)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config := defaultServerConfig()
+	config.imageJobs = imageJobs
+	handler := newHandler(health.NewChecker(), config)
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	for i, path := range []string{"/image/jobs", "/v1/image/jobs", "/v2/image/jobs"} {
+		t.Run(fmt.Sprintf("%s=%d", path, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+path, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusAccepted {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusAccepted, w.Code)
+			}
+			if !strings.HasPrefix(w.Header().Get("Location"), path+"/") {
+				t.Errorf("Location was %s, expected it to be under %s", w.Header().Get("Location"), path)
+			}
+		})
+	}
+}
+
+func TestStoredImagesRoutes(t *testing.T) {
+	imageStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config := defaultServerConfig()
+	config.imageStore = imageStore
+	handler := newHandler(health.NewChecker(), config)
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost:8080/v1/image", bytes.NewReader(testImg))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	converted := w.Body.Bytes()
+	location := w.Header().Get("Content-Location")
+	if !strings.HasPrefix(location, storedImagesURL) {
+		t.Fatalf("Content-Location was %q, expected it to be under %s", location, storedImagesURL)
+	}
+
+	req = httptest.NewRequest("GET", "http://localhost:8080"+location, nil)
+	req.Header.Set("Range", "bytes=0-7")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusPartialContent, w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), converted[:8]) {
+		t.Errorf("Body was %q, expected the first 8 bytes of the converted image", w.Body.Bytes())
+	}
+
+	req = httptest.NewRequest("GET", "http://localhost:8080"+location, nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status code to be %d, but was %d", http.StatusNotModified, w.Code)
+	}
+}
+
+func TestImageAnalysisRoutes(t *testing.T) {
+	handler := newHandler(health.NewChecker(), defaultServerConfig())
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	for i, path := range []string{"/image/analyze", "/v1/image/analyze", "/v2/image/analyze"} {
+		t.Run(fmt.Sprintf("%s=%d", path, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+path, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusOK, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), `"blurhash"`) {
+				t.Errorf("Body was %s, expected an analysis", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSimilarImagesRoutes(t *testing.T) {
+	config := defaultServerConfig()
+	config.imageIndex = images.NewIndex()
+	handler := newHandler(health.NewChecker(), config)
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+
+	upload := httptest.NewRecorder()
+	handler.ServeHTTP(upload, httptest.NewRequest("POST", "http://localhost:8080/v1/image", bytes.NewReader(testImg)))
+	if upload.Code != http.StatusOK {
+		t.Fatalf("Upload status was %d", upload.Code)
+	}
+
+	for i, path := range []string{"/image/similar", "/v1/image/similar", "/v2/image/similar"} {
+		t.Run(fmt.Sprintf("%s=%d", path, i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+path, bytes.NewReader(testImg))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status code to be %d, but was %d", http.StatusOK, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), `"distance":0`) {
+				t.Errorf("Body was %s, expected the uploaded image to match", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSignedImageRoutes(t *testing.T) {
+	t.Setenv(signingKeysEnv, strings.Repeat("ab", images.MinSigningKeyBytes)+","+strings.Repeat("cd", images.MinSigningKeyBytes))
+	imageStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	key := storage.ContentKey(testImg, ".jpeg")
+	if err := imageStore.Put(context.Background(), key, testImg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	config := defaultServerConfig()
+	config.imageStore = imageStore
+	if config.imageSigner, err = loadSigner(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	handler := newHandler(health.NewChecker(), config)
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if code := runCommand([]string{"images", "sign", "-expires", "1h", "/v2/image/signed?key=" + key + "&op=grayscale"}, nil, stdout, stderr); code != 0 {
+		t.Fatalf("Expected the command to succeed, but it exited with %d: %s", code, stderr.String())
+	}
+	signed := strings.TrimSpace(stdout.String())
+
+	for _, test := range []struct {
+		path                 string
+		expectedResponseCode int
+	}{
+		{signed, http.StatusOK},
+		{strings.Replace(signed, "grayscale", "blur%3A5", 1), http.StatusForbidden},
+		{"/v2/image/signed?key=" + key, http.StatusForbidden},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080"+test.path, nil))
+
+			if w.Code != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d: %s", test.expectedResponseCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	t.Setenv(signingKeysEnv, "")
+
+	tests := []struct {
+		args         []string
+		expectedCode int
+		expectedErr  string
+	}{
+		{[]string{"images", "resize"}, 2, "Unknown command"},
+		{[]string{"images", "sign"}, 2, "Usage: takehomeserver images sign"},
+		{[]string{"images", "sign", "/v2/image/signed?key=abc.jpeg"}, 1, signingKeysEnv + " must be set"},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+			if code := runCommand(test.args, nil, stdout, stderr); code != test.expectedCode {
+				t.Errorf("Expected exit code %d, but was %d", test.expectedCode, code)
+			}
+			if !strings.Contains(stderr.String(), test.expectedErr) {
+				t.Errorf("Expected %q in the output, but was %q", test.expectedErr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestImagesConvertCommand(t *testing.T) {
+	testImg, err := os.ReadFile("./images/test_images/test_image.jpeg")
+	if err != nil {
+		t.Fatalf("Error pulling test image: %v", err)
+	}
+	palette := color.Palette{color.Black, color.White}
+	animation := new(bytes.Buffer)
+	err = gif.EncodeAll(animation, &gif.GIF{
+		Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 300, 300), palette), image.NewPaletted(image.Rect(0, 0, 300, 300), palette)},
+		Delay: []int{10, 10},
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	in, out := t.TempDir(), t.TempDir()
+	for name, data := range map[string][]byte{
+		"a.jpeg":      testImg,
+		"sub/b.JPG":   testImg,
+		"anim.gif":    animation.Bytes(),
+		"notes.txt":   []byte("not an image"),
+		"broken.jpeg": []byte("not a JPEG"),
+	} {
+		path := filepath.Join(in, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	run := func(expectedCode int, expectedSummary string, args ...string) {
+		t.Helper()
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		if code := runCommand(append([]string{"images", "convert"}, args...), nil, stdout, stderr); code != expectedCode {
+			t.Errorf("Expected exit code %d, but was %d: %s", expectedCode, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String()+stderr.String(), expectedSummary) {
+			t.Errorf("Expected %q in the output, but was %q", expectedSummary, stdout.String()+stderr.String())
+		}
+	}
+	args := []string{"-out", out, "-workers", "2", "-name", "{dir}/{name}_thumb{ext}", in}
+
+	run(1, "Converted 3 of 4 images", args...)
+	for name, contentType := range map[string]string{"a_thumb.png": "image/png", "sub/b_thumb.png": "image/png", "anim_thumb.gif": "image/gif"} {
+		data, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Expected %s to have been written: %v", name, err)
+		}
+		if detected := http.DetectContentType(data); detected != contentType {
+			t.Errorf("Expected %s to be %s, but was %s", name, contentType, detected)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(in, "broken.jpeg")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	run(0, "Converted 0 of 3 images", args...)
+	// Changed inputs are converted again
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(in, "a.jpeg"), later, later); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	run(0, "Converted 1 of 3 images", args...)
+	run(0, "Converted 3 of 3 images", append([]string{"-force"}, args...)...)
+
+	run(2, "would be converted over itself", "-format", "jpeg", "-name", "{name}{ext}", filepath.Join(in, "a.jpeg"))
+	run(2, "-name must include {name}", "-name", "thumb{ext}", in)
+
+	// Inputs which would share an output are refused before any is converted
+	duplicates := t.TempDir()
+	for _, name := range []string{"c.jpg", "c.jpeg"} {
+		if err := os.WriteFile(filepath.Join(duplicates, name), testImg, 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	run(2, "would both be converted to "+filepath.Join(out, "c_thumb.png"), "-out", out, duplicates)
+	if _, err := os.Stat(filepath.Join(out, "c_thumb.png")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected nothing to be converted, but found c_thumb.png: %v", err)
+	}
+	run(2, "Invalid conversion options", "-op", "rotate:45", in)
+
+	// By default, thumbnails are written next to their images, which aren't
+	// replaced, and aren't converted again by later runs
+	beside := t.TempDir()
+	for name, data := range map[string][]byte{"d.jpeg": testImg, "anim.gif": animation.Bytes()} {
+		if err := os.WriteFile(filepath.Join(beside, name), data, 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	run(0, "Converted 2 of 2 images", beside)
+	for _, name := range []string{"d_thumb.png", "anim_thumb.gif"} {
+		if _, err := os.Stat(filepath.Join(beside, name)); err != nil {
+			t.Errorf("Expected %s to have been written: %v", name, err)
+		}
+	}
+	run(0, "Converted 0 of 2 images", beside)
+}
+
+func TestUsersTransformCommand(t *testing.T) {
+	dir := t.TempDir()
+	records := filepath.Join(dir, "users.csv")
+	err := os.WriteFile(records, []byte("user_id,name,date_of_birth,created_on\n1,Joe Smith,1983-05-12,1642612034\n2,,1984-05-10,1642612035\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	out, rejected := filepath.Join(dir, "users.ndjson"), filepath.Join(dir, "rejected.ndjson")
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if code := runCommand([]string{"users", "transform", "-format", "ndjson", "-out", out, "-rejected", rejected, records}, nil, stdout, stderr); code != 0 {
+		t.Fatalf("Expected the command to succeed, but it exited with %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Transformed 1 of 2 users, rejected 1") {
+		t.Errorf("Expected a summary, but the output was %q", stderr.String())
+	}
+	transformed, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if expected := `{"user_id":1,"name":"Joe Smith","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00"}` + "\n"; string(transformed) != expected {
+		t.Errorf("Received: %s, Expected: %s", transformed, expected)
+	}
+	rejections, err := os.ReadFile(rejected)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.HasPrefix(string(rejections), `{"index":1,`) || !strings.Contains(string(rejections), "missing required fields: name") {
+		t.Errorf("Expected the record without a name to be rejected, but was %s", rejections)
+	}
+
+	// Records are read from stdin, and rejections fail the command when
+	// there's no file for them
+	stdin := strings.NewReader(`{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034}` + "\n" + `{"user_id": 2}` + "\n")
+	stdout, stderr = new(bytes.Buffer), new(bytes.Buffer)
+	if code := runCommand([]string{"users", "transform", "-input-format", "ndjson", "-format", "csv", "-version", "v2"}, stdin, stdout, stderr); code != 1 {
+		t.Errorf("Expected exit code 1, but was %d: %s", code, stderr.String())
+	}
+	if expected := "user_id,name,weekday_of_birth,created_on\n1,Joe Smith,Thursday,2022-01-19T17:07:14Z\n"; stdout.String() != expected {
+		t.Errorf("Received: %s, Expected: %s", stdout.String(), expected)
+	}
+	if !strings.Contains(stderr.String(), "Rejected record 1") {
+		t.Errorf("Expected the rejection to be reported, but the output was %q", stderr.String())
+	}
+
+	stderr = new(bytes.Buffer)
+	if code := runCommand([]string{"users", "transform", "-format", "xml"}, nil, new(bytes.Buffer), stderr); code != 2 {
+		t.Errorf("Expected exit code 2, but was %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elehner/takehomeserver/users"
+)
+
+const usersTransformUsage = "[-input-format json|ndjson|csv] [-format json|ndjson|csv] [-version v1|v2] [-out file] [-rejected file] [file]"
+
+// runUsersTransform transforms a file of user records, or stdin, like
+// /user, writing the outputs and rejected records to their own files.
+func runUsersTransform(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("users transform", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	inputFormat := flags.String("input-format", "", "format of the records read, json, ndjson or csv, detected from the file's extension when empty and json for stdin")
+	format := flags.String("format", users.FormatJSON, "format of the transformed users written: json, ndjson or csv")
+	version := flags.String("version", users.VersionV1, "API version whose output is written: v1 reports created_on in EST like /user, v2 in UTC like /v2/user")
+	out := flags.String("out", "", "file the transformed users are written to, instead of stdout")
+	rejected := flags.String("rejected", "", "file the records which can't be transformed are written to as NDJSON, instead of being reported on stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: takehomeserver users transform %s\n\nTransforms user records like /user, reading the file or stdin when it's omitted or -.\n", usersTransformUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	outputFormat, err := users.ParseFormat(*format)
+	if err != nil {
+		fmt.Fprintf(stderr, "-format: %s\n", err.Error())
+		return 2
+	}
+	if *version != users.VersionV1 && *version != users.VersionV2 {
+		fmt.Fprintf(stderr, "-version must be %s or %s\n", users.VersionV1, users.VersionV2)
+		return 2
+	}
+
+	input, name := stdin, flags.Arg(0)
+	if name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error occurred while opening the records: %s\n", err.Error())
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+	if *inputFormat == "" {
+		*inputFormat = users.FormatJSON
+		if extension := strings.TrimPrefix(filepath.Ext(name), "."); extension != "" {
+			*inputFormat = extension
+		}
+	}
+	recordsFormat, err := users.ParseFormat(*inputFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "-input-format: %s\n", err.Error())
+		return 2
+	}
+
+	result, err := users.TransformBatch(bufio.NewReader(input), recordsFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error occurred while reading the records: %s\n", err.Error())
+		return 1
+	}
+	if err := writeOutput(*out, stdout, func(w io.Writer) error {
+		return users.WriteOutputs(w, outputFormat, *version, result)
+	}); err != nil {
+		fmt.Fprintf(stderr, "Error occurred while writing the users: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(stderr, "Transformed %d of %d users, rejected %d\n", len(result.Outputs), len(result.Outputs)+len(result.Rejected), len(result.Rejected))
+	if *rejected != "" {
+		if err := writeOutput(*rejected, nil, func(w io.Writer) error {
+			return users.WriteRejections(w, result.Rejected)
+		}); err != nil {
+			fmt.Fprintf(stderr, "Error occurred while writing the rejected records: %s\n", err.Error())
+			return 1
+		}
+		return 0
+	}
+	// Without a file for them, rejected records fail the command so they
+	// aren't silently dropped
+	for _, rejection := range result.Rejected {
+		fmt.Fprintf(stderr, "Rejected record %d: %s\n", rejection.Index, rejection.Error)
+	}
+	if len(result.Rejected) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// writeOutput writes to the file at path, or to fallback when path is
+// empty.
+func writeOutput(path string, fallback io.Writer, write func(io.Writer) error) error {
+	if path == "" {
+		return write(fallback)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+	if err := write(buffered); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,276 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The formats user records can be read and written in by TransformBatch
+// and WriteOutputs.
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// The API versions whose rendering WriteOutputs can use.
+const (
+	VersionV1 = "v1"
+	VersionV2 = "v2"
+)
+
+// csvColumns are the columns of a CSV of UserOutputs, in the order written.
+var csvColumns = []string{"user_id", "name", "weekday_of_birth", "created_on"}
+
+// Rejection is a record TransformBatch couldn't transform.
+type Rejection struct {
+	// Index is the record's position in the input, from 0.
+	Index int `json:"index"`
+	// Input is the record as read, or nil when it couldn't be read.
+	Input *UserInput `json:"record"`
+	Error string     `json:"error"`
+}
+
+// BatchResult holds the records of a batch which were transformed, along
+// with those which were rejected.
+type BatchResult struct {
+	// Inputs are the accepted records, transformed into the Outputs at the
+	// same positions.
+	Inputs   []UserInput
+	Outputs  []UserOutput
+	Rejected []Rejection
+}
+
+// ParseFormat checks the name of a format, such as from a flag.
+func ParseFormat(format string) (string, error) {
+	switch format := strings.ToLower(format); format {
+	case FormatJSON, FormatNDJSON, FormatCSV:
+		return format, nil
+	case "jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected json, ndjson or csv", format)
+}
+
+// TransformBatch reads user records in the format, then validates and
+// transforms each like /user. Unlike /user, a record which is missing
+// fields or can't be transformed is rejected on its own rather than
+// failing the whole batch, as are NDJSON lines and CSV rows which can't be
+// parsed. JSON input is read like the body of /user, so only the last of
+// several arrays is kept, and CSV input has a header row naming the
+// user_id, name, date_of_birth and created_on columns, in any order, with
+// empty cells treated as missing.
+func TransformBatch(r io.Reader, format string) (*BatchResult, error) {
+	var records []batchRecord
+	var err error
+	switch format {
+	case FormatJSON:
+		records, err = readJSON(r)
+	case FormatNDJSON:
+		records, err = readNDJSON(r)
+	case FormatCSV:
+		records, err = readCSV(r)
+	default:
+		_, err = ParseFormat(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BatchResult{}
+	for index, record := range records {
+		rejection := Rejection{Index: index, Input: record.input}
+		if record.err != nil {
+			rejection.Error = record.err.Error()
+			result.Rejected = append(result.Rejected, rejection)
+			continue
+		}
+		if err := validateUserInput(index, *record.input); err != nil {
+			rejection.Error = err.Error()
+			result.Rejected = append(result.Rejected, rejection)
+			continue
+		}
+		userOutput, err := transformUserInput(index, *record.input)
+		if err != nil {
+			rejection.Error = err.Error()
+			result.Rejected = append(result.Rejected, rejection)
+			continue
+		}
+		result.Inputs = append(result.Inputs, *record.input)
+		result.Outputs = append(result.Outputs, userOutput)
+	}
+	return result, nil
+}
+
+// batchRecord is a record read from a batch, or why it couldn't be read.
+type batchRecord struct {
+	input *UserInput
+	err   error
+}
+
+// readJSON reads the records as /user does. Since the records' boundaries
+// are lost, a syntax error fails the whole batch.
+func readJSON(r io.Reader) ([]batchRecord, error) {
+	userInputs, err := decodeUserInputs(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]batchRecord, len(userInputs))
+	for index := range userInputs {
+		records[index] = batchRecord{input: &userInputs[index]}
+	}
+	return records, nil
+}
+
+// readNDJSON reads a record from each line, skipping blank lines.
+func readNDJSON(r io.Reader) ([]batchRecord, error) {
+	var records []batchRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		userInput := &UserInput{}
+		if err := json.Unmarshal(text, userInput); err != nil {
+			records = append(records, batchRecord{err: fmt.Errorf("line %d: %s", line, err.Error())})
+			continue
+		}
+		records = append(records, batchRecord{input: userInput})
+	}
+	return records, scanner.Err()
+}
+
+// readCSV reads a record from each row after the header.
+func readCSV(r io.Reader) ([]batchRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for index, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = index
+	}
+
+	var records []batchRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			records = append(records, batchRecord{err: err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		userInput, err := parseCSVRow(row, columns)
+		if err != nil {
+			err = fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		records = append(records, batchRecord{input: userInput, err: err})
+	}
+}
+
+// parseCSVRow reads the record from the row's cells, leaving the fields
+// whose cells are missing or empty nil.
+func parseCSVRow(row []string, columns map[string]int) (*UserInput, error) {
+	cell := func(name string) *string {
+		index, ok := columns[name]
+		if !ok || index >= len(row) || row[index] == "" {
+			return nil
+		}
+		return &row[index]
+	}
+
+	userInput := &UserInput{Name: cell("name"), DateOfBirth: cell("date_of_birth")}
+	if value := cell("user_id"); value != nil {
+		userId, err := strconv.Atoi(*value)
+		if err != nil {
+			return userInput, fmt.Errorf("user_id: %s", err.Error())
+		}
+		userInput.UserId = &userId
+	}
+	if value := cell("created_on"); value != nil {
+		createdOn, err := strconv.ParseInt(*value, 10, 64)
+		if err != nil {
+			return userInput, fmt.Errorf("created_on: %s", err.Error())
+		}
+		userInput.CreatedOn = &createdOn
+	}
+	return userInput, nil
+}
+
+// WriteOutputs writes the batch's outputs in the format, rendered like
+// the given version of /user.
+func WriteOutputs(w io.Writer, format string, version string, result *BatchResult) error {
+	var rows []UserOutput
+	var rendered interface{}
+	switch version {
+	case VersionV1:
+		rows = result.Outputs
+		if rows == nil {
+			// Encoded as an empty array rather than null
+			rows = []UserOutput{}
+		}
+		rendered = renderV1(result.Inputs, rows)
+	case VersionV2:
+		outputsV2 := renderV2(result.Inputs, result.Outputs).([]UserOutputV2)
+		rendered = outputsV2
+		for _, output := range outputsV2 {
+			rows = append(rows, UserOutput(output))
+		}
+	default:
+		return fmt.Errorf("unknown version %q, expected v1 or v2", version)
+	}
+
+	switch format {
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(rendered)
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(csvColumns)
+		for _, row := range rows {
+			writer.Write([]string{strconv.Itoa(row.UserId), row.Name, row.WeekdayOfBirth, row.CreatedOn})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	_, err := ParseFormat(format)
+	return err
+}
+
+// WriteRejections writes each rejection as a line of JSON.
+func WriteRejections(w io.Writer, rejected []Rejection) error {
+	encoder := json.NewEncoder(w)
+	for _, rejection := range rejected {
+		if err := encoder.Encode(rejection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,12 +1,19 @@
 package users
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
+// OutputTimeZone is the location that CreatedOn timestamps are reported in.
+const OutputTimeZone = "EST"
+
+// dateOfBirthLayout is the format of a UserInput's DateOfBirth.
+const dateOfBirthLayout = "2006-01-02"
+
 type UserInput struct {
 	UserId      *int    `json:"user_id"`
 	Name        *string `json:"name"`
@@ -14,10 +21,61 @@ type UserInput struct {
 	CreatedOn   *int64  `json:"created_on"`
 }
 
-// Validates whether or not a given UserInput is valid (all fields are defined)
+// ValidationError lists the required fields missing from a UserInput,
+// along with those which are present but malformed.
+type ValidationError struct {
+	Index         int
+	MissingFields []string
+	// InvalidFields maps each malformed field to how it should be formatted.
+	InvalidFields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	var problems []string
+	if e.MissingFields != nil {
+		problems = append(problems, "is missing required fields: "+strings.Join(e.MissingFields, ", "))
+	}
+	if e.InvalidFields != nil {
+		var invalid []string
+		for _, field := range e.invalidFieldNames() {
+			invalid = append(invalid, field+" "+e.InvalidFields[field])
+		}
+		problems = append(problems, "has invalid fields: "+strings.Join(invalid, ", "))
+	}
+	return fmt.Sprintf("the UserInput entity at index %d %s", e.Index, strings.Join(problems, " and "))
+}
+
+// invalidFieldNames lists the malformed fields in a stable order.
+func (e *ValidationError) invalidFieldNames() []string {
+	fields := make([]string, 0, len(e.InvalidFields))
+	for field := range e.InvalidFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Validates whether or not a given UserInput is valid (all fields are
+// defined, and the date of birth is formatted as YYYY-MM-DD)
 func (ui UserInput) validate() error {
-	if ui.UserId == nil || ui.Name == nil || ui.DateOfBirth == nil || ui.CreatedOn == nil {
-		return errors.New("the UserInput entity is missing required fields")
+	var missingFields []string
+	var invalidFields map[string]string
+	if ui.UserId == nil {
+		missingFields = append(missingFields, "user_id")
+	}
+	if ui.Name == nil {
+		missingFields = append(missingFields, "name")
+	}
+	if ui.DateOfBirth == nil {
+		missingFields = append(missingFields, "date_of_birth")
+	} else if _, err := time.Parse(dateOfBirthLayout, *ui.DateOfBirth); err != nil {
+		invalidFields = map[string]string{"date_of_birth": "must be formatted as YYYY-MM-DD"}
+	}
+	if ui.CreatedOn == nil {
+		missingFields = append(missingFields, "created_on")
+	}
+	if missingFields != nil || invalidFields != nil {
+		return &ValidationError{MissingFields: missingFields, InvalidFields: invalidFields}
 	}
 
 	return nil
@@ -33,7 +91,7 @@ func (ui UserInput) generateUserOutput() (userOutput UserOutput, err error) {
 	}
 
 	// attempt to extract the day of the week from the date of birth
-	dateOfBirth, err := time.Parse("2006-01-02", *ui.DateOfBirth)
+	dateOfBirth, err := time.Parse(dateOfBirthLayout, *ui.DateOfBirth)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error occurred while parsing the user's DOB: %s", err.Error())
 		return userOutput, err
@@ -41,7 +99,7 @@ func (ui UserInput) generateUserOutput() (userOutput UserOutput, err error) {
 	userOutput.WeekdayOfBirth = dateOfBirth.Weekday().String()
 
 	// attempt to extract the time in the appropriate timezone and format
-	location, err := time.LoadLocation("EST")
+	location, err := time.LoadLocation(OutputTimeZone)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error occurred while finding the time zone: %s", err.Error())
 		return userOutput, err
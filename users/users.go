@@ -2,10 +2,13 @@ package users
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+
+	"github.com/elehner/takehomeserver/problem"
 )
 
 const (
@@ -15,27 +18,33 @@ const (
 	ErrorEncodingInput      = "Error encoding the processed data"
 )
 
+// outputRenderer converts the transformed users into the response body
+// for a version of the API.
+type outputRenderer func(userInputs []UserInput, userOutputs []UserOutput) interface{}
+
 // HandleUserRequest directs the request to the appropriate call based
-// on the request method.
+// on the request method. It serves v1 of the API, whose UserOutput
+// reports created_on in EST.
 func HandleUserRequest(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		handleUserInputs(w, r)
+		handleUserInputs(w, r, renderV1)
 	default:
-		http.Error(w, ErrorMethodNotSupported, http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", "POST")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
 	}
 }
 
 // handleUserInputs processes the user defined objects received
 // from the client, and responds to the request with either the
-// transformed inputs or an error.
-func handleUserInputs(w http.ResponseWriter, r *http.Request) {
+// transformed inputs (as rendered for the API version) or an error.
+func handleUserInputs(w http.ResponseWriter, r *http.Request, render outputRenderer) {
 	body := r.Body
 	defer body.Close()
 	// Utilize a json decoder since we're dealing with a stream
 	userInputs, err := processUserInputs(&body)
 	if err != nil {
-		http.Error(w, ErrorParsingInput, http.StatusBadRequest)
+		problem.Write(w, r, parsingProblem(err))
 		return
 	}
 	// Don't bother parsing an empty request
@@ -46,43 +55,96 @@ func handleUserInputs(w http.ResponseWriter, r *http.Request) {
 
 	userOutputs, err := transformUserInputs(userInputs)
 	if err != nil {
-		http.Error(w, ErrorProcessingInput, http.StatusInternalServerError)
+		problem.Write(w, r, processingProblem(err))
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(userOutputs)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(render(userInputs, userOutputs))
 	if err != nil {
-		http.Error(w, ErrorEncodingInput, http.StatusInternalServerError)
+		problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeEncodingFailed, ErrorEncodingInput))
 		return
 	}
 }
 
+func renderV1(userInputs []UserInput, userOutputs []UserOutput) interface{} {
+	return userOutputs
+}
+
+// parsingProblem describes why the request body could not be parsed,
+// including the missing and malformed fields when validation failed.
+func parsingProblem(err error) *problem.Problem {
+	p := problem.New(http.StatusBadRequest, problem.CodeInvalidInput, ErrorParsingInput).WithDetail(err.Error())
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		for _, field := range validationErr.MissingFields {
+			p.WithFieldErrors(problem.FieldError{
+				Field:   fmt.Sprintf("[%d].%s", validationErr.Index, field),
+				Message: "is required",
+			})
+		}
+		for _, field := range validationErr.invalidFieldNames() {
+			p.WithFieldErrors(problem.FieldError{
+				Field:   fmt.Sprintf("[%d].%s", validationErr.Index, field),
+				Message: validationErr.InvalidFields[field],
+			})
+		}
+	}
+
+	return p
+}
+
+// processingProblem describes why valid inputs could not be transformed.
+func processingProblem(err error) *problem.Problem {
+	return problem.New(http.StatusInternalServerError, problem.CodeProcessingFailed, ErrorProcessingInput).WithDetail(err.Error())
+}
+
 // processUserInputs transforms the body of an http request into a slice of UserInputs.
 // On Error, it returns nil and the associated error.
 func processUserInputs(body *io.ReadCloser) (userInputs []UserInput, err error) {
+	userInputs, err = decodeUserInputs(*body)
+	if err != nil {
+		// These (and other Fprintfs) should be moved to logs to track data over time & appropriate error levels
+		fmt.Fprintf(os.Stderr, "Error occurred while parsing the user's input: %s", err.Error())
+		return nil, err
+	}
+
+	// Validate the parsed input objects
+	for index, userInput := range userInputs {
+		if err = validateUserInput(index, userInput); err != nil {
+			return nil, err
+		}
+	}
+
+	return userInputs, err
+}
+
+// decodeUserInputs reads a stream of JSON arrays of UserInputs. Each array
+// is decoded over the last, so only the last array's UserInputs are
+// returned, or nil when the stream is empty.
+func decodeUserInputs(r io.Reader) (userInputs []UserInput, err error) {
 	// Utilize a json decoder since we're dealing with a stream
-	userInputsDecoder := json.NewDecoder(*body)
+	userInputsDecoder := json.NewDecoder(r)
 	for {
 		// Loop over elements to ensure the entire message is parsed correctly
 		if err = userInputsDecoder.Decode(&userInputs); err == io.EOF {
-			err = nil
-			break
+			return userInputs, nil
 		} else if err != nil {
-			// These (and other Fprintfs) should be moved to logs to track data over time & appropriate error levels
-			fmt.Fprintf(os.Stderr, "Error occurred while parsing the user's input: %s", err.Error())
 			return nil, err
 		}
 	}
+}
 
-	// Validate the parsed input objects
-	for _, userInput := range userInputs {
-		err = userInput.validate()
-		if err != nil {
-			return nil, err
-		}
+// validateUserInput checks the UserInput at the index has every field,
+// recording the index in any ValidationError.
+func validateUserInput(index int, userInput UserInput) error {
+	err := userInput.validate()
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		validationErr.Index = index
 	}
-
-	return userInputs, err
+	return err
 }
 
 // transformUserInputs generates a slice of UserOuputs from the given slice of UserInputs.
@@ -91,7 +153,7 @@ func transformUserInputs(userInputs []UserInput) (userOutputs []UserOutput, err
 	// Generate the slice of user outputs from the slice of user inputs
 	userOutputs = make([]UserOutput, len(userInputs))
 	for index, userInput := range userInputs {
-		userOutputs[index], err = userInput.generateUserOutput()
+		userOutputs[index], err = transformUserInput(index, userInput)
 		if err != nil {
 			return nil, err
 		}
@@ -99,3 +161,12 @@ func transformUserInputs(userInputs []UserInput) (userOutputs []UserOutput, err
 
 	return userOutputs, nil
 }
+
+// transformUserInput generates the UserOutput of the UserInput at the index.
+func transformUserInput(index int, userInput UserInput) (UserOutput, error) {
+	userOutput, err := userInput.generateUserOutput()
+	if err != nil {
+		return UserOutput{}, fmt.Errorf("the UserInput entity at index %d could not be processed: %w", index, err)
+	}
+	return userOutput, nil
+}
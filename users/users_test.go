@@ -1,6 +1,7 @@
 package users
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,6 +9,8 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/elehner/takehomeserver/problem"
 )
 
 func TestNonPostError(t *testing.T) {
@@ -47,11 +50,11 @@ func TestHandleUserRequestPostResponses(t *testing.T) {
 			http.StatusBadRequest,
 			ErrorParsingInput,
 		},
-		// cannot process requests with malformed dates
+		// Treats malformed dates as bad requests
 		{
 			`[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-124", "created_on": 1642612034 }]`,
-			http.StatusInternalServerError,
-			ErrorProcessingInput,
+			http.StatusBadRequest,
+			ErrorParsingInput,
 		},
 		// Can parse the expected values
 		{
@@ -96,6 +99,106 @@ func TestHandleUserRequestPostResponses(t *testing.T) {
 	}
 }
 
+func TestHandleUserRequestProblemResponses(t *testing.T) {
+	tests := []struct {
+		json                 string
+		expectedResponseCode int
+		expectedCode         string
+		expectedFieldErrors  []problem.FieldError
+	}{
+		{"this is not json", http.StatusBadRequest, problem.CodeInvalidInput, nil},
+		{
+			`[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }, {"name": "Jane Smith"}]`,
+			http.StatusBadRequest,
+			problem.CodeInvalidInput,
+			[]problem.FieldError{
+				{Field: "[1].user_id", Message: "is required"},
+				{Field: "[1].date_of_birth", Message: "is required"},
+				{Field: "[1].created_on", Message: "is required"},
+			},
+		},
+		{
+			`[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034 }, {"user_id": 2, "name": "Jane Smith", "date_of_birth": "1983-05-124"}]`,
+			http.StatusBadRequest,
+			problem.CodeInvalidInput,
+			[]problem.FieldError{
+				{Field: "[1].created_on", Message: "is required"},
+				{Field: "[1].date_of_birth", Message: "must be formatted as YYYY-MM-DD"},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("HandleUserRequest=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "localhost:8080", strings.NewReader(test.json))
+			req.Header.Set("Accept", problem.ContentType)
+			w := httptest.NewRecorder()
+
+			HandleUserRequest(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, resp.StatusCode)
+			}
+			if resp.Header.Get("Content-Type") != problem.ContentType {
+				t.Errorf("Content-Type was %s, expected %s", resp.Header.Get("Content-Type"), problem.ContentType)
+			}
+
+			var received problem.Problem
+			if err := json.NewDecoder(resp.Body).Decode(&received); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if received.Code != test.expectedCode {
+				t.Errorf("Code was %s, expected %s", received.Code, test.expectedCode)
+			}
+			if !reflect.DeepEqual(received.Errors, test.expectedFieldErrors) {
+				t.Errorf("Received: %v, Expected: %v", received.Errors, test.expectedFieldErrors)
+			}
+		})
+	}
+}
+
+func TestHandleUserRequestV2(t *testing.T) {
+	tests := []struct {
+		method               string
+		json                 string
+		expectedResponseCode int
+		expectedResponseBody string
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, ErrorMethodNotSupported},
+		{"POST", "", http.StatusNoContent, ""},
+		{"POST", "this is not json", http.StatusBadRequest, ErrorParsingInput},
+		// created_on is reported in UTC rather than EST
+		{
+			"POST",
+			`[{"user_id": 3, "name": "Doe Smith", "date_of_birth": "1985-05-11", "created_on": 1250000000 }]`,
+			http.StatusOK,
+			`[{"user_id":3,"name":"Doe Smith","weekday_of_birth":"Saturday","created_on":"2009-08-11T14:13:20Z"}]`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("HandleUserRequestV2=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "localhost:8080", strings.NewReader(test.json))
+			w := httptest.NewRecorder()
+
+			HandleUserRequestV2(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != test.expectedResponseCode {
+				t.Errorf("Expected status code to be %d, but was %d", test.expectedResponseCode, resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+			if strings.TrimSpace(string(body)) != test.expectedResponseBody {
+				t.Errorf("Body was %s, expected %s", string(body), test.expectedResponseBody)
+			}
+		})
+	}
+}
+
 func TestProcessUserInputs(t *testing.T) {
 	tests := []struct {
 		json               string
@@ -130,6 +233,12 @@ func TestProcessUserInputs(t *testing.T) {
 			true,
 			nil,
 		},
+		// Treats malformed dates as invalid
+		{
+			`[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-124", "created_on": 1642612034 }]`,
+			true,
+			nil,
+		},
 		// Can parse the expected values
 		{"", false, nil},
 		{"[]", false, []UserInput{}},
@@ -213,6 +322,106 @@ func TestTransformUserInputs(t *testing.T) {
 	}
 }
 
+func TestTransformBatch(t *testing.T) {
+	joe := baseUserInputGen(1, "Joe Smith", "1983-05-12", 1642612034)
+	jane := baseUserInputGen(2, "Jane Smith", "1984-05-10", 1642612035)
+	joeOutput := UserOutput{UserId: 1, Name: "Joe Smith", WeekdayOfBirth: "Thursday", CreatedOn: "2022-01-19T12:07:14-05:00"}
+	janeOutput := UserOutput{UserId: 2, Name: "Jane Smith", WeekdayOfBirth: "Thursday", CreatedOn: "2022-01-19T12:07:15-05:00"}
+
+	tests := []struct {
+		name             string
+		format           string
+		input            string
+		expectsError     bool
+		expectedInputs   []UserInput
+		expectedOutputs  []UserOutput
+		expectedRejected []int
+	}{
+		{"json", FormatJSON, `[{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034}, {"name": "Nobody"},
+			{"user_id": 2, "name": "Jane Smith", "date_of_birth": "1984-05-10", "created_on": 1642612035}, {"user_id": 3, "name": "Bad Date", "date_of_birth": "1985-05-124", "created_on": 1642612036}]`,
+			false, []UserInput{joe, jane}, []UserOutput{joeOutput, janeOutput}, []int{1, 3}},
+		// Like /user, only the last of several arrays is kept
+		{"json arrays", FormatJSON, `[{"name": "Nobody"}, {"name": "Nobody Else"}]
+			[{"user_id": 2, "name": "Jane Smith", "date_of_birth": "1984-05-10", "created_on": 1642612035}]`,
+			false, []UserInput{jane}, []UserOutput{janeOutput}, nil},
+		{"empty json", FormatJSON, "", false, nil, nil, nil},
+		{"invalid json", FormatJSON, "this is not json", true, nil, nil, nil},
+		{"ndjson", FormatNDJSON, `{"user_id": 1, "name": "Joe Smith", "date_of_birth": "1983-05-12", "created_on": 1642612034}
+
+			this is not json
+			{"user_id": 2, "name": "Jane Smith", "date_of_birth": "1984-05-10", "created_on": 1642612035}
+			{"user_id": "2"}`,
+			false, []UserInput{joe, jane}, []UserOutput{joeOutput, janeOutput}, []int{1, 3}},
+		{"csv", FormatCSV, "name,user_id,created_on,date_of_birth\n" +
+			"Joe Smith,1,1642612034,1983-05-12\n" +
+			",4,1642612034,1983-05-12\n" +
+			"\"Jane Smith\",2,1642612035,1984-05-10\n" +
+			"Bad Id,x,1642612034,1983-05-12\n",
+			false, []UserInput{joe, jane}, []UserOutput{joeOutput, janeOutput}, []int{1, 3}},
+		{"unknown format", "xml", "<users/>", true, nil, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := TransformBatch(strings.NewReader(test.input), test.format)
+			if (err != nil) != test.expectsError {
+				t.Fatalf("Expected an error to be %v, but was %v", test.expectsError, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(result.Inputs, test.expectedInputs) || !reflect.DeepEqual(result.Outputs, test.expectedOutputs) {
+				t.Errorf("Received: %v, %v, Expected: %v, %v", result.Inputs, result.Outputs, test.expectedInputs, test.expectedOutputs)
+			}
+			var rejected []int
+			for _, rejection := range result.Rejected {
+				rejected = append(rejected, rejection.Index)
+				if rejection.Error == "" {
+					t.Errorf("Expected rejection %d to say why", rejection.Index)
+				}
+			}
+			if !reflect.DeepEqual(rejected, test.expectedRejected) {
+				t.Errorf("Rejected %v, expected %v", rejected, test.expectedRejected)
+			}
+		})
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	result := &BatchResult{
+		Inputs:  []UserInput{baseUserInputGen(1, "Smith, Joe", "1983-05-12", 1642612034)},
+		Outputs: []UserOutput{{UserId: 1, Name: "Smith, Joe", WeekdayOfBirth: "Thursday", CreatedOn: "2022-01-19T12:07:14-05:00"}},
+	}
+
+	tests := []struct {
+		format   string
+		version  string
+		expected string
+	}{
+		{FormatJSON, VersionV1, `[{"user_id":1,"name":"Smith, Joe","weekday_of_birth":"Thursday","created_on":"2022-01-19T12:07:14-05:00"}]` + "\n"},
+		{FormatJSON, VersionV2, `[{"user_id":1,"name":"Smith, Joe","weekday_of_birth":"Thursday","created_on":"2022-01-19T17:07:14Z"}]` + "\n"},
+		{FormatNDJSON, VersionV2, `{"user_id":1,"name":"Smith, Joe","weekday_of_birth":"Thursday","created_on":"2022-01-19T17:07:14Z"}` + "\n"},
+		{FormatCSV, VersionV1, "user_id,name,weekday_of_birth,created_on\n1,\"Smith, Joe\",Thursday,2022-01-19T12:07:14-05:00\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format+" "+test.version, func(t *testing.T) {
+			output := new(strings.Builder)
+			if err := WriteOutputs(output, test.format, test.version, result); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if output.String() != test.expected {
+				t.Errorf("Received: %s, Expected: %s", output.String(), test.expected)
+			}
+		})
+	}
+
+	empty := new(strings.Builder)
+	if err := WriteOutputs(empty, FormatJSON, VersionV1, &BatchResult{}); err != nil || empty.String() != "[]\n" {
+		t.Errorf("Expected an empty array, but was %q: %v", empty.String(), err)
+	}
+}
+
 func baseUserInputGen(id int, name string, dateOfBirth string, createdOn int64) UserInput {
 	return UserInput{
 		UserId:      &id,
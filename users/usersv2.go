@@ -0,0 +1,43 @@
+package users
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/elehner/takehomeserver/problem"
+)
+
+// UserOutputV2 is the v2 representation of a transformed user. Unlike
+// UserOutput, created_on is reported in UTC.
+type UserOutputV2 struct {
+	UserId         int    `json:"user_id"`
+	Name           string `json:"name"`
+	WeekdayOfBirth string `json:"weekday_of_birth"`
+	CreatedOn      string `json:"created_on"`
+}
+
+// HandleUserRequestV2 directs the request to the appropriate call based
+// on the request method, responding with UserOutputV2s.
+func HandleUserRequestV2(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		handleUserInputs(w, r, renderV2)
+	default:
+		w.Header().Set("Allow", "POST")
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ErrorMethodNotSupported))
+	}
+}
+
+func renderV2(userInputs []UserInput, userOutputs []UserOutput) interface{} {
+	userOutputsV2 := make([]UserOutputV2, len(userOutputs))
+	for index, userOutput := range userOutputs {
+		userOutputsV2[index] = UserOutputV2{
+			UserId:         userOutput.UserId,
+			Name:           userOutput.Name,
+			WeekdayOfBirth: userOutput.WeekdayOfBirth,
+			CreatedOn:      time.Unix(*userInputs[index].CreatedOn, 0).UTC().Format(time.RFC3339),
+		}
+	}
+
+	return userOutputsV2
+}
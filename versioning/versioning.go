@@ -0,0 +1,111 @@
+// Package versioning registers handlers under version prefixes such as /v1,
+// and advertises the deprecation and sunset dates of old versions.
+package versioning
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version describes a single API version and its lifecycle.
+type Version struct {
+	// Name is used as the route prefix, e.g. "v1" serves /v1/user.
+	Name string
+	// Deprecated is when the version was deprecated. The zero value means
+	// the version is current.
+	Deprecated time.Time
+	// Sunset is when the version will stop being served. The zero value
+	// means no date has been set.
+	Sunset time.Time
+	// Successor is the version clients should migrate to, if any.
+	Successor string
+}
+
+// Router registers versioned handlers on a ServeMux.
+type Router struct {
+	mux      *http.ServeMux
+	versions map[string]Version
+	routes   map[string][]string
+}
+
+func NewRouter(mux *http.ServeMux) *Router {
+	return &Router{
+		mux:      mux,
+		versions: make(map[string]Version),
+		routes:   make(map[string][]string),
+	}
+}
+
+// Handle registers the handler for a version at /<version>/<pattern>.
+// Different versions of the same pattern can be registered side by side.
+func (router *Router) Handle(version Version, pattern string, handler http.Handler) {
+	router.versions[version.Name] = version
+	router.routes[version.Name] = append(router.routes[version.Name], pattern)
+	router.mux.Handle(Path(version.Name, pattern), router.withHeaders(version, pattern, handler))
+}
+
+// HandleFunc registers the handler function for a version at /<version>/<pattern>.
+func (router *Router) HandleFunc(version Version, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	router.Handle(version, pattern, http.HandlerFunc(handler))
+}
+
+// HandleUnversioned registers the handler at the bare pattern, for clients
+// which predate versioning. The responses carry the headers of the version
+// the bare pattern is an alias of.
+func (router *Router) HandleUnversioned(version Version, pattern string, handler http.Handler) {
+	router.mux.Handle(pattern, router.withHeaders(version, pattern, handler))
+}
+
+// Versions lists the registered version names, sorted.
+func (router *Router) Versions() []string {
+	names := make([]string, 0, len(router.versions))
+	for name := range router.versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Routes lists the patterns registered for a version.
+func (router *Router) Routes(version string) []string {
+	return router.routes[version]
+}
+
+func (router *Router) hasRoute(version string, pattern string) bool {
+	for _, route := range router.routes[version] {
+		if route == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the route for a pattern under a version prefix.
+func Path(version string, pattern string) string {
+	return "/" + version + "/" + strings.TrimPrefix(pattern, "/")
+}
+
+// withHeaders wraps the handler so that every response reports the version
+// it was served by, along with its deprecation details.
+func (router *Router) withHeaders(version Version, pattern string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("API-Version", version.Name)
+		if !version.Deprecated.IsZero() {
+			// RFC 9745 structured field date
+			header.Set("Deprecation", fmt.Sprintf("@%d", version.Deprecated.Unix()))
+		}
+		if !version.Sunset.IsZero() {
+			// RFC 8594 HTTP-date
+			header.Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if version.Successor != "" && router.hasRoute(version.Successor, pattern) {
+			header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, Path(version.Successor, pattern)))
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package versioning
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRouterHeaders(t *testing.T) {
+	v1 := Version{
+		Name:       "v1",
+		Deprecated: time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+		Sunset:     time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC),
+		Successor:  "v2",
+	}
+	v2 := Version{Name: "v2"}
+
+	mux := http.NewServeMux()
+	router := NewRouter(mux)
+	versionHandler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}
+	}
+	router.HandleFunc(v1, "/user", versionHandler("v1 user"))
+	router.HandleFunc(v1, "/image", versionHandler("v1 image"))
+	router.HandleFunc(v2, "/user", versionHandler("v2 user"))
+	router.HandleUnversioned(v1, "/user", versionHandler("v1 user"))
+
+	tests := []struct {
+		path                string
+		expectedBody        string
+		expectedVersion     string
+		expectedDeprecation string
+		expectedSunset      string
+		expectedLink        string
+	}{
+		{"/v1/user", "v1 user", "v1", "@1792368000", "Thu, 01 Apr 2027 00:00:00 GMT", `</v2/user>; rel="successor-version"`},
+		// There is no v2 image, so no successor is linked
+		{"/v1/image", "v1 image", "v1", "@1792368000", "Thu, 01 Apr 2027 00:00:00 GMT", ""},
+		{"/v2/user", "v2 user", "v2", "", "", ""},
+		{"/user", "v1 user", "v1", "@1792368000", "Thu, 01 Apr 2027 00:00:00 GMT", `</v2/user>; rel="successor-version"`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Router=%d", i), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost:8080"+test.path, nil)
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			if w.Body.String() != test.expectedBody {
+				t.Errorf("Body was %s, expected %s", w.Body.String(), test.expectedBody)
+			}
+			headers := map[string]string{
+				"API-Version": test.expectedVersion,
+				"Deprecation": test.expectedDeprecation,
+				"Sunset":      test.expectedSunset,
+				"Link":        test.expectedLink,
+			}
+			for name, expected := range headers {
+				if w.Header().Get(name) != expected {
+					t.Errorf("%s header was %q, expected %q", name, w.Header().Get(name), expected)
+				}
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(router.Versions(), []string{"v1", "v2"}) {
+		t.Errorf("Versions were %v, expected [v1 v2]", router.Versions())
+	}
+	if !reflect.DeepEqual(router.Routes("v1"), []string{"/user", "/image"}) {
+		t.Errorf("v1 routes were %v, expected [/user /image]", router.Routes("v1"))
+	}
+}